@@ -0,0 +1,182 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+//roles given by channel status, to whoever has that prefix or a higher one on the channel
+//the command was sent to
+var statusRoles = map[string]byte{"op": '@', "halfop": '%', "voice": '+'}
+
+//ACL gives roles to users by hostmask or services account, and from their status on the
+//channel. Commands of a Router with an ACL require one of their Roles.
+type ACL struct {
+	n        *Network
+	lock     *sync.RWMutex
+	masks    map[string][]string //hostmask glob -> roles
+	accounts map[string][]string //folded account -> roles
+	audit    *log.Logger
+}
+
+//NewACL returns an empty ACL, auditing to the network log
+func (n *Network) NewACL() *ACL {
+	return &ACL{n, new(sync.RWMutex), make(map[string][]string), make(map[string][]string), n.l}
+}
+
+//SetAuditLog makes the ACL log the use of privileged commands to w
+func (a *ACL) SetAuditLog(w io.Writer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.audit = log.New(w, "", log.Ldate|log.Ltime)
+}
+
+func addRole(roles []string, role string) []string {
+	for _, r := range roles {
+		if r == role {
+			return roles
+		}
+	}
+	return append(roles, role)
+}
+
+func delRole(roles []string, role string) []string {
+	for i, r := range roles {
+		if r == role {
+			return append(roles[:i], roles[i+1:]...)
+		}
+	}
+	return roles
+}
+
+//GrantMask gives role to the users matching the hostmask glob mask
+func (a *ACL) GrantMask(mask, role string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.masks[mask] = addRole(a.masks[mask], role)
+}
+
+//GrantAccount gives role to the users logged in to services as account
+func (a *ACL) GrantAccount(account, role string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	account = a.n.Fold(account)
+	a.accounts[account] = addRole(a.accounts[account], role)
+}
+
+//RevokeMask takes role back from mask
+func (a *ACL) RevokeMask(mask, role string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if roles := delRole(a.masks[mask], role); len(roles) > 0 {
+		a.masks[mask] = roles
+	} else {
+		a.masks[mask] = nil, false
+	}
+}
+
+//RevokeAccount takes role back from account
+func (a *ACL) RevokeAccount(account, role string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	account = a.n.Fold(account)
+	if roles := delRole(a.accounts[account], role); len(roles) > 0 {
+		a.accounts[account] = roles
+	} else {
+		a.accounts[account] = nil, false
+	}
+}
+
+//account returns the services account of nick, asking with WHOIS unless the state tracker
+//knows it, which it does for users sharing a channel with us with account-notify and
+//extended-join: only then is a missing account a sure logged out
+func (a *ACL) account(nick string) string {
+	u, _ := a.n.LookupUser(nick)
+	if u.Account != "" || (a.n.channels.shares(nick) && a.n.HasCap("account-notify") && a.n.HasCap("extended-join")) {
+		return u.Account
+	}
+	a.lock.RLock()
+	none := len(a.accounts) == 0
+	a.lock.RUnlock()
+	if none {
+		return ""
+	}
+	whois, err := a.n.Whois([]string{nick}, "")
+	if err != nil {
+		return ""
+	}
+	for _, line := range whois[replies["RPL_WHOISACCOUNT"]] { //me nick account :is logged in as
+		if fields := strings.Fields(line); len(fields) > 2 && a.n.EqualFold(fields[1], nick) {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+//Roles returns the roles of the sender of a command
+func (a *ACL) Roles(c *CommandContext) []string {
+	roles := make([]string, 0)
+	a.lock.RLock()
+	for mask, r := range a.masks {
+		if a.n.MatchHostmask(mask, c.Sender) {
+			for _, role := range r {
+				roles = addRole(roles, role)
+			}
+		}
+	}
+	a.lock.RUnlock()
+	if account := a.account(c.Sender.Nick); account != "" {
+		a.lock.RLock()
+		for _, role := range a.accounts[a.n.Fold(account)] {
+			roles = addRole(roles, role)
+		}
+		a.lock.RUnlock()
+	}
+	if !c.Private {
+		if m, ok := a.n.ChannelMember(c.Target, c.Sender.Nick); ok && m.Prefixes != "" {
+			syms := a.n.ModeSpec(c.Target).PrefixSyms
+			highest := strings.IndexRune(syms, int(m.Prefixes[0]))
+			for role, sym := range statusRoles {
+				if i := strings.IndexRune(syms, int(sym)); i > -1 && highest > -1 && highest <= i {
+					roles = addRole(roles, role)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+//Allowed reports whether the sender of a command has one of roles, which is always the
+//case if roles is empty. Privileged uses, allowed or not, are audited.
+func (a *ACL) Allowed(c *CommandContext, roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	has := a.Roles(c)
+	allowed := false
+	for _, role := range roles {
+		for _, r := range has {
+			if r == role {
+				allowed = true
+			}
+		}
+	}
+	verdict := "denied"
+	if allowed {
+		verdict = "allowed"
+	}
+	a.lock.RLock()
+	audit := a.audit
+	a.lock.RUnlock()
+	audit.Printf("Audit: %s: %s in %s by %s (roles %v, needs %v): %s", verdict, c.Command, c.Target, c.Sender, has, roles, c.Line)
+	return allowed
+}
+
+//errDenied is noticed to those who lack the roles of a command
+func errDenied(cmd *Command) os.Error {
+	return os.NewError(fmt.Sprintf("Permission denied: %s needs %s", cmd.Name, strings.Join(cmd.Roles, " or ")))
+}
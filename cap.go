@@ -0,0 +1,118 @@
+package ircchans
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//IRCv3 capabilities: what we want, what the server offers and what got acknowledged
+type capSet struct {
+	lock      *sync.RWMutex
+	wanted    map[string]bool
+	available map[string]string
+	enabled   map[string]string
+}
+
+func newCapSet(wanted ...string) capSet {
+	s := capSet{new(sync.RWMutex), make(map[string]bool), make(map[string]string), make(map[string]string)}
+	for _, c := range wanted {
+		s.wanted[c] = true
+	}
+	return s
+}
+
+func (s *capSet) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.available = make(map[string]string)
+	s.enabled = make(map[string]string)
+}
+
+//RequestCap asks for capability name on the next connection
+func (n *Network) RequestCap(name string) {
+	n.caps.lock.Lock()
+	defer n.caps.lock.Unlock()
+	n.caps.wanted[name] = true
+}
+
+//HasCap reports whether capability name was acknowledged by the server
+func (n *Network) HasCap(name string) bool {
+	_, ok := n.CapValue(name)
+	return ok
+}
+
+//CapValue returns the value the server advertised with an enabled capability (e.g. sts=port=6697)
+func (n *Network) CapValue(name string) (string, bool) {
+	n.caps.lock.RLock()
+	defer n.caps.lock.RUnlock()
+	val, ok := n.caps.enabled[name]
+	return val, ok
+}
+
+//offered returns the value of capability name if the server advertised it
+func (s *capSet) offered(name string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	val, ok := s.available[name]
+	return val, ok
+}
+
+//negotiateCaps runs CAP LS/REQ/END before registration. Servers that don't know about CAP
+//simply don't answer (or answer ERR_UNKNOWNCOMMAND), in which case registration goes on without.
+//On a plain text connection, an sts capability with a port stops it with an *stsUpgrade.
+func (n *Network) negotiateCaps() os.Error {
+	n.caps.reset()
+	myreplies := []string{"ERR_UNKNOWNCOMMAND", "CAP"}
+	isLs := func(m *IrcMessage) bool {
+		return m.Cmd != "CAP" || (len(m.Params) > 2 && m.Params[1] == "LS")
+	}
+	lsDone := func(m *IrcMessage) bool {
+		return m.Cmd != "CAP" || m.Params[2] != "*" //CAP * LS * :more caps follow
+	}
+	msgs, err := n.query(&IrcMessage{"", "CAP", []string{"LS", "302"}, nil}, myreplies, isLs, lsDone)
+	if err != nil {
+		n.l.Printf("No capability negotiation: %s", err.String())
+		return nil
+	}
+	n.caps.lock.Lock()
+	for _, m := range msgs {
+		for _, c := range strings.Fields(m.Params[len(m.Params)-1]) {
+			name, val := c, ""
+			if i := strings.Index(c, "="); i > -1 {
+				name, val = c[:i], c[i+1:]
+			}
+			n.caps.available[name] = val
+		}
+	}
+	req := make([]string, 0)
+	for c, _ := range n.caps.wanted {
+		if _, ok := n.caps.available[c]; ok {
+			req = append(req, c)
+		}
+	}
+	n.caps.lock.Unlock()
+	if val, ok := n.caps.offered("sts"); ok && !n.Secure() && n.stsApplies() {
+		if port, err := strconv.Atoi(parseSts(val)["port"]); err == nil && port > 0 && port <= 0xffff {
+			return &stsUpgrade{strconv.Itoa(port)}
+		}
+	}
+	if len(req) > 0 {
+		isAck := func(m *IrcMessage) bool {
+			return m.Cmd != "CAP" || (len(m.Params) > 2 && (m.Params[1] == "ACK" || m.Params[1] == "NAK"))
+		}
+		msgs, err := n.query(&IrcMessage{"", "CAP", []string{"REQ", strings.Join(req, " ")}, nil}, myreplies, isAck, nil)
+		if err == nil && msgs[0].Cmd == "CAP" && msgs[0].Params[1] == "ACK" {
+			n.caps.lock.Lock()
+			for _, c := range strings.Fields(msgs[0].Params[len(msgs[0].Params)-1]) {
+				n.caps.enabled[c] = n.caps.available[c]
+			}
+			n.caps.lock.Unlock()
+		} else if err == nil {
+			n.l.Printf("Server refused capabilities: %s", strings.Join(req, " "))
+		}
+	}
+	n.queueOut <- &IrcMessage{"", "CAP", []string{"END"}, nil}
+	return nil
+}
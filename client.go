@@ -0,0 +1,259 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//NetworkConfig describes a network of a Client
+type NetworkConfig struct {
+	Name     string //what the client calls the network, must be unique
+	Server   string //host name, or ws:// or wss:// URL
+	Port     string
+	Nick     string
+	User     string //defaults to Nick
+	RealName string //defaults to Nick
+	Password string
+	LogFile  string   //"" for stderr
+	Version  string   //CTCP VERSION reply, IRCVERSION if empty
+	ConfDir  string   //defaults to a directory of the shared configuration directory named after the network
+	Encoding string   //"" for UTF-8
+	Channels []string //joined on connection
+	Dialer   Dialer   //nil to connect directly
+}
+
+//NetworkEvent is a message received on one of the networks of a Client
+type NetworkEvent struct {
+	Network string
+	Net     *Network
+	Msg     *IrcMessage
+}
+
+type clientPlugin struct {
+	name   string
+	create func() Plugin
+}
+
+type clientNetwork struct {
+	conf NetworkConfig
+	n    *Network
+	exch chan bool
+}
+
+//Client runs several networks, merging what they receive in Events
+type Client struct {
+	Events   chan *NetworkEvent
+	lock     *sync.RWMutex
+	networks map[string]*clientNetwork
+	plugins  []clientPlugin
+	closed   bool
+}
+
+func NewClient() *Client {
+	return &Client{make(chan *NetworkEvent, 1000), new(sync.RWMutex), make(map[string]*clientNetwork), make([]clientPlugin, 0), false}
+}
+
+//AddNetwork creates a network from conf, with the client plugins, without connecting it.
+//The plugins are registered without the client lock, they may use the client.
+func (c *Client) AddNetwork(conf NetworkConfig) (*Network, os.Error) {
+	if conf.Name == "" {
+		conf.Name = conf.Server
+	}
+	if conf.User == "" {
+		conf.User = conf.Nick
+	}
+	if conf.RealName == "" {
+		conf.RealName = conf.Nick
+	}
+	if conf.ConfDir == "" {
+		conf.ConfDir = confdir + "/networks/" + SanitizeFilename(conf.Name)
+	}
+	c.lock.RLock()
+	_, exists := c.networks[conf.Name]
+	c.lock.RUnlock()
+	if exists {
+		return nil, os.NewError(fmt.Sprintf("Network %s already exists", conf.Name))
+	}
+	n := NewNetwork(conf.Server, conf.Port, conf.Nick, conf.User, conf.RealName, conf.Password, conf.LogFile)
+	if conf.Version != "" {
+		n.SetVersion(conf.Version)
+	}
+	if err := n.SetConfDir(conf.ConfDir); err != nil {
+		return nil, err
+	}
+	if conf.Dialer != nil {
+		n.SetDialer(conf.Dialer)
+	}
+	if conf.Encoding != "" {
+		if err := n.SetEncoding(conf.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	cn := &clientNetwork{conf, n, make(chan bool)}
+	ch := make(chan *IrcMessage, 100)
+	if err := n.Listen.RegListener("*", "client", ch); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Couldn't register client listener: %s", err.String()))
+	}
+	c.lock.Lock()
+	if _, exists = c.networks[conf.Name]; exists || c.closed { //added or shut down meanwhile
+		c.lock.Unlock()
+		n.Listen.DelListener("*", "client")
+		if exists {
+			return nil, os.NewError(fmt.Sprintf("Network %s already exists", conf.Name))
+		}
+		return nil, os.NewError("Client shut down")
+	}
+	c.networks[conf.Name] = cn
+	plugins := c.plugins //those added from now on are registered by AddPlugin
+	c.lock.Unlock()
+	go c.forward(cn, ch)
+	for _, p := range plugins {
+		if err := n.RegisterPlugin(p.name, p.create(), true); err != nil {
+			n.l.Printf("Client plugin %s: %s", p.name, err.String())
+		}
+	}
+	return n, nil
+}
+
+//forward tags the messages of a network for the merged stream
+func (c *Client) forward(cn *clientNetwork, ch chan *IrcMessage) {
+	defer cn.n.Listen.DelListener("*", "client")
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case <-cn.exch:
+			return
+		}
+		select {
+		case c.Events <- &NetworkEvent{cn.conf.Name, cn.n, msg}:
+		default:
+			cn.n.l.Printf("Client event stream full, dropping %s", msg)
+		}
+	}
+}
+
+//Network returns the network called name
+func (c *Client) Network(name string) (*Network, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	cn, ok := c.networks[name]
+	if !ok {
+		return nil, false
+	}
+	return cn.n, true
+}
+
+//Networks returns the names of the networks
+func (c *Client) Networks() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	names := make([]string, 0, len(c.networks))
+	for name := range c.networks {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+//Connect connects the network called name and joins its channels
+func (c *Client) Connect(name string) os.Error {
+	c.lock.RLock()
+	cn, ok := c.networks[name]
+	c.lock.RUnlock()
+	if !ok {
+		return os.NewError(fmt.Sprintf("No such network: %s", name))
+	}
+	if err := cn.n.Connect(); err != nil {
+		return err
+	}
+	if len(cn.conf.Channels) > 0 {
+		return cn.n.Join(cn.conf.Channels, []string{})
+	}
+	return nil
+}
+
+//ConnectAll connects the networks that are disconnected, returning the errors by network
+func (c *Client) ConnectAll() map[string]os.Error {
+	errs := make(map[string]os.Error)
+	for _, name := range c.Networks() {
+		if n, ok := c.Network(name); ok && n.State() == Disconnected {
+			if err := c.Connect(name); err != nil {
+				errs[name] = err
+			}
+		}
+	}
+	return errs
+}
+
+//RemoveNetwork disconnects the network called name and forgets it
+func (c *Client) RemoveNetwork(name, reason string) os.Error {
+	c.lock.Lock()
+	cn, ok := c.networks[name]
+	c.networks[name] = nil, false
+	c.lock.Unlock()
+	if !ok {
+		return os.NewError(fmt.Sprintf("No such network: %s", name))
+	}
+	cn.exch <- true
+	return cn.n.Close(reason, closeTimeout)
+}
+
+//AddPlugin registers a plugin on every network, now and when added. Each network gets its
+//own instance from create.
+func (c *Client) AddPlugin(name string, create func() Plugin) os.Error {
+	c.lock.Lock()
+	for _, p := range c.plugins {
+		if p.name == name {
+			c.lock.Unlock()
+			return os.NewError(fmt.Sprintf("Plugin %s already registered", name))
+		}
+	}
+	c.plugins = append(c.plugins, clientPlugin{name, create})
+	networks := make([]*clientNetwork, 0, len(c.networks)) //those added from now on get it in AddNetwork
+	for _, cn := range c.networks {
+		networks = append(networks, cn)
+	}
+	c.lock.Unlock()
+	for _, cn := range networks {
+		if err := cn.n.RegisterPlugin(name, create(), true); err != nil {
+			cn.n.l.Printf("Client plugin %s: %s", name, err.String())
+		}
+	}
+	return nil
+}
+
+//Shutdown closes all the networks at once, giving each timeout nanoseconds, and closes
+//Events. The error lists the networks that didn't close cleanly.
+func (c *Client) Shutdown(reason string, timeout int64) os.Error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	networks := c.networks
+	c.networks = make(map[string]*clientNetwork)
+	c.closed = true
+	c.lock.Unlock()
+	errs := make(chan os.Error)
+	for _, cn := range networks {
+		go func(cn *clientNetwork) {
+			cn.exch <- true
+			errs <- cn.n.Close(reason, timeout)
+		}(cn)
+	}
+	failed := make([]string, 0)
+	for _ = range networks {
+		if err := <-errs; err != nil {
+			failed = append(failed, err.String())
+		}
+	}
+	close(c.Events)
+	if len(failed) > 0 {
+		return os.NewError(strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"sort"
+	"strings"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//SplitArgs splits a command line in words. Words can be quoted with double or single quotes,
+//and a backslash escapes the next character outside single quotes.
+func SplitArgs(line string) ([]string, os.Error) {
+	args := make([]string, 0)
+	word := bytes.NewBufferString("")
+	inWord := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return args, os.NewError(fmt.Sprintf("Unterminated %c quote", quote))
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+//what a command handler gets to work with
+type CommandContext struct {
+	Net     *Network
+	Msg     *IrcMessage
+	Sender  Hostmask
+	Target  string //where replies go: the channel, or the sender's nick for private messages
+	Private bool
+	Command string //the name the command was called by, which may be an alias
+	Args    []string
+	Line    string //the arguments as typed
+}
+
+func (c *CommandContext) say(text string, notice bool, target string) os.Error {
+	cmd := "PRIVMSG"
+	if notice {
+		cmd = "NOTICE"
+	}
+	for _, part := range splitText(text, c.Net.maxText(cmd, target)) {
+		if notice {
+			c.Net.Notice(target, part)
+		} else if err := c.Net.Privmsg([]string{target}, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Reply answers where the command came from: in the channel, or in private
+func (c *CommandContext) Reply(text string) os.Error {
+	return c.say(text, false, c.Target)
+}
+
+//ReplyNick answers where the command came from, addressing the sender by nick in channels
+func (c *CommandContext) ReplyNick(text string) os.Error {
+	if !c.Private {
+		text = c.Sender.Nick + ": " + text
+	}
+	return c.say(text, false, c.Target)
+}
+
+//Notice answers the sender privately with a notice, which bots must not answer
+func (c *CommandContext) Notice(text string) os.Error {
+	return c.say(text, true, c.Sender.Nick)
+}
+
+//CommandHandler runs a command, a returned error is noticed to the sender
+type CommandHandler func(c *CommandContext) os.Error
+
+type Command struct {
+	Name    string
+	Aliases []string
+	Usage   string //arguments, e.g. "<nick> [reason]"
+	Help    string
+	MinArgs int
+	Roles   []string //needs one of these roles in the router's ACL, nil for everyone
+	Handler CommandHandler
+}
+
+//Router runs commands sent to us in channels with a prefix ("!cmd") or by addressing us
+//("nick: cmd"), and in private messages with or without prefix
+type Router struct {
+	Prefix   string
+	n        *Network
+	lock     *sync.RWMutex
+	commands map[string]*Command //by lower case name and aliases
+	acl      *ACL
+	name     string
+	exch     chan bool //closed by Stop
+	stop     *sync.Once
+}
+
+//NewRouter starts a command router with the given prefix ("" to only answer when addressed).
+//A help command is built in.
+func (n *Network) NewRouter(prefix string) (*Router, os.Error) {
+	r := &Router{prefix, n, new(sync.RWMutex), make(map[string]*Command), nil,
+		"router" + strconv.Itoa64(time.Nanoseconds()), make(chan bool), new(sync.Once)}
+	r.Handle(&Command{Name: "help", Usage: "[command]", Help: "Lists the commands, or explains one", Handler: func(c *CommandContext) os.Error {
+		return r.help(c)
+	}})
+	ch := make(chan *IrcMessage, 100)
+	if err := n.Listen.RegListener("PRIVMSG", r.name, ch); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Couldn't register router listener: %s", err.String()))
+	}
+	go r.run(ch)
+	return r, nil
+}
+
+//Handle adds a command
+func (r *Router) Handle(cmd *Command) os.Error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if _, ok := r.commands[strings.ToLower(name)]; ok {
+			return os.NewError(fmt.Sprintf("Command %s already exists", name))
+		}
+	}
+	for _, name := range names {
+		r.commands[strings.ToLower(name)] = cmd
+	}
+	return nil
+}
+
+//Remove removes a command and its aliases
+func (r *Router) Remove(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if cmd, ok := r.commands[strings.ToLower(name)]; ok {
+		for _, alias := range append([]string{cmd.Name}, cmd.Aliases...) {
+			r.commands[strings.ToLower(alias)] = nil, false
+		}
+	}
+}
+
+//SetACL checks the roles of commands against a. Commands with roles are refused to everyone
+//until an ACL is set.
+func (r *Router) SetACL(a *ACL) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.acl = a
+}
+
+//allowed checks the roles of cmd, which may have to wait for a WHOIS
+func (r *Router) allowed(cmd *Command, c *CommandContext) bool {
+	if len(cmd.Roles) == 0 {
+		return true
+	}
+	r.lock.RLock()
+	acl := r.acl
+	r.lock.RUnlock()
+	if acl == nil {
+		r.n.l.Printf("Audit: denied: %s by %s, no ACL", c.Command, c.Sender)
+		return false
+	}
+	return acl.Allowed(c, cmd.Roles)
+}
+
+func (r *Router) lookup(name string) (*Command, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	cmd, ok := r.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+//Stop stops the router, calls after the first do nothing
+func (r *Router) Stop() {
+	r.stop.Do(func() { close(r.exch) })
+}
+
+func (r *Router) help(c *CommandContext) os.Error {
+	if len(c.Args) > 0 {
+		cmd, ok := r.lookup(c.Args[0])
+		if !ok {
+			return os.NewError(fmt.Sprintf("No such command: %s", c.Args[0]))
+		}
+		text := fmt.Sprintf("%s%s %s: %s", r.Prefix, cmd.Name, cmd.Usage, cmd.Help)
+		if len(cmd.Aliases) > 0 {
+			text += fmt.Sprintf(" (also %s)", strings.Join(cmd.Aliases, ", "))
+		}
+		return c.Notice(text)
+	}
+	r.lock.RLock()
+	names := make([]string, 0, len(r.commands))
+	for name, cmd := range r.commands {
+		if name == strings.ToLower(cmd.Name) {
+			names = append(names, r.Prefix+cmd.Name)
+		}
+	}
+	r.lock.RUnlock()
+	sort.SortStrings(names)
+	return c.Notice("Commands: " + strings.Join(names, " "))
+}
+
+//Parse finds a command in msg, returning nil if there is none
+func (r *Router) Parse(msg *IrcMessage) (*CommandContext, os.Error) {
+	if msg.Cmd != "PRIVMSG" || len(msg.Params) < 2 {
+		return nil, nil
+	}
+	if _, _, ok := ParseCtcp(msg.Params[1]); ok {
+		return nil, nil
+	}
+	c := &CommandContext{Net: r.n, Msg: msg, Sender: msg.Hostmask(), Target: msg.Params[0]}
+	if c.Sender.Nick == "" {
+		return nil, nil
+	}
+	text := strings.TrimSpace(msg.Params[1])
+	c.Private = !r.n.IsChannel(c.Target)
+	if c.Private {
+		c.Target = c.Sender.Nick
+	}
+	nick := r.n.GetNick()
+	switch {
+	case r.Prefix != "" && strings.HasPrefix(text, r.Prefix):
+		text = text[len(r.Prefix):]
+	case len(text) > len(nick) && r.n.EqualFold(text[:len(nick)], nick) && strings.IndexRune(":,", int(text[len(nick)])) > -1:
+		text = strings.TrimSpace(text[len(nick)+1:])
+	case !c.Private:
+		return nil, nil
+	}
+	parts := strings.Split(text, " ", 2)
+	if parts[0] == "" {
+		return nil, nil
+	}
+	c.Command = parts[0]
+	if len(parts) > 1 {
+		c.Line = strings.TrimSpace(parts[1])
+	}
+	var err os.Error
+	c.Args, err = SplitArgs(c.Line)
+	return c, err
+}
+
+//run executes a command in its own goroutine so it can wait for server replies, the ACL
+//included
+func (r *Router) run(ch chan *IrcMessage) {
+	defer r.n.Listen.DelListener("PRIVMSG", r.name)
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case <-r.exch:
+			return
+		}
+		c, err := r.Parse(msg)
+		if c == nil {
+			continue
+		}
+		cmd, ok := r.lookup(c.Command)
+		switch {
+		case !ok:
+			if c.Private {
+				c.Notice(fmt.Sprintf("Unknown command %s, try %shelp", c.Command, r.Prefix))
+			}
+		case err != nil:
+			c.Notice(err.String())
+		case len(c.Args) < cmd.MinArgs:
+			c.Notice(fmt.Sprintf("Usage: %s%s %s", r.Prefix, c.Command, cmd.Usage))
+		default:
+			go func(cmd *Command, c *CommandContext) {
+				defer func() {
+					if x := recover(); x != nil {
+						r.n.l.Printf("Command %s from %s panicked: %v", c.Command, c.Sender, x)
+						c.Notice(fmt.Sprintf("Command %s failed", c.Command))
+					}
+				}()
+				if !r.allowed(cmd, c) {
+					c.Notice(errDenied(cmd).String())
+					return
+				}
+				if err := cmd.Handler(c); err != nil {
+					c.Notice(err.String())
+				}
+			}(cmd, c)
+		}
+	}
+}
@@ -1,19 +1,172 @@
 package ircchans
 
 import (
+	"os"
 	"strings"
+	"strconv"
 	"fmt"
+	"sync"
 	"time"
+	"bytes"
 )
 
+const (
+	ctcpDelim   = "\x01"
+	ctcpTimeout = second * 30 //replies come from the other client, not the server
+)
+
+//CtcpHandler answers a CTCP request from nick with the given arguments.
+//An empty reply means no answer is sent.
+type CtcpHandler func(n *Network, nick, args string) string
+
+type ctcpRegistry struct {
+	lock     *sync.RWMutex
+	handlers map[string]CtcpHandler
+}
+
+func newCtcpRegistry() ctcpRegistry {
+	r := ctcpRegistry{new(sync.RWMutex), make(map[string]CtcpHandler)}
+	r.handlers["VERSION"] = func(n *Network, nick, args string) string {
+		return n.GetVersion()
+	}
+	r.handlers["USERINFO"] = func(n *Network, nick, args string) string {
+		return n.getStr(&n.user)
+	}
+	r.handlers["CLIENTINFO"] = func(n *Network, nick, args string) string {
+		return strings.Join(n.ctcpHandlers.verbs(), " ")
+	}
+	r.handlers["PING"] = func(n *Network, nick, args string) string {
+		return args
+	}
+	r.handlers["TIME"] = func(n *Network, nick, args string) string {
+		return time.LocalTime().String()
+	}
+	r.handlers["FINGER"] = func(n *Network, nick, args string) string {
+		return "like i'm gonna tell you"
+	}
+	r.handlers["SOURCE"] = func(n *Network, nick, args string) string {
+		return "https://github.com/soul9/go-irc-chans"
+	}
+	r.handlers["DCC"] = func(n *Network, nick, args string) string {
+		n.dccRequest(nick, args)
+		return ""
+	}
+	return r
+}
+
+func (r *ctcpRegistry) get(verb string) (CtcpHandler, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	h, ok := r.handlers[verb]
+	return h, ok
+}
+
+func (r *ctcpRegistry) verbs() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]string, 0, len(r.handlers))
+	for verb, _ := range r.handlers {
+		ret = append(ret, verb)
+	}
+	return ret
+}
+
+//RegCtcp makes h answer CTCP requests for verb, replacing any previous handler
+func (n *Network) RegCtcp(verb string, h CtcpHandler) {
+	n.ctcpHandlers.lock.Lock()
+	defer n.ctcpHandlers.lock.Unlock()
+	n.ctcpHandlers.handlers[strings.ToUpper(verb)] = h
+}
+
+//DelCtcp stops answering CTCP requests for verb
+func (n *Network) DelCtcp(verb string) {
+	n.ctcpHandlers.lock.Lock()
+	defer n.ctcpHandlers.lock.Unlock()
+	n.ctcpHandlers.handlers[strings.ToUpper(verb)] = nil, false
+}
+
+//low level quoting: NUL, CR, LF and the quote character itself can't appear in an irc line
+var lowQuote = map[byte]byte{0: '0', '\r': 'r', '\n': 'n', '\x10': '\x10'}
+
+//ctcp level quoting: the delimiter and the quote character can't appear in ctcp data
+var ctcpQuote = map[byte]byte{'\x01': 'a', '\\': '\\'}
+
+func quote(s string, q byte, table map[byte]byte) string {
+	buf := bytes.NewBufferString("")
+	for i := 0; i < len(s); i++ {
+		if c, ok := table[s[i]]; ok {
+			buf.WriteByte(q)
+			buf.WriteByte(c)
+		} else {
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func dequote(s string, q byte, table map[byte]byte) string {
+	buf := bytes.NewBufferString("")
+	for i := 0; i < len(s); i++ {
+		if s[i] != q || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		found := false
+		for orig, c := range table {
+			if c == s[i] {
+				buf.WriteByte(orig)
+				found = true
+				break
+			}
+		}
+		if !found { //undefined quote: drop the quote character
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+//CtcpEncode builds the quoted CTCP message for verb and args, ready to be sent with PRIVMSG or NOTICE
+func CtcpEncode(verb, args string) string {
+	data := strings.ToUpper(verb)
+	if args != "" {
+		data += " " + args
+	}
+	return quote(ctcpDelim+quote(data, '\\', ctcpQuote)+ctcpDelim, '\x10', lowQuote)
+}
+
+//ParseCtcp extracts the verb and arguments of a CTCP message. ok is false if text is not CTCP.
+func ParseCtcp(text string) (verb, args string, ok bool) {
+	text = dequote(text, '\x10', lowQuote)
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return "", "", false
+	}
+	text = text[1:]
+	if i := strings.Index(text, ctcpDelim); i > -1 { //the closing delimiter is sometimes missing
+		text = text[:i]
+	}
+	text = dequote(text, '\\', ctcpQuote)
+	if text == "" {
+		return "", "", false
+	}
+	parts := strings.Split(text, " ", 2)
+	verb = strings.ToUpper(parts[0])
+	if len(parts) > 1 {
+		args = parts[1]
+	}
+	return verb, args, true
+}
+
 //CTCP sucks, each client implements it a bit differently
 func (n *Network) ctcp() {
 	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
+	done, err := n.Shutdown.regName("ctcp", exch)
 	if err != nil {
 		return
 	}
-	ch := make(chan *IrcMessage)
+	defer close(done)
+	ch := make(chan *IrcMessage, 100) //dispatch drops what doesn't fit while a handler runs
 	n.Listen.RegListener("PRIVMSG", "ctcp", ch)
 	defer n.Listen.DelListener("PRIVMSG", "ctcp")
 	for !closed(ch) {
@@ -26,58 +179,147 @@ func (n *Network) ctcp() {
 			}
 			continue
 		}
-		if i := strings.LastIndex(p.Params[1], "\x01"); i > -1 { //FIXME: DCC?
-			p.Params[1] = strings.Trim(p.Params[1], "\x01")
-			ctype := p.Params[1]
-			dst := strings.Split(p.Prefix, "!", 2)[0]
-			switch {
-			case ctype == "VERSION":
-				n.Notice(dst, fmt.Sprintf("\x01VERSION %s\x01", IRCVERSION))
-			case ctype == "USERINFO":
-				n.Notice(dst, fmt.Sprintf("\x01USERINFO %s\x01", n.user))
-			case ctype == "CLIENTINFO":
-				n.Notice(dst, "\x01CLIENTINFO PING VERSION TIME USERINFO CLIENTINFO FINGER SOURCE\x01")
-			case ctype[0:4] == "PING":
-				params := strings.Split(p.Params[1], " ", -1)
-				if len(params) < 2 {
-					n.l.Println("Illegal ctcp ping received: No arguments", p)
-					break
-				}
-				n.Notice(dst, fmt.Sprintf("\x01PING %s\x01", strings.Join(params[1:], " ")))
-			case ctype == "TIME":
-				n.Notice(dst, fmt.Sprintf("\x01TIME %s\x01", time.LocalTime().String()))
-				//TODO: ACTION, PAGE?
-			case ctype == "FINGER":
-				n.Notice(dst, fmt.Sprintln("\x01FINGER like i'm gonna tell you\x01"))
-			case ctype == "SOURCE":
-				n.Notice(dst, fmt.Sprintln("\x01SOURCE https://github.com/soul9/go-irc-chans\x01"))
+		if len(p.Params) < 2 {
+			continue
+		}
+		verb, args, ok := ParseCtcp(p.Params[1])
+		if !ok {
+			continue
+		}
+		h, ok := n.ctcpHandlers.get(verb)
+		if !ok {
+			continue
+		}
+		dst := p.Origin()
+		if reply := h(n, dst, args); reply != "" {
+			n.Notice(dst, CtcpEncode(verb, reply))
+		}
+	}
+	return
+}
 
+//Ctcp sends a CTCP request to target and returns the arguments of its reply
+func (n *Network) Ctcp(target, verb, args string) (string, os.Error) {
+	verb = strings.ToUpper(verb)
+	t := strconv.Itoa64(time.Nanoseconds())
+	myreplies := []string{"ERR_NOSUCHNICK", "NOTICE"}
+	repch := make(chan *IrcMessage, 10)
+	if err := n.listen(myreplies, t, repch); err != nil {
+		return "", err
+	}
+	defer n.unlisten(myreplies, t)
+	ticker := time.NewTicker(ctcpTimeout)
+	defer ticker.Stop()
+	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{target, CtcpEncode(verb, args)}, nil}
+	for {
+		select {
+		case msg := <-repch:
+			if msg.Cmd == replies["ERR_NOSUCHNICK"] {
+				if paramIs(1, target)(msg) {
+					return "", replyError(msg)
+				}
+				continue
 			}
+			if !n.EqualFold(msg.Origin(), target) || len(msg.Params) < 2 {
+				continue
+			}
+			rverb, rargs, ok := ParseCtcp(msg.Params[1])
+			if !ok {
+				continue
+			}
+			if rverb == "ERRMSG" {
+				return "", os.NewError(fmt.Sprintf("CTCP error from %s: %s", target, rargs))
+			}
+			if rverb == verb {
+				return rargs, nil
+			}
+		case <-ticker.C:
+			return "", os.NewError(fmt.Sprintf("No CTCP %s reply from %s", verb, target))
 		}
 	}
-	return
+	return "", os.NewError("Unknown error")
+}
+
+func (n *Network) CtcpVersion(target string) (string, os.Error) {
+	return n.Ctcp(target, "VERSION", "")
+}
+
+func (n *Network) CtcpUserInfo(target string) (string, os.Error) {
+	return n.Ctcp(target, "USERINFO", "")
+}
+
+//CtcpClientInfo returns the CTCP verbs target understands
+func (n *Network) CtcpClientInfo(target string) ([]string, os.Error) {
+	info, err := n.Ctcp(target, "CLIENTINFO", "")
+	return strings.Fields(info), err
 }
 
-func (n *Network) CtcpVersion(target string) {
+//CtcpPing returns the round trip time to target in nanoseconds
+func (n *Network) CtcpPing(target string) (int64, os.Error) {
+	now := time.Nanoseconds()
+	reply, err := n.Ctcp(target, "PING", strconv.Itoa64(now))
+	if err != nil {
+		return 0, err
+	}
+	if sent, err := strconv.Atoi64(reply); err != nil || sent != now {
+		return 0, os.NewError(fmt.Sprintf("Bad CTCP PING reply from %s: %s", target, reply))
+	}
+	return time.Nanoseconds() - now, nil
 }
 
-func (n *Network) CtcpUserInfo(target string) {
+func (n *Network) CtcpTime(target string) (string, os.Error) {
+	return n.Ctcp(target, "TIME", "")
 }
 
-func (n *Network) CtcpClientInfo(target string) {
+func (n *Network) CtcpFinger(target string) (string, os.Error) {
+	return n.Ctcp(target, "FINGER", "")
 }
 
-func (n *Network) CtcpPing(target string) {
+func (n *Network) CtcpSource(target string) (string, os.Error) {
+	return n.Ctcp(target, "SOURCE", "")
 }
 
-func (n *Network) CtcpTime(target string) {
+//maxText returns how many bytes of text fit in a cmd message to target, once the server has
+//prepended our prefix (nick!user@host, the host is at most 63 bytes long)
+func (n *Network) maxText(cmd, target string) int {
+	prefix := len(":!@ ") + len(n.GetNick()) + len(n.getStr(&n.user)) + 63 + 1 //user may get a ~
+	return 510 - prefix - len(cmd) - len(target) - len("  :")
 }
 
-func (n *Network) CtcpFinger(target string) {
+//splitEncoded is splitText for text that is sent encoded: every part fits in max bytes once
+//encoded, quoting making some characters longer
+func splitEncoded(text string, max int, encode func(string) string) []string {
+	ret := make([]string, 0)
+	for _, part := range splitText(text, max-len(encode(""))) {
+		for len(encode(part)) > max {
+			first := part
+			for size := len(part) - (len(encode(part)) - max); len(encode(first)) > max && size > 0; size-- {
+				first = splitText(part, size)[0]
+			}
+			ret = append(ret, first)
+			part = strings.TrimLeft(part[len(first):], " ")
+		}
+		if part != "" || len(ret) == 0 {
+			ret = append(ret, part)
+		}
+	}
+	return ret
 }
 
-func (n *Network) CtcpSource(target string) {
+//Action sends text as a CTCP ACTION (/me) to target, split in several messages if it is too long
+func (n *Network) Action(target, text string) os.Error {
+	encode := func(part string) string { return CtcpEncode("ACTION", part) }
+	parts := splitEncoded(text, n.maxText("PRIVMSG", target), encode)
+	for i, part := range parts {
+		parts[i] = encode(part)
+	}
+	_, err := n.privmsgs([]string{target}, parts)
+	return err
 }
 
-func (n *Network) CtcpAction(target string) {
+//CtcpAction sends text as a CTCP ACTION to target. Deprecated: use Action, which reports errors.
+func (n *Network) CtcpAction(target string, text ...string) {
+	if err := n.Action(target, strings.Join(text, " ")); err != nil {
+		n.l.Printf("Couldn't send action to %s: %s", target, err.String())
+	}
 }
@@ -0,0 +1,454 @@
+package ircchans
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"net"
+	"bufio"
+	"bytes"
+	"strings"
+	"strconv"
+	"sync"
+	"time"
+	"crypto/rand"
+)
+
+const dccTimeout = minute * 2
+
+//an incoming (or, for passive DCC, answering) DCC request
+type DccOffer struct {
+	Nick  string
+	Type  string //CHAT, SEND, or RESUME/ACCEPT during file transfers
+	Arg   string //"chat" for CHAT, the file name otherwise
+	IP    net.IP //nil for RESUME/ACCEPT
+	Port  int    //0 for passive (reverse) DCC: the peer wants us to listen
+	Size  int64  //file size for SEND, position for RESUME/ACCEPT
+	Token string //passive DCC only
+	n     *Network
+}
+
+//ErrNoNetwork is returned when answering an offer from ParseDcc: only those sent on DccOffers
+//know the network to answer through
+var ErrNoNetwork = os.NewError("DCC offer not received from a network")
+
+//DCC requests we sent and that wait for an answer from the peer: passive offers by token,
+//transfers waiting for RESUME or ACCEPT by port. Keys start with the folded nick of the
+//peer (see dccKey) so nobody else can answer.
+type dccPendingMap struct {
+	lock    *sync.Mutex
+	pending map[string]chan *DccOffer
+}
+
+func newDccPendingMap() dccPendingMap {
+	return dccPendingMap{new(sync.Mutex), make(map[string]chan *DccOffer)}
+}
+
+func (p *dccPendingMap) add(key string) chan *DccOffer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ch := make(chan *DccOffer, 1)
+	p.pending[key] = ch
+	return ch
+}
+
+func (p *dccPendingMap) del(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pending[key] = nil, false
+}
+
+//deliver hands o to whoever waits for key, and reports whether someone did
+func (p *dccPendingMap) deliver(key string, o *DccOffer) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ch, ok := p.pending[key]
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- o:
+	default:
+	}
+	return true
+}
+
+//dccKey returns the dccPendingMap key of the answer of kind from nick about id
+func (n *Network) dccKey(nick, kind, id string) string {
+	return fmt.Sprintf("%s %s:%s", n.Fold(nick), kind, id)
+}
+
+//dccToken returns a random token for passive DCC, which peers can't guess
+func dccToken() (string, os.Error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return strconv.Uitoa64(uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])), nil
+}
+
+//dccIP encodes ip the way DCC wants it: IPv4 as a decimal integer, IPv6 as is
+func dccIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Uitoa64(uint64(ip4[0])<<24 | uint64(ip4[1])<<16 | uint64(ip4[2])<<8 | uint64(ip4[3]))
+	}
+	return ip.String()
+}
+
+func parseDccIP(s string) net.IP {
+	if i, err := strconv.Atoui64(s); err == nil {
+		return net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	return net.ParseIP(s)
+}
+
+func dccHostPort(ip net.IP, port int) string {
+	if ip.To4() == nil {
+		return fmt.Sprintf("[%s]:%d", ip.String(), port)
+	}
+	return fmt.Sprintf("%s:%d", ip.String(), port)
+}
+
+//dccFields splits DCC arguments, the file name may be quoted if it contains spaces
+func dccFields(args string) []string {
+	args = strings.TrimSpace(args)
+	if i := strings.Index(args, " "); i > -1 && strings.HasPrefix(args[i+1:], "\"") {
+		if j := strings.Index(args[i+2:], "\""); j > -1 {
+			rest := strings.Fields(args[i+2+j+1:])
+			return append([]string{args[:i], args[i+2 : i+2+j]}, rest...)
+		}
+	}
+	return strings.Fields(args)
+}
+
+//ParseDcc parses the arguments of a CTCP DCC request
+func ParseDcc(nick, args string) (*DccOffer, os.Error) {
+	f := dccFields(args)
+	if len(f) < 4 {
+		return nil, os.NewError(fmt.Sprintf("Malformed DCC request: %s", args))
+	}
+	if t := strings.ToUpper(f[0]); t == "RESUME" || t == "ACCEPT" { //file port position [token]
+		o := &DccOffer{Nick: nick, Type: t, Arg: f[1]}
+		var err os.Error
+		if o.Port, err = strconv.Atoi(f[2]); err != nil {
+			return nil, os.NewError(fmt.Sprintf("Bad DCC port: %s", f[2]))
+		}
+		if o.Size, err = strconv.Atoi64(f[3]); err != nil {
+			return nil, os.NewError(fmt.Sprintf("Bad DCC position: %s", f[3]))
+		}
+		if len(f) > 4 {
+			o.Token = f[4]
+		}
+		return o, nil
+	}
+	o := &DccOffer{Nick: nick, Type: strings.ToUpper(f[0]), Arg: f[1], IP: parseDccIP(f[2])}
+	if o.IP == nil {
+		return nil, os.NewError(fmt.Sprintf("Bad DCC address: %s", f[2]))
+	}
+	var err os.Error
+	if o.Port, err = strconv.Atoi(f[3]); err != nil || o.Port < 0 || o.Port > 65535 {
+		return nil, os.NewError(fmt.Sprintf("Bad DCC port: %s", f[3]))
+	}
+	rest := f[4:]
+	if o.Type == "SEND" && len(rest) > 0 {
+		o.Size, _ = strconv.Atoi64(rest[0])
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		o.Token = rest[0]
+	}
+	return o, nil
+}
+
+//String returns the DCC request arguments for o
+func (o *DccOffer) String() string {
+	arg := o.Arg
+	if strings.Contains(arg, " ") {
+		arg = fmt.Sprintf("\"%s\"", arg)
+	}
+	if o.Type == "RESUME" || o.Type == "ACCEPT" {
+		s := fmt.Sprintf("%s %s %d %d", o.Type, arg, o.Port, o.Size)
+		if o.Token != "" {
+			s += " " + o.Token
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s %s %s %d", o.Type, arg, dccIP(o.IP), o.Port)
+	if o.Type == "SEND" {
+		s += " " + strconv.Itoa64(o.Size)
+	}
+	if o.Token != "" {
+		s += " " + o.Token
+	}
+	return s
+}
+
+//SetDccIP sets the address we advertise in DCC offers, for when we're behind NAT
+func (n *Network) SetDccIP(ip string) {
+	n.setStr(&n.dccIP, ip)
+}
+
+func (n *Network) dccLocalIP() net.IP {
+	if dccIP := n.getStr(&n.dccIP); dccIP != "" {
+		if ip := net.ParseIP(dccIP); ip != nil {
+			return ip
+		}
+	}
+	if conn, _ := n.connection(); conn != nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+//dccRequest handles incoming CTCP DCC requests: answers to our passive offers and resume
+//negotiations go to whoever waits for them, new offers are sent on DccOffers
+func (n *Network) dccRequest(nick, args string) {
+	o, err := ParseDcc(nick, args)
+	if err != nil {
+		n.l.Printf("Ignoring DCC request from %s: %s", nick, err.String())
+		return
+	}
+	o.n = n
+	switch {
+	case o.Type == "RESUME" || o.Type == "ACCEPT":
+		key := n.dccKey(nick, strings.ToLower(o.Type), strconv.Itoa(o.Port))
+		if o.Port == 0 {
+			key = n.dccKey(nick, strings.ToLower(o.Type), o.Token)
+		}
+		if !n.dccPending.deliver(key, o) {
+			n.l.Printf("Ignoring DCC %s from %s: no such transfer", o.Type, nick)
+		}
+		return
+	case o.Port != 0 && o.Token != "" && n.dccPending.deliver(n.dccKey(nick, "token", o.Token), o):
+		return
+	}
+	select {
+	case n.DccOffers <- o:
+	default:
+		n.l.Printf("Dropping DCC offer from %s: nobody is listening", nick)
+	}
+}
+
+//dccListen listens on a random port and returns the listener and the port
+func dccListen() (net.Listener, int, os.Error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, 0, err
+	}
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		l.Close()
+		return nil, 0, os.NewError("Couldn't find DCC listening port")
+	}
+	return l, addr.Port, nil
+}
+
+//dccPeer returns the addresses of the host of nick, asking the server if we don't know it.
+//Cloaked hosts don't resolve: passive DCC has to be used with those peers.
+func (n *Network) dccPeer(nick string) ([]net.IP, os.Error) {
+	host := ""
+	if u, ok := n.LookupUser(nick); ok {
+		host = u.Host
+	}
+	if host == "" {
+		r, err := n.Userhost([]string{nick})
+		if err != nil {
+			return nil, err
+		}
+		if len(r) == 0 {
+			return nil, os.NewError(fmt.Sprintf("Couldn't find the host of %s", nick))
+		}
+		host = r[0].Host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	_, addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("Couldn't resolve %s, the host of %s: %s", host, nick, err.String()))
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+//dccFromPeer tells whether c comes from one of the peer addresses
+func dccFromPeer(c net.Conn, peer []net.IP) bool {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip := range peer {
+		if ip != nil && bytes.Equal(ip.To16(), addr.IP.To16()) {
+			return true
+		}
+	}
+	return false
+}
+
+//dccAccept waits for one connection from the peer addresses on l, then closes it.
+//Connections from anywhere else are closed right away.
+func dccAccept(l net.Listener, peer []net.IP) (net.Conn, os.Error) {
+	connch := make(chan net.Conn, 1)
+	errch := make(chan os.Error, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errch <- err
+				return
+			}
+			if dccFromPeer(c, peer) {
+				connch <- c
+				return
+			}
+			c.Close()
+		}
+	}()
+	defer l.Close()
+	select {
+	case c := <-connch:
+		return c, nil
+	case err := <-errch:
+		return nil, err
+	case <-time.After(dccTimeout):
+	}
+	return nil, os.NewError("Timeout waiting for DCC connection")
+}
+
+//a DCC CHAT session: lines arrive on In, which is closed when the session ends
+type DccChat struct {
+	Nick string
+	In   chan string
+	conn net.Conn
+	buf  *bufio.ReadWriter
+	lock *sync.Mutex
+}
+
+func newDccChat(nick string, conn net.Conn) *DccChat {
+	c := &DccChat{nick, make(chan string, 100), conn,
+		bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), new(sync.Mutex)}
+	go c.receiver()
+	return c
+}
+
+func (c *DccChat) receiver() {
+	defer close(c.In)
+	for {
+		l, err := c.buf.ReadString('\n')
+		if l = strings.TrimRight(l, "\r\n"); l != "" {
+			c.In <- l
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//Send sends one line of text to the peer
+func (c *DccChat) Send(line string) os.Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.buf.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *DccChat) Close() os.Error {
+	return c.conn.Close()
+}
+
+//DccChat offers a DCC CHAT to nick and waits for the connection, which has to come from
+//the host of nick
+func (n *Network) DccChat(nick string) (*DccChat, os.Error) {
+	peer, err := n.dccPeer(nick)
+	if err != nil {
+		return nil, err
+	}
+	l, port, err := dccListen()
+	if err != nil {
+		return nil, err
+	}
+	o := &DccOffer{Nick: nick, Type: "CHAT", Arg: "chat", IP: n.dccLocalIP(), Port: port}
+	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{nick, CtcpEncode("DCC", o.String())}, nil}
+	conn, err := dccAccept(l, peer)
+	if err != nil {
+		return nil, err
+	}
+	return newDccChat(nick, conn), nil
+}
+
+//DccChatPassive offers a passive DCC CHAT to nick: the peer listens and we connect,
+//for when we can't accept connections ourselves
+func (n *Network) DccChatPassive(nick string) (*DccChat, os.Error) {
+	token, err := dccToken()
+	if err != nil {
+		return nil, err
+	}
+	o := &DccOffer{Nick: nick, Type: "CHAT", Arg: "chat", IP: n.dccLocalIP(), Port: 0, Token: token}
+	key := n.dccKey(nick, "token", token)
+	ch := n.dccPending.add(key)
+	defer n.dccPending.del(key)
+	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{nick, CtcpEncode("DCC", o.String())}, nil}
+	select {
+	case reply := <-ch:
+		conn, err := net.Dial("tcp", "", dccHostPort(reply.IP, reply.Port))
+		if err != nil {
+			return nil, err
+		}
+		return newDccChat(nick, conn), nil
+	case <-time.After(dccTimeout):
+	}
+	return nil, os.NewError(fmt.Sprintf("%s didn't answer the passive DCC CHAT", nick))
+}
+
+//Accept accepts a DCC CHAT offer. For passive offers we listen and tell the peer where to connect.
+func (o *DccOffer) Accept() (*DccChat, os.Error) {
+	if o.Type != "CHAT" {
+		return nil, os.NewError(fmt.Sprintf("Not a DCC CHAT offer: %s", o.Type))
+	}
+	if o.Port != 0 {
+		conn, err := net.Dial("tcp", "", dccHostPort(o.IP, o.Port))
+		if err != nil {
+			return nil, err
+		}
+		return newDccChat(o.Nick, conn), nil
+	}
+	if o.n == nil {
+		return nil, ErrNoNetwork
+	}
+	l, port, err := dccListen()
+	if err != nil {
+		return nil, err
+	}
+	reply := &DccOffer{Nick: o.Nick, Type: o.Type, Arg: o.Arg, IP: o.n.dccLocalIP(), Port: port, Token: o.Token}
+	o.n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{o.Nick, CtcpEncode("DCC", reply.String())}, nil}
+	conn, err := dccAccept(l, o.peer())
+	if err != nil {
+		return nil, err
+	}
+	return newDccChat(o.Nick, conn), nil
+}
+
+//peer returns the addresses a passive offer may be answered from: the host of the sender
+//and the address it advertised
+func (o *DccOffer) peer() []net.IP {
+	peer, _ := o.n.dccPeer(o.Nick)
+	return append(peer, o.IP)
+}
+
+//Reject tells the peer we don't want the offer
+func (o *DccOffer) Reject() os.Error {
+	if o.n == nil {
+		return ErrNoNetwork
+	}
+	o.n.Notice(o.Nick, CtcpEncode("DCC", fmt.Sprintf("REJECT %s %s", o.Type, o.Arg)))
+	return nil
+}
@@ -0,0 +1,478 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"utf8"
+	"strings"
+	"strconv"
+	"sync"
+	"time"
+	"hash"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+const dccBlockSize = 4096
+
+//DccPolicy decides where received files go and how fast transfers may run
+type DccPolicy struct {
+	Dir     string //download directory
+	MaxSize int64  //offers for bigger files are refused, 0 for no limit
+	Resume  bool   //resume partial downloads instead of saving them under a new name
+	Rate    int64  //bandwidth cap of each transfer in bytes per second, 0 for no limit
+}
+
+var defDccPolicy = DccPolicy{confdir + "/downloads", 0, true, 0}
+
+//SetDccPolicy sets the policy for the transfers started from now on
+func (n *Network) SetDccPolicy(p DccPolicy) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.dccPolicy = p
+}
+
+func (n *Network) getDccPolicy() DccPolicy {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.dccPolicy
+}
+
+//SanitizeFilename makes a file name offered by a peer safe to create in the download directory:
+//no path separators, no control characters, no leading dots
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(c int) int {
+		if c < ' ' || c == 0x7f || strings.IndexRune("/\\:*?\"<>|", c) > -1 {
+			return '_'
+		}
+		return c
+	}, name)
+	name = strings.Trim(name, ". ")
+	if len(name) > 200 {
+		cut := 200
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+//freeName returns name, or name.1, name.2... whichever doesn't exist yet
+func freeName(name string) string {
+	free := name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(free); err != nil {
+			return free
+		}
+		free = fmt.Sprintf("%s.%d", name, i)
+	}
+	return free
+}
+
+//a DCC SEND file transfer, in either direction
+type DccTransfer struct {
+	Nick     string
+	File     string        //local path
+	Size     int64         //0 if the sender didn't tell
+	Offset   int64         //where the transfer started, not 0 when resumed
+	Progress chan int64    //position in the file, sent after each block unless nobody reads
+	Done     chan os.Error //receives nil, or the error that ended the transfer
+	rate     int64
+	conn     net.Conn
+	sum      hash.Hash
+	lock     *sync.Mutex
+	pos      int64
+	acked    int64
+	peerGone bool
+	ackch    chan bool
+}
+
+func newDccTransfer(nick, file string, size, offset, rate int64, conn net.Conn) *DccTransfer {
+	return &DccTransfer{nick, file, size, offset, make(chan int64, 10), make(chan os.Error, 1),
+		rate, conn, md5.New(), new(sync.Mutex), offset, 0, false, make(chan bool, 1)}
+}
+
+//Bytes returns the position reached in the file
+func (t *DccTransfer) Bytes() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.pos
+}
+
+//Checksum returns the hex encoded MD5 sum of the file, valid once the transfer is done
+func (t *DccTransfer) Checksum() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return hex.EncodeToString(t.sum.Sum())
+}
+
+//Verify compares the file with a hex encoded MD5 sum the peer gave us some other way
+func (t *DccTransfer) Verify(sum string) os.Error {
+	if mine := t.Checksum(); strings.ToLower(sum) != mine {
+		return os.NewError(fmt.Sprintf("Checksum mismatch for %s: got %s, expected %s", t.File, mine, sum))
+	}
+	return nil
+}
+
+//Cancel aborts the transfer
+func (t *DccTransfer) Cancel() os.Error {
+	return t.conn.Close()
+}
+
+func (t *DccTransfer) progress(data []byte) {
+	t.lock.Lock()
+	t.sum.Write(data)
+	t.pos += int64(len(data))
+	pos := t.pos
+	t.lock.Unlock()
+	select {
+	case t.Progress <- pos:
+	default:
+	}
+}
+
+//throttle sleeps long enough to keep the transfer under the bandwidth cap
+func (t *DccTransfer) throttle(start int64) {
+	if t.rate <= 0 {
+		return
+	}
+	due := int64(float64(t.Bytes()-t.Offset) / float64(t.rate) * second)
+	if ahead := due - (time.Nanoseconds() - start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+func (t *DccTransfer) finish(f *os.File, err os.Error) {
+	f.Close()
+	t.conn.Close()
+	t.Done <- err
+}
+
+//receive copies the file from the connection, acknowledging each block with the
+//number of bytes received so far (32 bits, network order)
+func (t *DccTransfer) receive(f *os.File) {
+	buf := make([]byte, dccBlockSize)
+	ack := make([]byte, 4)
+	start := time.Nanoseconds()
+	var err os.Error
+	for t.Size == 0 || t.Bytes() < t.Size {
+		var n int
+		n, err = t.conn.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				err = werr
+				break
+			}
+			t.progress(buf[:n])
+			binary.BigEndian.PutUint32(ack, uint32(t.Bytes()))
+			t.conn.Write(ack) //the sender may hang up as soon as it has sent everything
+			t.throttle(start)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == os.EOF {
+		err = nil
+		if t.Size > 0 && t.Bytes() < t.Size {
+			err = os.NewError(fmt.Sprintf("DCC SEND from %s ended after %d of %d bytes", t.Nick, t.Bytes(), t.Size))
+		}
+	}
+	t.finish(f, err)
+}
+
+func (t *DccTransfer) readAcks() {
+	ack := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(t.conn, ack)
+		t.lock.Lock()
+		if err != nil {
+			t.peerGone = true
+		} else {
+			t.acked = int64(binary.BigEndian.Uint32(ack))
+		}
+		t.lock.Unlock()
+		select {
+		case t.ackch <- true:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//waitAcks waits until the receiver acknowledged the whole file or hung up
+func (t *DccTransfer) waitAcks() os.Error {
+	timeout := time.After(dccTimeout)
+	for {
+		t.lock.Lock()
+		acked, gone := t.acked, t.peerGone
+		t.lock.Unlock()
+		if uint32(acked) == uint32(t.Size) || (gone && acked == 0) { //some clients never acknowledge
+			return nil
+		} else if gone {
+			return os.NewError(fmt.Sprintf("%s hung up after receiving %d of %d bytes", t.Nick, acked, t.Size))
+		}
+		select {
+		case <-t.ackch:
+		case <-timeout:
+			return os.NewError(fmt.Sprintf("Timeout waiting for %s to acknowledge %s", t.Nick, t.File))
+		}
+	}
+	return nil
+}
+
+func (t *DccTransfer) send(f *os.File) {
+	go t.readAcks()
+	buf := make([]byte, dccBlockSize)
+	start := time.Nanoseconds()
+	var err os.Error
+	for {
+		n, rerr := f.Read(buf)
+		if n > 0 {
+			if _, err = t.conn.Write(buf[:n]); err != nil {
+				break
+			}
+			t.progress(buf[:n])
+			t.throttle(start)
+		}
+		if rerr != nil {
+			if rerr != os.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	if err == nil {
+		err = t.waitAcks()
+	}
+	t.finish(f, err)
+}
+
+//skip hashes the first offset bytes of f, leaving it positioned there for a resumed transfer
+func (t *DccTransfer) skip(f *os.File) os.Error {
+	if _, err := io.Copyn(t.sum, f, t.Offset); err != nil {
+		return err
+	}
+	return nil
+}
+
+//dccConnect waits for the answer to our passive DCC offer, then connects to the peer
+func (n *Network) dccConnect(nick string, ch chan *DccOffer) (net.Conn, os.Error) {
+	select {
+	case reply := <-ch:
+		return net.Dial("tcp", "", dccHostPort(reply.IP, reply.Port))
+	case <-time.After(dccTimeout):
+	}
+	return nil, os.NewError(fmt.Sprintf("%s didn't answer the passive DCC SEND", nick))
+}
+
+//dccSendConn waits for connect to establish the connection, answering a DCC RESUME with
+//ACCEPT meanwhile, and returns the connection and the position to send from
+func (n *Network) dccSendConn(o *DccOffer, resume chan *DccOffer, connect func() (net.Conn, os.Error)) (net.Conn, int64, os.Error) {
+	connch := make(chan net.Conn, 1)
+	errch := make(chan os.Error, 1)
+	go func() {
+		c, err := connect()
+		if err != nil {
+			errch <- err
+		} else {
+			connch <- c
+		}
+	}()
+	var offset int64
+	for {
+		select {
+		case r := <-resume:
+			if r.Size < 0 || r.Size > o.Size {
+				n.l.Printf("Ignoring DCC RESUME from %s at %d: %s is only %d bytes", o.Nick, r.Size, o.Arg, o.Size)
+				continue
+			}
+			offset = r.Size
+			accept := &DccOffer{Nick: o.Nick, Type: "ACCEPT", Arg: r.Arg, Port: r.Port, Size: r.Size, Token: r.Token}
+			n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{o.Nick, CtcpEncode("DCC", accept.String())}, nil}
+		case c := <-connch:
+			return c, offset, nil
+		case err := <-errch:
+			return nil, 0, err
+		}
+	}
+	return nil, 0, os.NewError("Unknown error")
+}
+
+func dccOpen(file string) (*os.File, int64, os.Error) {
+	f, err := os.Open(file, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !fi.IsRegular() {
+		f.Close()
+		return nil, 0, os.NewError(fmt.Sprintf("Not a regular file: %s", file))
+	}
+	return f, fi.Size, nil
+}
+
+func (n *Network) dccSend(nick, file string, passive bool) (*DccTransfer, os.Error) {
+	f, size, err := dccOpen(file)
+	if err != nil {
+		return nil, err
+	}
+	o := &DccOffer{Nick: nick, Type: "SEND", Arg: SanitizeFilename(path.Base(file)), IP: n.dccLocalIP(), Size: size}
+	var connect func() (net.Conn, os.Error)
+	var key string
+	if passive {
+		if o.Token, err = dccToken(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		token := n.dccKey(nick, "token", o.Token)
+		ch := n.dccPending.add(token)
+		defer n.dccPending.del(token)
+		connect = func() (net.Conn, os.Error) { return n.dccConnect(nick, ch) }
+		key = n.dccKey(nick, "resume", o.Token)
+	} else {
+		peer, err := n.dccPeer(nick)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		l, port, err := dccListen()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		o.Port = port
+		connect = func() (net.Conn, os.Error) { return dccAccept(l, peer) }
+		key = n.dccKey(nick, "resume", strconv.Itoa(port))
+	}
+	resume := n.dccPending.add(key)
+	defer n.dccPending.del(key)
+	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{nick, CtcpEncode("DCC", o.String())}, nil}
+	conn, offset, err := n.dccSendConn(o, resume, connect)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := newDccTransfer(nick, file, size, offset, n.getDccPolicy().Rate, conn)
+	if err := t.skip(f); err != nil {
+		t.finish(f, err)
+		return nil, err
+	}
+	go t.send(f)
+	return t, nil
+}
+
+//DccSend offers file to nick and starts sending it once the peer connects from its host.
+//Wait on the transfer's Done channel for the outcome.
+func (n *Network) DccSend(nick, file string) (*DccTransfer, os.Error) {
+	return n.dccSend(nick, file, false)
+}
+
+//DccSendPassive offers file to nick with passive DCC: the peer listens and we connect,
+//for when we can't accept connections ourselves
+func (n *Network) DccSendPassive(nick, file string) (*DccTransfer, os.Error) {
+	return n.dccSend(nick, file, true)
+}
+
+//resume asks the sender to resume the transfer at pos and returns the position it accepted
+func (o *DccOffer) resume(pos int64) (int64, os.Error) {
+	key := o.n.dccKey(o.Nick, "accept", strconv.Itoa(o.Port))
+	if o.Port == 0 {
+		key = o.n.dccKey(o.Nick, "accept", o.Token)
+	}
+	ch := o.n.dccPending.add(key)
+	defer o.n.dccPending.del(key)
+	r := &DccOffer{Nick: o.Nick, Type: "RESUME", Arg: o.Arg, Port: o.Port, Size: pos, Token: o.Token}
+	o.n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{o.Nick, CtcpEncode("DCC", r.String())}, nil}
+	select {
+	case a := <-ch:
+		if a.Size < 0 || a.Size > pos {
+			return 0, os.NewError(fmt.Sprintf("%s accepted to resume at a bad position: %d", o.Nick, a.Size))
+		}
+		return a.Size, nil
+	case <-time.After(ctcpTimeout):
+	}
+	return 0, os.NewError(fmt.Sprintf("%s doesn't support DCC RESUME", o.Nick))
+}
+
+//Receive accepts a DCC SEND offer, saving the file in the download directory under a
+//sanitised name. A partial download of the same file is resumed if the policy allows it.
+func (o *DccOffer) Receive() (*DccTransfer, os.Error) {
+	if o.Type != "SEND" {
+		return nil, os.NewError(fmt.Sprintf("Not a DCC SEND offer: %s", o.Type))
+	}
+	if o.n == nil {
+		return nil, ErrNoNetwork
+	}
+	p := o.n.getDccPolicy()
+	if p.MaxSize > 0 && o.Size > p.MaxSize {
+		return nil, os.NewError(fmt.Sprintf("%s is too big: %d bytes, the limit is %d", o.Arg, o.Size, p.MaxSize))
+	}
+	if err := os.MkdirAll(p.Dir, 0751); err != nil {
+		return nil, err
+	}
+	file := path.Join(p.Dir, SanitizeFilename(o.Arg))
+	var offset int64
+	if fi, err := os.Stat(file); err == nil {
+		if p.Resume && fi.IsRegular() && fi.Size > 0 && fi.Size < o.Size {
+			if offset, err = o.resume(fi.Size); err != nil {
+				o.n.l.Printf("Not resuming %s: %s", file, err.String())
+				offset = 0
+			}
+		}
+		if offset == 0 {
+			file = freeName(file)
+		}
+	}
+	var f *os.File
+	var err os.Error
+	if offset > 0 {
+		f, err = os.Open(file, os.O_RDWR, 0644)
+	} else {
+		f, err = os.Open(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	var conn net.Conn
+	if o.Port != 0 {
+		conn, err = net.Dial("tcp", "", dccHostPort(o.IP, o.Port))
+	} else {
+		var l net.Listener
+		var port int
+		if l, port, err = dccListen(); err == nil {
+			reply := &DccOffer{Nick: o.Nick, Type: o.Type, Arg: o.Arg, IP: o.n.dccLocalIP(), Port: port, Size: o.Size, Token: o.Token}
+			o.n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{o.Nick, CtcpEncode("DCC", reply.String())}, nil}
+			conn, err = dccAccept(l, o.peer())
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := newDccTransfer(o.Nick, file, o.Size, offset, p.Rate, conn)
+	if err := t.skip(f); err != nil {
+		t.finish(f, err)
+		return nil, err
+	}
+	go t.receive(f)
+	return t, nil
+}
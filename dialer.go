@@ -0,0 +1,441 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"bufio"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"crypto/tls"
+	"encoding/base64"
+)
+
+//Dialer opens connections to IRC servers, addr is host:port
+type Dialer interface {
+	Dial(addr string) (net.Conn, os.Error)
+}
+
+//how Connect uses TLS
+type TlsMode int
+
+const (
+	TlsTry     TlsMode = iota //try TLS first, then STARTTLS, then plain text (the default)
+	TlsRequire                //fail if neither TLS nor STARTTLS work
+	TlsOff                    //plain text only, e.g. on a connection that is already encrypted
+)
+
+//how TLS went with an address, remembered so that TlsTry doesn't dial again for what failed
+const (
+	tlsUntried = iota
+	tlsDirect
+	tlsStarttls
+	tlsPlain //neither TLS nor STARTTLS worked
+)
+
+var tlsTimeout int64 = 15 * second //for TLS handshakes and STARTTLS replies
+
+//DirectDialer connects over TCP, from the Local address (e.g. "[2001:db8::1]:0") if it is set
+type DirectDialer struct {
+	Local string
+}
+
+func (d DirectDialer) Dial(addr string) (net.Conn, os.Error) {
+	return net.Dial("tcp", d.Local, addr)
+}
+
+//UnixDialer connects to a Unix socket whatever the server address
+type UnixDialer struct {
+	Path string
+}
+
+func (d UnixDialer) Dial(addr string) (net.Conn, os.Error) {
+	return net.Dial("unix", "", d.Path)
+}
+
+//ConnDialer hands out an established connection, once
+type ConnDialer struct {
+	lock *sync.Mutex
+	conn net.Conn
+}
+
+func NewConnDialer(conn net.Conn) *ConnDialer {
+	return &ConnDialer{new(sync.Mutex), conn}
+}
+
+func (d *ConnDialer) Dial(addr string) (net.Conn, os.Error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.conn == nil {
+		return nil, os.NewError("Connection already used")
+	}
+	conn := d.conn
+	d.conn = nil
+	return conn, nil
+}
+
+//plainDialer tells whether TlsTry means plain text with d: a Unix socket is local, and the
+//connection of a ConnDialer would be lost to a failed TLS attempt
+func plainDialer(d Dialer) bool {
+	switch d.(type) {
+	case UnixDialer, *UnixDialer, *ConnDialer:
+		return true
+	}
+	return false
+}
+
+//splitAddr splits host:port, removing the brackets of IPv6 addresses
+func splitAddr(addr string) (string, int, os.Error) {
+	i := strings.LastIndex(addr, ":")
+	if i == -1 {
+		return "", 0, os.NewError(fmt.Sprintf("No port in %s", addr))
+	}
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil || port < 0 || port > 0xffff {
+		return "", 0, os.NewError(fmt.Sprintf("Bad port in %s", addr))
+	}
+	return strings.Trim(addr[:i], "[]"), port, nil
+}
+
+//Socks5Dialer connects through a SOCKS5 proxy, authenticating if User is set. The proxy
+//itself is reached with Forward, or directly if it is nil.
+type Socks5Dialer struct {
+	Proxy    string //host:port
+	User     string
+	Password string
+	Forward  Dialer
+}
+
+var socks5Errors = []string{"", "General failure", "Connection not allowed by ruleset", "Network unreachable",
+	"Host unreachable", "Connection refused", "TTL expired", "Command not supported", "Address type not supported"}
+
+func (d Socks5Dialer) Dial(addr string) (net.Conn, os.Error) {
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) > 255 {
+		return nil, os.NewError(fmt.Sprintf("Host name too long: %s", host))
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = DirectDialer{}
+	}
+	conn, err := forward.Dial(d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.handshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, os.NewError(fmt.Sprintf("SOCKS5 proxy %s: %s", d.Proxy, err.String()))
+	}
+	return conn, nil
+}
+
+func (d Socks5Dialer) handshake(conn net.Conn, host string, port int) os.Error {
+	buf := make([]byte, 0, 6+len(host))
+	if d.User != "" {
+		buf = append(buf, 5, 2, 0, 2) //version 5, no authentication or user/password
+	} else {
+		buf = append(buf, 5, 1, 0)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := readFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != 5:
+		return os.NewError(fmt.Sprintf("Bad version %d", reply[0]))
+	case reply[1] == 2 && d.User != "": //RFC 1929
+		if len(d.User) > 255 || len(d.Password) > 255 {
+			return os.NewError("User name or password too long")
+		}
+		buf = append([]byte{1, byte(len(d.User))}, []byte(d.User)...)
+		buf = append(append(buf, byte(len(d.Password))), []byte(d.Password)...)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		if _, err := readFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return os.NewError("Authentication failed")
+		}
+	case reply[1] != 0:
+		return os.NewError("No acceptable authentication method")
+	}
+	buf = append([]byte{5, 1, 0, 3, byte(len(host))}, []byte(host)...) //CONNECT to a domain name
+	buf = append(buf, byte(port>>8), byte(port))
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply = make([]byte, 4)
+	if _, err := readFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socks5Errors) {
+			return os.NewError(socks5Errors[reply[1]])
+		}
+		return os.NewError(fmt.Sprintf("Error %d", reply[1]))
+	}
+	var skip int //the bound address, which we don't need
+	switch reply[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		l := make([]byte, 1)
+		if _, err := readFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return os.NewError(fmt.Sprintf("Bad address type %d", reply[3]))
+	}
+	_, err := readFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func readFull(conn net.Conn, buf []byte) (int, os.Error) {
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+//HttpDialer connects through an HTTP proxy with the CONNECT method, authenticating if User
+//is set. The proxy itself is reached with Forward, or directly if it is nil.
+type HttpDialer struct {
+	Proxy    string //host:port
+	User     string
+	Password string
+	Forward  Dialer
+}
+
+//a connection whose first bytes were read in a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, os.Error) {
+	return c.r.Read(b)
+}
+
+func (d HttpDialer) Dial(addr string) (net.Conn, os.Error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = DirectDialer{}
+	}
+	conn, err := forward.Dial(d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if d.User != "" {
+		auth := []byte(d.User + ":" + d.Password)
+		enc := make([]byte, base64.StdEncoding.EncodedLen(len(auth)))
+		base64.StdEncoding.Encode(enc, auth)
+		req += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", enc)
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err == nil {
+		if fields := strings.Fields(status); len(fields) < 2 || fields[1] != "200" {
+			err = os.NewError(strings.TrimSpace(status))
+		}
+	}
+	for err == nil { //skip the headers, the server may already talk after them
+		var l string
+		l, err = r.ReadString('\n')
+		if strings.TrimSpace(l) == "" {
+			break
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, os.NewError(fmt.Sprintf("HTTP proxy %s: %s", d.Proxy, err.String()))
+	}
+	return &bufferedConn{conn, r}, nil
+}
+
+//SetDialer sets how Connect reaches the server, from the next connection on
+func (n *Network) SetDialer(d Dialer) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.dialer = d
+}
+
+//SetTls sets whether Connect uses TLS, from the next connection on
+func (n *Network) SetTls(mode TlsMode) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.tlsMode = mode
+	n.tlsWays = make(map[string]int)
+}
+
+//readLine reads a line from conn a byte at a time, so that nothing after it is consumed
+func readLine(conn net.Conn) (string, os.Error) {
+	line, b := make([]byte, 0, 512), make([]byte, 1)
+	for len(line) < 8192 {
+		if _, err := readFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", os.NewError("Line too long")
+}
+
+//startTls upgrades a plain text connection with STARTTLS, before registration. If the
+//server refuses, conn is returned with the error, still usable in plain text.
+func (n *Network) startTls(conn net.Conn, tlsConfig *tls.Config) (net.Conn, os.Error) {
+	if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+		return nil, err
+	}
+	conn.SetReadTimeout(tlsTimeout)
+	for {
+		line, err := readLine(conn)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := PackMsg(line)
+		if err != nil {
+			continue
+		}
+		if msg.Cmd == "PING" && len(msg.Params) > 0 {
+			if _, err := conn.Write([]byte("PONG :" + msg.Params[len(msg.Params)-1] + "\r\n")); err != nil {
+				return nil, err
+			}
+		} else if msg.Cmd == replies["RPL_STARTTLS"] {
+			conn.SetReadTimeout(0)
+			return tlsHandshake(conn, tlsConfig)
+		} else if len(msg.Cmd) == 3 && (msg.Cmd[0] == '4' || msg.Cmd[0] == '5') { //ERR_STARTTLS, or a server that doesn't know about it
+			conn.SetReadTimeout(0)
+			return conn, &ReplyError{replyName(msg.Cmd), &msg}
+		}
+	}
+	return nil, nil
+}
+
+//tlsHandshake starts TLS on conn, closing it if the server doesn't complete the handshake in time
+func tlsHandshake(conn net.Conn, tlsConfig *tls.Config) (net.Conn, os.Error) {
+	tconn := tls.Client(conn, tlsConfig)
+	result := make(chan os.Error, 1)
+	go func() {
+		result <- tconn.Handshake()
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	case <-time.After(tlsTimeout):
+		conn.Close() //ends the handshake
+	}
+	return nil, os.NewError("TLS handshake timed out")
+}
+
+//dial connects to addr with the dialer, over TLS if mode says so: directly if the server
+//speaks TLS on that port, else with STARTTLS, starting with the way that worked last time.
+//TlsTry is plain text with a UnixDialer or a ConnDialer, which is never dialed twice. A ws://
+//or wss:// addr goes through a WebSocketDialer, whose URL alone decides about TLS, ws://
+//failing with TlsRequire. secure tells whether conn is encrypted.
+func (n *Network) dial(addr string, mode TlsMode) (conn net.Conn, secure bool, err os.Error) {
+	n.lock.RLock()
+	d := n.dialer
+	n.lock.RUnlock()
+	if isWsURL(addr) {
+		if mode == TlsRequire && !strings.HasPrefix(addr, "wss://") {
+			return nil, false, os.NewError(fmt.Sprintf("TLS is required, %s is plain text", addr))
+		}
+		ws := WebSocketDialer{URL: addr, Forward: d}
+		if strings.HasPrefix(addr, "wss://") {
+			if ws.TlsConfig, err = customTlsConf(n.getStr(&n.confdir) + "/tls"); err != nil {
+				return nil, false, err
+			}
+		}
+		conn, err = ws.Dial(addr)
+		return conn, ws.TlsConfig != nil, err
+	}
+	if mode == TlsOff || (mode == TlsTry && plainDialer(d)) {
+		conn, err = d.Dial(addr)
+		return conn, false, err
+	}
+	tlsConfig, err := customTlsConf(n.getStr(&n.confdir) + "/tls")
+	if err != nil {
+		if mode == TlsRequire {
+			return nil, false, err
+		}
+		n.l.Printf("No tls configuration (%s), trying plain-text", err.String())
+		conn, err = d.Dial(addr)
+		return conn, false, err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = splitAddr(addr)
+	}
+	n.lock.RLock()
+	way := n.tlsWays[addr]
+	n.lock.RUnlock()
+	remember := func(way int) {
+		n.lock.Lock()
+		n.tlsWays[addr] = way
+		n.lock.Unlock()
+	}
+	switch {
+	case way == tlsPlain && mode == TlsTry:
+		conn, err = d.Dial(addr)
+		return conn, false, err
+	case way != tlsStarttls:
+		if conn, err = d.Dial(addr); err != nil { //the server is unreachable, whatever the way
+			return nil, false, err
+		}
+		if conn, err = tlsHandshake(conn, tlsConfig); err == nil {
+			remember(tlsDirect)
+			return conn, true, nil
+		}
+		n.l.Printf("Problem connecting using tls (%s), trying STARTTLS", err.String())
+	}
+	if conn, err = d.Dial(addr); err != nil {
+		return nil, false, err
+	}
+	tconn, err := n.startTls(conn, tlsConfig)
+	switch {
+	case err == nil:
+		remember(tlsStarttls)
+		return tconn, true, nil
+	case mode == TlsRequire:
+		conn.Close()
+		return nil, false, err
+	case tconn == nil: //the connection is unusable
+		conn.Close()
+		n.l.Printf("STARTTLS failed (%s), trying plain-text", err.String())
+		if conn, err = d.Dial(addr); err == nil {
+			remember(tlsPlain)
+		}
+		return conn, false, err
+	}
+	remember(tlsPlain)
+	n.l.Printf("STARTTLS refused (%s), going on in plain-text", err.String())
+	return conn, false, nil
+}
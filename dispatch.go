@@ -4,11 +4,17 @@ import (
 	"os"
 	"fmt"
 	"sync"
+	"time"
 )
 
 type dispatchMap struct {
-	lock  *sync.RWMutex
-	chans map[string]map[string]chan *IrcMessage //wildcard * is for any message
+	lock     *sync.RWMutex
+	chans    map[string]map[string]chan *IrcMessage //wildcard * is for any message
+	internal map[string]bool                        //"cmd name" of our own listeners, which see ignored messages too
+}
+
+func newDispatchMap() dispatchMap {
+	return dispatchMap{new(sync.RWMutex), make(map[string]map[string]chan *IrcMessage), make(map[string]bool)}
 }
 
 func (m *dispatchMap) RegListener(cmd, name string, ch chan *IrcMessage) os.Error {
@@ -25,12 +31,25 @@ func (m *dispatchMap) RegListener(cmd, name string, ch chan *IrcMessage) os.Erro
 	return nil
 }
 
+//regInternal registers a listener that keeps the library state current and must
+//not miss messages from ignored users
+func (m *dispatchMap) regInternal(cmd, name string, ch chan *IrcMessage) os.Error {
+	if err := m.RegListener(cmd, name, ch); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.internal[cmd+" "+name] = true
+	return nil
+}
+
 func (m *dispatchMap) DelListener(cmd, name string) os.Error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.chans[cmd] == nil || m.chans[cmd][name] == nil {
 		return os.NewError(fmt.Sprintf("No such listener: %s for cmd %s", name, cmd))
 	}
+	m.internal[cmd+" "+name] = false, false
 	if !closed(m.chans[cmd][name]) {
 		select {
 		case <-m.chans[cmd][name]:
@@ -46,54 +65,118 @@ func (m *dispatchMap) DelListener(cmd, name string) os.Error {
 }
 
 func (m *dispatchMap) dispatch(msg IrcMessage) {
+	m.dispatchIgnored(msg, false)
+}
+
+//dispatchIgnored sends msg to the listeners, ignored messages only reach internal ones
+func (m *dispatchMap) dispatchIgnored(msg IrcMessage, ignored bool) {
 	m.lock.RLock()
-	for _, ch := range m.chans[msg.Cmd] {
-		select {
-		case ch <- &msg:
-			continue
-		default:
-			continue
-		}
-	}
-	for _, ch := range m.chans["*"] {
-		select {
-		case ch <- &msg:
-			continue
-		default:
-			continue
+	for _, cmd := range []string{msg.Cmd, "*"} {
+		for name, ch := range m.chans[cmd] {
+			if ignored && !m.internal[cmd+" "+name] {
+				continue
+			}
+			select {
+			case ch <- &msg:
+				continue
+			default:
+				continue
+			}
 		}
 	}
 	m.lock.RUnlock()
 	return
 }
 
+//a goroutine stopped when the connection closes
+type shutdownClient struct {
+	name string
+	exch chan bool //told to stop with true, nil for goroutines that stop with the connection
+	done chan bool //closed once stopped, nil if the goroutine doesn't tell
+	told bool
+}
+
 type shutdownDispatcher struct {
 	lock    *sync.Mutex
-	clients []chan bool
+	clients []*shutdownClient
 }
 
+func newShutdownDispatcher() shutdownDispatcher {
+	return shutdownDispatcher{new(sync.Mutex), make([]*shutdownClient, 0)}
+}
+
+//Reg registers ch to get true when the connection closes. The receiving goroutine must
+//listen on ch until then.
 func (s *shutdownDispatcher) Reg(ch chan bool) os.Error {
 	if len(ch) > 0 {
 		return os.NewError("Need to pass synchronous channel for shutdown")
 	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.clients = append(s.clients, ch)
+	s.clients = append(s.clients, &shutdownClient{"listener", ch, nil, false})
 	return nil
 }
 
-func (s *shutdownDispatcher) do() int {
+//regName registers one of our goroutines, which must close the returned channel when it
+//stops so Close can wait for it
+func (s *shutdownDispatcher) regName(name string, ch chan bool) (chan bool, os.Error) {
+	if len(ch) > 0 {
+		return nil, os.NewError("Need to pass synchronous channel for shutdown")
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	stale := 0
-	for i, _ := range s.clients {
+	done := make(chan bool)
+	s.clients = append(s.clients, &shutdownClient{name, ch, done, false})
+	return done, nil
+}
+
+//remaining returns the nanoseconds left until deadline
+func remaining(deadline int64) int64 {
+	if left := deadline - time.Nanoseconds(); left > 0 {
+		return left
+	}
+	return 0
+}
+
+//signal tells the goroutines to stop, giving up on those that don't listen by deadline
+func (s *shutdownDispatcher) signal(deadline int64) {
+	s.lock.Lock()
+	clients := s.clients
+	s.lock.Unlock()
+	for _, c := range clients {
+		if c.exch == nil {
+			continue
+		}
 		select {
-		case s.clients[i] <- true:
-		default:
-			stale++
+		case c.exch <- true:
+			c.told = true
+		case <-c.done: //stopped on its own, a nil done never is
+			c.told = true
+		case <-time.After(remaining(deadline)):
+		}
+	}
+}
+
+//wait waits until deadline for the goroutines to stop, forgets them all and returns the
+//names of those that didn't
+func (s *shutdownDispatcher) wait(deadline int64) []string {
+	s.lock.Lock()
+	clients := s.clients
+	s.clients = make([]*shutdownClient, 0)
+	s.lock.Unlock()
+	stale := make([]string, 0)
+	for _, c := range clients {
+		if c.done == nil {
+			if !c.told {
+				stale = append(stale, c.name)
+			}
+			continue
+		}
+		select {
+		case <-c.done:
+		case <-time.After(remaining(deadline)):
+			stale = append(stale, c.name)
 		}
 	}
-	//BUG: what if some don't shut down?
-	s.clients = make([]chan bool, 0)
 	return stale
 }
@@ -0,0 +1,315 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"sync"
+	"bytes"
+	"utf8"
+)
+
+//Codec converts between a legacy character set and UTF-8
+type Codec interface {
+	Decode(s string) (string, os.Error) //from the character set to UTF-8
+	Encode(s string) (string, os.Error) //from UTF-8 to the character set
+}
+
+//single byte character sets: bytes below 0x80 are ASCII, high holds the code points of 0x80-0xff
+type tableCodec struct {
+	high []int
+	lock *sync.Mutex
+	rev  map[int]byte
+}
+
+func newTableCodec(high []int) *tableCodec {
+	return &tableCodec{high, new(sync.Mutex), nil}
+}
+
+func (c *tableCodec) Decode(s string) (string, os.Error) {
+	buf := bytes.NewBufferString("")
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x80 {
+			buf.WriteByte(s[i])
+		} else {
+			buf.WriteRune(c.high[s[i]-0x80])
+		}
+	}
+	return buf.String(), nil
+}
+
+//Encode replaces the characters the set lacks with '?' and reports the first one
+func (c *tableCodec) Encode(s string) (string, os.Error) {
+	c.lock.Lock()
+	if c.rev == nil {
+		c.rev = make(map[int]byte)
+		for i, r := range c.high {
+			if r != utf8.RuneError {
+				c.rev[r] = byte(i + 0x80)
+			}
+		}
+	}
+	c.lock.Unlock()
+	buf := bytes.NewBufferString("")
+	var err os.Error
+	for _, r := range s {
+		if r < 0x80 {
+			buf.WriteByte(byte(r))
+		} else if b, ok := c.rev[r]; ok {
+			buf.WriteByte(b)
+		} else {
+			if err == nil {
+				err = os.NewError(fmt.Sprintf("Can't encode %q", r))
+			}
+			buf.WriteByte('?')
+		}
+	}
+	return buf.String(), err
+}
+
+type utf8Codec struct{}
+
+func (c utf8Codec) Decode(s string) (string, os.Error) {
+	if !validUTF8(s) {
+		return s, os.NewError("Invalid UTF-8")
+	}
+	return s, nil
+}
+
+func (c utf8Codec) Encode(s string) (string, os.Error) {
+	return s, nil
+}
+
+func validUTF8(s string) bool {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+func latin1() []int {
+	high := make([]int, 128)
+	for i := range high {
+		high[i] = i + 0x80
+	}
+	return high
+}
+
+func cp1252() []int {
+	high := latin1()
+	copy(high, []int{
+		0x20ac, utf8.RuneError, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+		0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, utf8.RuneError, 0x017d, utf8.RuneError,
+		utf8.RuneError, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+		0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, utf8.RuneError, 0x017e, 0x0178,
+	})
+	return high
+}
+
+func cp1251() []int {
+	high := []int{
+		0x0402, 0x0403, 0x201a, 0x0453, 0x201e, 0x2026, 0x2020, 0x2021,
+		0x20ac, 0x2030, 0x0409, 0x2039, 0x040a, 0x040c, 0x040b, 0x040f,
+		0x0452, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+		utf8.RuneError, 0x2122, 0x0459, 0x203a, 0x045a, 0x045c, 0x045b, 0x045f,
+		0x00a0, 0x040e, 0x045e, 0x0408, 0x00a4, 0x0490, 0x00a6, 0x00a7,
+		0x0401, 0x00a9, 0x0404, 0x00ab, 0x00ac, 0x00ad, 0x00ae, 0x0407,
+		0x00b0, 0x00b1, 0x0406, 0x0456, 0x0491, 0x00b5, 0x00b6, 0x00b7,
+		0x0451, 0x2116, 0x0454, 0x00bb, 0x0458, 0x0405, 0x0455, 0x0457,
+	}
+	for r := 0x0410; r <= 0x044f; r++ { //А-я
+		high = append(high, r)
+	}
+	return high
+}
+
+var codecs = struct {
+	lock   *sync.RWMutex
+	codecs map[string]Codec
+}{new(sync.RWMutex), map[string]Codec{
+	"utf-8":        utf8Codec{},
+	"iso-8859-1":   newTableCodec(latin1()),
+	"windows-1252": newTableCodec(cp1252()),
+	"windows-1251": newTableCodec(cp1251()),
+}}
+
+var codecAliases = map[string]string{
+	"utf8":    "utf-8",
+	"latin1":  "iso-8859-1",
+	"latin-1": "iso-8859-1",
+	"cp1252":  "windows-1252",
+	"cp1251":  "windows-1251",
+}
+
+func codecName(name string) string {
+	name = strings.ToLower(name)
+	if alias, ok := codecAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+//RegisterCodec makes a character set available to SetEncoding, e.g. ISO-2022-JP which isn't built in.
+//ISO-8859-1 (latin1), windows-1252 (cp1252), windows-1251 (cp1251) and UTF-8 are.
+func RegisterCodec(name string, c Codec) {
+	codecs.lock.Lock()
+	defer codecs.lock.Unlock()
+	codecs.codecs[codecName(name)] = c
+}
+
+func getCodec(name string) (Codec, bool) {
+	codecs.lock.RLock()
+	defer codecs.lock.RUnlock()
+	c, ok := codecs.codecs[codecName(name)]
+	return c, ok
+}
+
+//ISO-2022-JP is 7 bit and valid UTF-8, recognise it by its escape sequences
+func isISO2022JP(s string) bool {
+	return strings.Contains(s, "\x1b$B") || strings.Contains(s, "\x1b$@")
+}
+
+type encodingSettings struct {
+	lock     *sync.RWMutex
+	network  string
+	fallback string
+	channels map[string]string //folded channel -> encoding
+	utf8Only bool              //respect the UTF8ONLY ISUPPORT token
+}
+
+func newEncodingSettings() encodingSettings {
+	return encodingSettings{new(sync.RWMutex), "utf-8", "windows-1252", make(map[string]string), true}
+}
+
+//SetEncoding sets the character set used on the network. ISO-2022-JP is not built in: lines
+//using it are recognised, but only decoded once a codec is registered with RegisterCodec, and
+//until then SetEncoding refuses it like any unknown encoding.
+func (n *Network) SetEncoding(enc string) os.Error {
+	if _, ok := getCodec(enc); !ok {
+		return os.NewError(fmt.Sprintf("Unknown encoding: %s", enc))
+	}
+	n.encoding.lock.Lock()
+	defer n.encoding.lock.Unlock()
+	n.encoding.network = codecName(enc)
+	return nil
+}
+
+//SetChannelEncoding sets the character set used on channel, overriding the network one.
+//An empty enc goes back to the network encoding.
+func (n *Network) SetChannelEncoding(channel, enc string) os.Error {
+	channel = n.Fold(channel)
+	n.encoding.lock.Lock()
+	defer n.encoding.lock.Unlock()
+	if enc == "" {
+		n.encoding.channels[channel] = "", false
+		return nil
+	}
+	if _, ok := getCodec(enc); !ok {
+		return os.NewError(fmt.Sprintf("Unknown encoding: %s", enc))
+	}
+	n.encoding.channels[channel] = codecName(enc)
+	return nil
+}
+
+//SetFallbackEncoding sets the character set used to decode lines that aren't valid UTF-8
+//when the network or channel encoding is UTF-8 (default windows-1252)
+func (n *Network) SetFallbackEncoding(enc string) os.Error {
+	if _, ok := getCodec(enc); !ok {
+		return os.NewError(fmt.Sprintf("Unknown encoding: %s", enc))
+	}
+	n.encoding.lock.Lock()
+	defer n.encoding.lock.Unlock()
+	n.encoding.fallback = codecName(enc)
+	return nil
+}
+
+//RespectUtf8Only makes us send UTF-8 whatever the encoding settings when the server
+//advertises UTF8ONLY (the default), or not
+func (n *Network) RespectUtf8Only(respect bool) {
+	n.encoding.lock.Lock()
+	defer n.encoding.lock.Unlock()
+	n.encoding.utf8Only = respect
+}
+
+//Encoding returns the character set used for target, a channel or a nick
+func (n *Network) Encoding(target string) string {
+	target = n.Fold(target)
+	n.encoding.lock.RLock()
+	defer n.encoding.lock.RUnlock()
+	if enc, ok := n.encoding.channels[target]; ok {
+		return enc
+	}
+	return n.encoding.network
+}
+
+//msgTarget returns the channel msg is about, if any
+func (n *Network) msgTarget(msg *IrcMessage) string {
+	for i := 0; i < 2 && i < len(msg.Params); i++ {
+		if n.IsChannel(msg.Params[i]) {
+			return msg.Params[i]
+		}
+	}
+	return ""
+}
+
+//decode converts s to UTF-8: valid UTF-8 is kept as is whatever the settings, other lines
+//are decoded with the encoding of target, or the fallback one
+func (n *Network) decode(s, target string) string {
+	if isISO2022JP(s) {
+		if c, ok := getCodec("iso-2022-jp"); ok {
+			if dec, err := c.Decode(s); err == nil {
+				return dec
+			}
+		}
+	}
+	if validUTF8(s) {
+		return s
+	}
+	enc := n.Encoding(target)
+	if enc == "utf-8" {
+		n.encoding.lock.RLock()
+		enc = n.encoding.fallback
+		n.encoding.lock.RUnlock()
+	}
+	if c, ok := getCodec(enc); ok {
+		if dec, err := c.Decode(s); err == nil {
+			return dec
+		}
+	}
+	return s
+}
+
+func (n *Network) decodeMsg(msg *IrcMessage) {
+	target := n.msgTarget(msg)
+	msg.Prefix = n.decode(msg.Prefix, target)
+	for i, p := range msg.Params {
+		msg.Params[i] = n.decode(p, target)
+	}
+}
+
+//encodeMsg returns msg in the character set of its target, UTF-8 messages are left alone
+func (n *Network) encodeMsg(msg *IrcMessage) *IrcMessage {
+	enc := n.Encoding(n.msgTarget(msg))
+	n.encoding.lock.RLock()
+	utf8Only := n.encoding.utf8Only
+	n.encoding.lock.RUnlock()
+	if _, ok := n.ISupport("UTF8ONLY"); enc == "utf-8" || (ok && utf8Only) {
+		return msg
+	}
+	c, ok := getCodec(enc)
+	if !ok {
+		return msg
+	}
+	ret := &IrcMessage{msg.Prefix, msg.Cmd, make([]string, len(msg.Params)), msg.Tags}
+	for i, p := range msg.Params {
+		var err os.Error
+		if ret.Params[i], err = c.Encode(p); err != nil {
+			n.l.Printf("Encoding to %s: %s", enc, err.String())
+		}
+	}
+	return ret
+}
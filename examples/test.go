@@ -22,6 +22,7 @@ func main() {
 	rnf := flag.String("realname", "", "Real Name (defaults to nick)")
 	chans := flag.String("chans", "#go-nuts", "Channles to join separated by commas (e.g. #foo,#bar; defaults to #go-nuts)")
 	logfile := flag.String("logfile", "", "File used for logging (default: stderr)")
+	admin := flag.String("admin", "", "Hostmask allowed to use admin commands (e.g. *!*@my.host)")
 	usage := flag.Bool("h", false, "Display usage and help message")
 	flag.Parse()
 	if *usage {
@@ -37,35 +38,36 @@ func main() {
 	log.Println(strings.Join([]string{*netf, *port}, ":"), *nickf, *userf, *rnf, *passf, *logfile)
 	channels := strings.Split(*chans, ",", -1)
 	n := ircchans.NewNetwork(*netf, *port, *nickf, *userf, *rnf, *passf, *logfile)
-	//test replies, outgoing messages
-	go func() {
-		chin := make(chan *ircchans.IrcMessage, 100)
-		n.Listen.RegListener("PRIVMSG", "testreply", chin)
-		for !closed(chin) {
-			msg := <-chin
-			nick := n.GetNick()
-			if msg.Destination() == nick {
-				switch strings.Join(msg.Params[1:], " ") {
-				case "memusage":
-					targ := strings.Split(msg.Prefix, "!", 2)
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated: %.2fMb, taken from system: %.2fMb", float32(runtime.MemStats.Alloc)/1024/1024, float32(runtime.MemStats.Sys)/1024/1024))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Currently allocated (heap): %.2fMb, taken from system (heap): %.2fMb", float32(runtime.MemStats.HeapAlloc)/1024/1024, float32(runtime.MemStats.HeapSys)/1024/1024))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Goroutines currently running: %d", runtime.Goroutines()))
-					n.Privmsg([]string{targ[0]}, fmt.Sprintf("Next garbage collection will be when heap reaches %.1f Mb.", float32(runtime.MemStats.NextGC)/1024/1024))
-				case "reconnect":
-					n.Disconnect("Order")
-				}
-			}
+	//test commands
+	r, err := n.NewRouter("!")
+	if err != nil {
+		log.Fatalf("Couldn't start the command router: %s", err.String())
+	}
+	acl := n.NewACL()
+	if *admin != "" {
+		acl.GrantMask(*admin, "admin")
+	}
+	r.SetACL(acl)
+	r.Handle(&ircchans.Command{Name: "memusage", Aliases: []string{"mem"}, Help: "Shows memory usage", Handler: func(c *ircchans.CommandContext) os.Error {
+		c.Reply(fmt.Sprintf("Currently allocated: %.2fMb, taken from system: %.2fMb", float32(runtime.MemStats.Alloc)/1024/1024, float32(runtime.MemStats.Sys)/1024/1024))
+		c.Reply(fmt.Sprintf("Currently allocated (heap): %.2fMb, taken from system (heap): %.2fMb", float32(runtime.MemStats.HeapAlloc)/1024/1024, float32(runtime.MemStats.HeapSys)/1024/1024))
+		c.Reply(fmt.Sprintf("Goroutines currently running: %d", runtime.Goroutines()))
+		return c.Reply(fmt.Sprintf("Next garbage collection will be when heap reaches %.1f Mb.", float32(runtime.MemStats.NextGC)/1024/1024))
+	}})
+	r.Handle(&ircchans.Command{Name: "reconnect", Help: "Reconnects to the network", Roles: []string{"admin"}, Handler: func(c *ircchans.CommandContext) os.Error {
+		if !c.Private {
+			return os.NewError("Only in private")
 		}
-		n.Listen.DelListener("PRIVMSG", "testreply")
-	}()
+		n.Disconnect("Order")
+		return nil
+	}})
 	ticker := time.Tick(1000 * 1000 * 1000 * 15)
 	ticker15 := time.Tick(1000 * 1000 * 1000 * 60 * 15)
 	for !closed(ticker) {
 		select {
 		case <-ticker:
 			fmt.Println(time.LocalTime())
-			if n.Disconnected {
+			if n.State() == ircchans.Disconnected {
 				fmt.Println("Disconnected")
 				for err := n.Connect(); err != nil; err = n.Connect() {
 					fmt.Printf("Connection failed: %s", err.String())
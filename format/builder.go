@@ -0,0 +1,152 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//Builder composes formatted messages:
+//	format.NewBuilder().Bold().Text("warning:").Bold().Color(format.Red, format.NoColor).Text(" disk full").String()
+type Builder struct {
+	buf   *bytes.Buffer
+	st    Style
+	guard string //characters the next text can't start with, they would be read as part of the last colour code
+}
+
+func NewBuilder() *Builder {
+	return &Builder{bytes.NewBufferString(""), Plain, ""}
+}
+
+func (b *Builder) toggle(code string, on *bool) *Builder {
+	*on = !*on
+	b.buf.WriteString(code)
+	b.guard = ""
+	return b
+}
+
+//Bold turns bold on, or off if it is on; the other toggles work the same way
+func (b *Builder) Bold() *Builder {
+	return b.toggle(CodeBold, &b.st.Bold)
+}
+
+func (b *Builder) Italic() *Builder {
+	return b.toggle(CodeItalic, &b.st.Italic)
+}
+
+func (b *Builder) Underline() *Builder {
+	return b.toggle(CodeUnderline, &b.st.Underline)
+}
+
+func (b *Builder) Strike() *Builder {
+	return b.toggle(CodeStrike, &b.st.Strike)
+}
+
+func (b *Builder) Monospace() *Builder {
+	return b.toggle(CodeMonospace, &b.st.Monospace)
+}
+
+func (b *Builder) Reverse() *Builder {
+	return b.toggle(CodeReverse, &b.st.Reverse)
+}
+
+func colorArg(c Color) string {
+	if c == NoColor {
+		return "99"
+	}
+	return fmt.Sprintf("%02d", int(c)) //always two digits, the text may start with one
+}
+
+func hexArg(c Color) string {
+	rgb, _ := c.Value()
+	return fmt.Sprintf("%06X", rgb)
+}
+
+//Color sets the foreground and background colours, NoColor for the defaults. RGB colours
+//use the hex colour code, which fewer clients understand and which has no default
+//foreground: black is used instead.
+func (b *Builder) Color(fg, bg Color) *Builder {
+	prevbg := b.st.Bg
+	b.st.Fg, b.st.Bg = fg, bg
+	switch {
+	case fg == NoColor && bg == NoColor:
+		b.buf.WriteString(CodeColor)
+		b.guard = "0123456789"
+		return b
+	case fg.IsRGB() || bg.IsRGB():
+		if fg == NoColor {
+			fg, b.st.Fg = Black, Black
+		}
+		if bg == NoColor && prevbg != NoColor {
+			b.buf.WriteString(CodeColor)
+		}
+		b.buf.WriteString(CodeHexColor + hexArg(fg))
+		b.guard = ","
+		if bg != NoColor {
+			b.buf.WriteString("," + hexArg(bg))
+			b.guard = ""
+		}
+		return b
+	}
+	b.buf.WriteString(CodeColor + colorArg(fg))
+	b.guard = ","
+	if bg != NoColor || prevbg != NoColor {
+		b.buf.WriteString("," + colorArg(bg))
+		b.guard = ""
+	}
+	return b
+}
+
+//Reset turns all formatting off
+func (b *Builder) Reset() *Builder {
+	b.st = Plain
+	b.buf.WriteString(CodeReset)
+	b.guard = ""
+	return b
+}
+
+//Text appends unformatted text in the current style
+func (b *Builder) Text(s string) *Builder {
+	if s != "" {
+		if strings.IndexRune(b.guard, int(s[0])) > -1 {
+			b.buf.WriteString(CodeBold + CodeBold) //ends the colour code without changing the style
+		}
+		b.guard = ""
+	}
+	b.buf.WriteString(s)
+	return b
+}
+
+//Span appends text in the given style, and leaves the style at that
+func (b *Builder) Span(span Span) *Builder {
+	if !b.st.equal(span.Style) {
+		b.Reset()
+		if span.Bold {
+			b.Bold()
+		}
+		if span.Italic {
+			b.Italic()
+		}
+		if span.Underline {
+			b.Underline()
+		}
+		if span.Strike {
+			b.Strike()
+		}
+		if span.Monospace {
+			b.Monospace()
+		}
+		if span.Reverse {
+			b.Reverse()
+		}
+		if span.Fg != NoColor || span.Bg != NoColor {
+			b.Color(span.Fg, span.Bg)
+		}
+	}
+	return b.Text(span.Text)
+}
+
+//String returns the message built so far
+func (b *Builder) String() string {
+	return b.buf.String()
+}
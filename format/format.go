@@ -0,0 +1,220 @@
+//Package format parses the mIRC formatting codes found in irc messages into styled spans,
+//strips them, renders them for terminals, HTML and Markdown, and builds formatted messages.
+package format
+
+import (
+	"bytes"
+	"strings"
+	"strconv"
+)
+
+//formatting control codes
+const (
+	CodeBold      = "\x02"
+	CodeColor     = "\x03"
+	CodeHexColor  = "\x04"
+	CodeReset     = "\x0f"
+	CodeMonospace = "\x11"
+	CodeReverse   = "\x16"
+	CodeItalic    = "\x1d"
+	CodeStrike    = "\x1e"
+	CodeUnderline = "\x1f"
+)
+
+//Color is a mIRC colour number (0-98) or, for hex colour codes, an RGB value with the
+//rgbFlag bit set
+type Color int
+
+const (
+	NoColor Color = -1
+	rgbFlag Color = 1 << 24
+)
+
+//the 16 standard colours
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+//palette holds the RGB values of colours 0-98, 99 means the default colour
+var palette = []uint32{
+	0xffffff, 0x000000, 0x00007f, 0x009300, 0xff0000, 0x7f0000, 0x9c009c, 0xfc7f00,
+	0xffff00, 0x00fc00, 0x009393, 0x00ffff, 0x0000fc, 0xff00ff, 0x7f7f7f, 0xd2d2d2,
+	0x470000, 0x472100, 0x474700, 0x324700, 0x004700, 0x00472c, 0x004747, 0x002747, 0x000047, 0x2e0047, 0x470047, 0x47002a,
+	0x740000, 0x743a00, 0x747400, 0x517400, 0x007400, 0x007449, 0x007474, 0x004074, 0x000074, 0x4b0074, 0x740074, 0x740045,
+	0xb50000, 0xb56300, 0xb5b500, 0x7db500, 0x00b500, 0x00b571, 0x00b5b5, 0x0063b5, 0x0000b5, 0x7500b5, 0xb500b5, 0xb5006b,
+	0xff0000, 0xff8c00, 0xffff00, 0xb2ff00, 0x00ff00, 0x00ffa0, 0x00ffff, 0x008cff, 0x0000ff, 0xa500ff, 0xff00ff, 0xff0098,
+	0xff5959, 0xffb459, 0xffff71, 0xcfff60, 0x6fff6f, 0x65ffc9, 0x6dffff, 0x59b4ff, 0x5959ff, 0xc459ff, 0xff66ff, 0xff59bc,
+	0xff9c9c, 0xffd39c, 0xffff9c, 0xe2ff9c, 0x9cff9c, 0x9cffdb, 0x9cffff, 0x9cd3ff, 0x9c9cff, 0xdc9cff, 0xff9cff, 0xff94d3,
+	0x000000, 0x131313, 0x282828, 0x363636, 0x4d4d4d, 0x656565, 0x818181, 0x9f9f9f, 0xbcbcbc, 0xe2e2e2, 0xffffff,
+}
+
+//RGB returns the colour for a hex colour code
+func RGB(r, g, b byte) Color {
+	return rgbFlag | Color(r)<<16 | Color(g)<<8 | Color(b)
+}
+
+//IsRGB reports whether c came from a hex colour code rather than the mIRC palette
+func (c Color) IsRGB() bool {
+	return c != NoColor && c&rgbFlag != 0
+}
+
+//Value returns the RGB value of c, ok is false for NoColor
+func (c Color) Value() (rgb uint32, ok bool) {
+	switch {
+	case c.IsRGB():
+		return uint32(c &^ rgbFlag), true
+	case c >= 0 && int(c) < len(palette):
+		return palette[c], true
+	}
+	return 0, false
+}
+
+//Style is the formatting in effect for a piece of text
+type Style struct {
+	Bold, Italic, Underline, Strike, Monospace, Reverse bool
+	Fg, Bg                                              Color
+}
+
+//Plain is the style of unformatted text
+var Plain = Style{Fg: NoColor, Bg: NoColor}
+
+//IsPlain reports whether s has no formatting at all
+func (s Style) IsPlain() bool {
+	return !s.Bold && !s.Italic && !s.Underline && !s.Strike && !s.Monospace && !s.Reverse &&
+		s.Fg == NoColor && s.Bg == NoColor
+}
+
+func (s Style) equal(o Style) bool {
+	return s.Bold == o.Bold && s.Italic == o.Italic && s.Underline == o.Underline && s.Strike == o.Strike &&
+		s.Monospace == o.Monospace && s.Reverse == o.Reverse && s.Fg == o.Fg && s.Bg == o.Bg
+}
+
+//a piece of text in a single style
+type Span struct {
+	Style
+	Text string
+}
+
+//digits returns how many (at most max) bytes at the start of s are in set
+func digits(s, set string, max int) int {
+	i := 0
+	for i < len(s) && i < max && strings.Index(set, s[i:i+1]) > -1 {
+		i++
+	}
+	return i
+}
+
+const (
+	decDigits = "0123456789"
+	hexDigits = "0123456789abcdefABCDEF"
+)
+
+func paletteColor(s string) Color {
+	c, _ := strconv.Atoi(s)
+	if c >= len(palette) { //99 is the default colour
+		return NoColor
+	}
+	return Color(c)
+}
+
+func hexColor(s string) Color {
+	v, _ := strconv.Btoui64(s, 16)
+	return rgbFlag | Color(v)
+}
+
+//parseColor parses the arguments following a colour code in s. It returns how many bytes
+//they use, and whether there was a foreground (set) and a background colour.
+func parseColor(s string, hex bool) (fg, bg Color, n int, set, setbg bool) {
+	chars, width, conv := decDigits, 2, paletteColor
+	if hex {
+		chars, width, conv = hexDigits, 6, hexColor
+	}
+	if n = digits(s, chars, width); n == 0 || (hex && n < width) {
+		return NoColor, NoColor, 0, false, false
+	}
+	fg = conv(s[:n])
+	if n+1 < len(s) && s[n] == ',' {
+		if m := digits(s[n+1:], chars, width); m > 0 && (!hex || m == width) {
+			return fg, conv(s[n+1 : n+1+m]), n + 1 + m, true, true
+		}
+	}
+	return fg, NoColor, n, true, false
+}
+
+//Parse splits s into spans of differently formatted text, dropping the formatting codes
+func Parse(s string) []Span {
+	spans := make([]Span, 0)
+	st := Plain
+	text := bytes.NewBufferString("")
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, Span{st, text.String()})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case CodeBold[0]:
+			flush()
+			st.Bold = !st.Bold
+		case CodeItalic[0]:
+			flush()
+			st.Italic = !st.Italic
+		case CodeUnderline[0]:
+			flush()
+			st.Underline = !st.Underline
+		case CodeStrike[0]:
+			flush()
+			st.Strike = !st.Strike
+		case CodeMonospace[0]:
+			flush()
+			st.Monospace = !st.Monospace
+		case CodeReverse[0]:
+			flush()
+			st.Reverse = !st.Reverse
+		case CodeReset[0]:
+			flush()
+			st = Plain
+		case CodeColor[0], CodeHexColor[0]:
+			flush()
+			fg, bg, n, set, setbg := parseColor(s[i+1:], s[i] == CodeHexColor[0])
+			i += n
+			switch {
+			case !set: //a lone colour code resets the colours
+				st.Fg, st.Bg = NoColor, NoColor
+			case setbg:
+				st.Fg, st.Bg = fg, bg
+			default:
+				st.Fg = fg
+			}
+		default:
+			text.WriteByte(s[i])
+		}
+	}
+	flush()
+	return spans
+}
+
+//Strip removes all formatting from s
+func Strip(s string) string {
+	buf := bytes.NewBufferString("")
+	for _, span := range Parse(s) {
+		buf.WriteString(span.Text)
+	}
+	return buf.String()
+}
@@ -0,0 +1,64 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	spans := Parse("a\x02b\x0304,12c\x1dd\x0f\x03e\x04FF8000f")
+	expected := []Span{
+		{Plain, "a"},
+		{Style{Bold: true, Fg: NoColor, Bg: NoColor}, "b"},
+		{Style{Bold: true, Fg: Red, Bg: LightBlue}, "c"},
+		{Style{Bold: true, Italic: true, Fg: Red, Bg: LightBlue}, "d"},
+		{Plain, "e"},
+		{Style{Fg: RGB(0xff, 0x80, 0), Bg: NoColor}, "f"},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("Format error: expected %d spans, got %d: %#v", len(expected), len(spans), spans)
+	}
+	for i, span := range spans {
+		if span.Text != expected[i].Text || !span.Style.equal(expected[i].Style) {
+			t.Errorf("Format error: span %d is %#v, expected %#v", i, span, expected[i])
+		}
+	}
+	//a comma not followed by a colour belongs to the text, so do digits after two
+	if s := Strip("\x034,x \x031234 \x02\x02plain"); s != ",x 34 plain" {
+		t.Errorf("Format error: stripped to %q", s)
+	}
+}
+
+func TestRender(t *testing.T) {
+	if s := HTML("<\x02b\x02>"); s != "&lt;<span style=\"font-weight: bold\">b</span>&gt;" {
+		t.Errorf("Format error: bad HTML: %s", s)
+	}
+	if s := Markdown("\x02bold \x02\x1dit_alic\x1d"); s != "**bold** _it\\_alic_" {
+		t.Errorf("Format error: bad Markdown: %s", s)
+	}
+	if s := ANSI("\x0304red\x03 plain"); s != "\x1b[0;91mred\x1b[0m plain" {
+		t.Errorf("Format error: bad ANSI: %q", s)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	s := NewBuilder().Bold().Text("1").Bold().Color(Green, NoColor).Text("2").Color(NoColor, NoColor).Text("3").String()
+	if Strip(s) != "123" {
+		t.Errorf("Format error: built %q, which reads %q", s, Strip(s))
+	}
+	s = NewBuilder().Color(Red, NoColor).Text(",5").Color(RGB(0x11, 0x22, 0x33), NoColor).Text(",ABCDEF").String()
+	if Strip(s) != ",5,ABCDEF" {
+		t.Errorf("Format error: built %q, which reads %q", s, Strip(s))
+	}
+	in := "x\x02y\x0305,01z\x1fw"
+	b := NewBuilder()
+	for _, span := range Parse(in) {
+		b.Span(span)
+	}
+	if Strip(b.String()) != Strip(in) {
+		t.Errorf("Format error: round trip of %q gave %q", in, b.String())
+	}
+	out := Parse(b.String())
+	if last := out[len(out)-1]; !last.Underline || last.Fg != Brown || last.Bg != Black {
+		t.Errorf("Format error: round trip lost the style: %#v", last)
+	}
+}
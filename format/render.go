@@ -0,0 +1,183 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//ANSI colour numbers for the 16 standard colours, add 10 for backgrounds
+var ansiColors = []int{97, 30, 34, 32, 91, 31, 35, 33, 93, 92, 36, 96, 94, 95, 90, 37}
+
+func ansiColor(c Color, bg bool) string {
+	off := 0
+	if bg {
+		off = 10
+	}
+	if c >= 0 && int(c) < len(ansiColors) {
+		return fmt.Sprintf(";%d", ansiColors[c]+off)
+	}
+	rgb, _ := c.Value() //extended palette and hex colours need a 24 bit terminal
+	return fmt.Sprintf(";%d;2;%d;%d;%d", 38+off, rgb>>16, rgb>>8&0xff, rgb&0xff)
+}
+
+//ANSI renders s with terminal escape sequences
+func ANSI(s string) string {
+	buf := bytes.NewBufferString("")
+	styled := false
+	for _, span := range Parse(s) {
+		if span.IsPlain() {
+			if styled {
+				buf.WriteString("\x1b[0m")
+				styled = false
+			}
+			buf.WriteString(span.Text)
+			continue
+		}
+		buf.WriteString("\x1b[0")
+		for _, a := range []struct {
+			on   bool
+			code string
+		}{{span.Bold, ";1"}, {span.Italic, ";3"}, {span.Underline, ";4"}, {span.Reverse, ";7"}, {span.Strike, ";9"}} {
+			if a.on {
+				buf.WriteString(a.code)
+			}
+		}
+		if span.Fg != NoColor {
+			buf.WriteString(ansiColor(span.Fg, false))
+		}
+		if span.Bg != NoColor {
+			buf.WriteString(ansiColor(span.Bg, true))
+		}
+		buf.WriteString("m" + span.Text)
+		styled = true
+	}
+	if styled {
+		buf.WriteString("\x1b[0m")
+	}
+	return buf.String()
+}
+
+func htmlEscape(s string) string {
+	buf := bytes.NewBufferString("")
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '&':
+			buf.WriteString("&amp;")
+		case '"':
+			buf.WriteString("&quot;")
+		case '\'':
+			buf.WriteString("&#39;")
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+func cssColor(c Color) string {
+	rgb, _ := c.Value()
+	return fmt.Sprintf("#%06x", rgb)
+}
+
+//HTML renders s as HTML, formatted text goes in span elements with inline styles
+func HTML(s string) string {
+	buf := bytes.NewBufferString("")
+	for _, span := range Parse(s) {
+		if span.IsPlain() {
+			buf.WriteString(htmlEscape(span.Text))
+			continue
+		}
+		css := make([]string, 0)
+		if span.Bold {
+			css = append(css, "font-weight: bold")
+		}
+		if span.Italic {
+			css = append(css, "font-style: italic")
+		}
+		switch {
+		case span.Underline && span.Strike:
+			css = append(css, "text-decoration: underline line-through")
+		case span.Underline:
+			css = append(css, "text-decoration: underline")
+		case span.Strike:
+			css = append(css, "text-decoration: line-through")
+		}
+		if span.Monospace {
+			css = append(css, "font-family: monospace")
+		}
+		fg, bg := span.Fg, span.Bg
+		if span.Reverse {
+			if fg == NoColor {
+				fg = Black
+			}
+			if bg == NoColor {
+				bg = White
+			}
+			fg, bg = bg, fg
+		}
+		if fg != NoColor {
+			css = append(css, "color: "+cssColor(fg))
+		}
+		if bg != NoColor {
+			css = append(css, "background-color: "+cssColor(bg))
+		}
+		fmt.Fprintf(buf, "<span style=\"%s\">%s</span>", strings.Join(css, "; "), htmlEscape(span.Text))
+	}
+	return buf.String()
+}
+
+const markdownSpecial = "\\`*_~[]<>#|"
+
+func markdownEscape(s string) string {
+	buf := bytes.NewBufferString("")
+	for i := 0; i < len(s); i++ {
+		if strings.Index(markdownSpecial, s[i:i+1]) > -1 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+//Markdown renders s as Markdown. Colours, reverse and underline have no Markdown equivalent
+//and are dropped.
+func Markdown(s string) string {
+	buf := bytes.NewBufferString("")
+	for _, span := range Parse(s) {
+		text := span.Text
+		//emphasis markers must touch the text, keep surrounding spaces outside
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" {
+			buf.WriteString(text)
+			continue
+		}
+		lead := text[:strings.Index(text, trimmed)]
+		trail := text[len(lead)+len(trimmed):]
+		open := ""
+		if span.Monospace {
+			open = "`"
+		} else {
+			trimmed = markdownEscape(trimmed)
+		}
+		if span.Strike {
+			open = "~~" + open
+		}
+		if span.Italic {
+			open = "_" + open
+		}
+		if span.Bold {
+			open = "**" + open
+		}
+		end := ""
+		for i := len(open) - 1; i >= 0; i-- {
+			end += open[i : i+1]
+		}
+		buf.WriteString(lead + open + trimmed + end + trail)
+	}
+	return buf.String()
+}
@@ -0,0 +1,136 @@
+package ircchans
+
+import (
+	"strings"
+)
+
+//the source of a message: nick!user@host for users, only Host (the server name) for servers
+type Hostmask struct {
+	Nick string
+	User string
+	Host string
+}
+
+//ParseHostmask parses a message prefix. Server names contain dots, which nicks can't.
+func ParseHostmask(prefix string) Hostmask {
+	var h Hostmask
+	if strings.IndexAny(prefix, "!@") == -1 && strings.Contains(prefix, ".") {
+		h.Host = prefix
+		return h
+	}
+	h.Nick = prefix
+	if i := strings.Index(h.Nick, "@"); i > -1 {
+		h.Host = h.Nick[i+1:]
+		h.Nick = h.Nick[:i]
+	}
+	if i := strings.Index(h.Nick, "!"); i > -1 {
+		h.User = h.Nick[i+1:]
+		h.Nick = h.Nick[:i]
+	}
+	return h
+}
+
+//IsServer reports whether the prefix was a server name
+func (h Hostmask) IsServer() bool {
+	return h.Nick == "" && h.Host != ""
+}
+
+//Name returns the nick, or the server name for servers
+func (h Hostmask) Name() string {
+	if h.IsServer() {
+		return h.Host
+	}
+	return h.Nick
+}
+
+func (h Hostmask) String() string {
+	if h.IsServer() {
+		return h.Host
+	}
+	s := h.Nick
+	if h.User != "" {
+		s += "!" + h.User
+	}
+	if h.Host != "" {
+		s += "@" + h.Host
+	}
+	return s
+}
+
+//Match reports whether h matches the glob mask (e.g. a ban mask like *!*@*.example.org),
+//comparing case insensitively according to casemapping
+func (h Hostmask) Match(mask, casemapping string) bool {
+	s := h.String()
+	if !h.IsServer() && strings.IndexAny(mask, "!@") > -1 { //keep the separators even if we don't know user or host
+		s = h.Nick + "!" + h.User + "@" + h.Host
+	}
+	return MatchMask(mask, s, casemapping)
+}
+
+//MatchMask matches s against mask, where * matches any sequence of characters and ? any
+//single one, comparing case insensitively according to casemapping
+func MatchMask(mask, s, casemapping string) bool {
+	return glob(CaseFold(casemapping, mask), CaseFold(casemapping, s))
+}
+
+func glob(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0 //position of the last * in pattern, and where in s it started matching
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star > -1: //let the last * eat one more character
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+//CaseFold lower cases s according to an ISUPPORT CASEMAPPING: in rfc1459 (the default)
+//[]\~ are the upper case forms of {}|^, strict-rfc1459 leaves ~ and ^ alone, ascii only
+//folds letters
+func CaseFold(casemapping, s string) string {
+	upper := "ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\~"
+	switch strings.ToLower(casemapping) {
+	case "ascii":
+		upper = upper[:26]
+	case "strict-rfc1459":
+		upper = upper[:29]
+	}
+	lower := "abcdefghijklmnopqrstuvwxyz{}|^"
+	return strings.Map(func(c int) int {
+		if i := strings.IndexRune(upper, c); i > -1 {
+			return int(lower[i])
+		}
+		return c
+	}, s)
+}
+
+//Fold lower cases a nick or channel name the way the server does
+func (n *Network) Fold(s string) string {
+	cm, _ := n.ISupport("CASEMAPPING")
+	return CaseFold(cm, s)
+}
+
+//EqualFold reports whether two nicks or channel names are the same for the server
+func (n *Network) EqualFold(a, b string) bool {
+	return n.Fold(a) == n.Fold(b)
+}
+
+//MatchHostmask reports whether h matches mask with the server's casemapping
+func (n *Network) MatchHostmask(mask string, h Hostmask) bool {
+	cm, _ := n.ISupport("CASEMAPPING")
+	return h.Match(mask, cm)
+}
@@ -0,0 +1,221 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+//what an ignore applies to
+const (
+	IgnorePrivmsg = 1 << iota
+	IgnoreNotice
+	IgnoreCtcp  //CTCP requests and replies, but not ACTION
+	IgnoreJoins //JOIN, PART, QUIT and NICK noise
+	IgnoreInvite
+	IgnoreAll = IgnorePrivmsg | IgnoreNotice | IgnoreCtcp | IgnoreJoins | IgnoreInvite
+)
+
+//an entry of the ignore list
+type Ignore struct {
+	Mask    string //hostmask glob, e.g. *!*@*.example.org
+	Scope   int    //Ignore* flags
+	Channel string //only ignore on this channel, "" for everywhere
+	Expires int64  //in seconds since the epoch, 0 for never
+	Reason  string
+}
+
+func (i Ignore) expired(now int64) bool {
+	return i.Expires != 0 && i.Expires <= now
+}
+
+//IgnoreStore keeps the ignore list across restarts
+type IgnoreStore interface {
+	Load() ([]Ignore, os.Error)
+	Save(ignores []Ignore) os.Error
+}
+
+//the ignore list in a JSON file
+type ignoreFile string
+
+//NewIgnoreFile returns a store keeping the ignore list in a JSON file, name is relative to the
+//configuration directory unless it is absolute
+func NewIgnoreFile(name string) IgnoreStore {
+	if len(name) == 0 || name[0] != '/' {
+		name = confdir + "/" + name
+	}
+	return ignoreFile(name)
+}
+
+func (f ignoreFile) Load() ([]Ignore, os.Error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+			return []Ignore{}, nil
+		}
+		return nil, err
+	}
+	ignores := make([]Ignore, 0)
+	if err := json.Unmarshal(data, &ignores); err != nil {
+		return nil, err
+	}
+	return ignores, nil
+}
+
+func (f ignoreFile) Save(ignores []Ignore) os.Error {
+	data, err := json.Marshal(ignores)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(string(f), data, 0600)
+}
+
+type ignoreList struct {
+	lock  *sync.RWMutex
+	list  []Ignore
+	store IgnoreStore
+}
+
+func newIgnoreList() ignoreList {
+	return ignoreList{new(sync.RWMutex), make([]Ignore, 0), nil}
+}
+
+//prune drops expired entries, with the lock held
+func (l *ignoreList) prune() {
+	now := time.Seconds()
+	kept := make([]Ignore, 0, len(l.list))
+	for _, i := range l.list {
+		if !i.expired(now) {
+			kept = append(kept, i)
+		}
+	}
+	l.list = kept
+}
+
+//save writes the list to the store, with the lock held
+func (l *ignoreList) save() os.Error {
+	if l.store == nil {
+		return nil
+	}
+	return l.store.Save(l.list)
+}
+
+//SetIgnoreStore loads the ignore list from s, and saves it there on every change
+func (n *Network) SetIgnoreStore(s IgnoreStore) os.Error {
+	list, err := s.Load()
+	if err != nil {
+		return err
+	}
+	n.ignores.lock.Lock()
+	defer n.ignores.lock.Unlock()
+	n.ignores.list, n.ignores.store = list, s
+	n.ignores.prune()
+	return nil
+}
+
+//AddIgnore adds i to the ignore list, replacing an entry with the same mask and channel
+func (n *Network) AddIgnore(i Ignore) os.Error {
+	if i.Mask == "" || i.Scope&IgnoreAll == 0 {
+		return os.NewError(fmt.Sprintf("Empty ignore: %#v", i))
+	}
+	n.ignores.lock.Lock()
+	defer n.ignores.lock.Unlock()
+	found := false
+	for j, old := range n.ignores.list {
+		if n.Fold(old.Mask) == n.Fold(i.Mask) && n.Fold(old.Channel) == n.Fold(i.Channel) {
+			n.ignores.list[j], found = i, true
+			break
+		}
+	}
+	if !found {
+		n.ignores.list = append(n.ignores.list, i)
+	}
+	n.ignores.prune()
+	return n.ignores.save()
+}
+
+//IgnoreFor ignores mask everywhere for duration seconds (0 for ever)
+func (n *Network) IgnoreFor(mask string, scope int, duration int64, reason string) os.Error {
+	i := Ignore{Mask: mask, Scope: scope, Reason: reason}
+	if duration > 0 {
+		i.Expires = time.Seconds() + duration
+	}
+	return n.AddIgnore(i)
+}
+
+//DelIgnore removes the entry for mask and channel ("" for the global one)
+func (n *Network) DelIgnore(mask, channel string) os.Error {
+	n.ignores.lock.Lock()
+	defer n.ignores.lock.Unlock()
+	for j, old := range n.ignores.list {
+		if n.Fold(old.Mask) == n.Fold(mask) && n.Fold(old.Channel) == n.Fold(channel) {
+			n.ignores.list = append(n.ignores.list[:j], n.ignores.list[j+1:]...)
+			return n.ignores.save()
+		}
+	}
+	return os.NewError(fmt.Sprintf("Not ignoring %s", mask))
+}
+
+//Ignores returns the current ignore list
+func (n *Network) Ignores() []Ignore {
+	n.ignores.lock.Lock()
+	defer n.ignores.lock.Unlock()
+	n.ignores.prune()
+	ret := make([]Ignore, len(n.ignores.list))
+	copy(ret, n.ignores.list)
+	return ret
+}
+
+//ignoreScope returns the kind of message msg is, 0 for messages that can't be ignored
+func ignoreScope(msg *IrcMessage) int {
+	switch msg.Cmd {
+	case "PRIVMSG":
+		if len(msg.Params) > 1 {
+			if verb, _, ok := ParseCtcp(msg.Params[1]); ok && verb != "ACTION" {
+				return IgnoreCtcp
+			}
+		}
+		return IgnorePrivmsg
+	case "NOTICE":
+		if len(msg.Params) > 1 {
+			if _, _, ok := ParseCtcp(msg.Params[1]); ok {
+				return IgnoreCtcp
+			}
+		}
+		return IgnoreNotice
+	case "JOIN", "PART", "QUIT", "NICK":
+		return IgnoreJoins
+	case "INVITE":
+		return IgnoreInvite
+	}
+	return 0
+}
+
+//IsIgnored reports whether msg comes from someone on the ignore list. Ignored messages
+//don't reach the Listen subscribers.
+func (n *Network) IsIgnored(msg *IrcMessage) bool {
+	scope := ignoreScope(msg)
+	h := msg.Hostmask()
+	if scope == 0 || h.IsServer() || h.Nick == "" {
+		return false
+	}
+	channel := n.msgTarget(msg)
+	now := time.Seconds()
+	n.ignores.lock.RLock()
+	defer n.ignores.lock.RUnlock()
+	for _, i := range n.ignores.list {
+		if i.Scope&scope == 0 || i.expired(now) {
+			continue
+		}
+		if i.Channel != "" && !n.EqualFold(i.Channel, channel) {
+			continue
+		}
+		if n.MatchHostmask(i.Mask, h) {
+			return true
+		}
+	}
+	return false
+}
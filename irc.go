@@ -5,6 +5,7 @@ import (
 	"net"
 	"log"
 	"fmt"
+	"strconv"
 	"strings"
 	"bufio"
 	"time"
@@ -17,10 +18,36 @@ import (
 )
 
 const (
-	minute = 1000 * 1000 * 1000 * 60
-	second = minute / 60
+	minute       = 1000 * 1000 * 1000 * 60
+	second       = minute / 60
+	closeTimeout = 10 * second //for Disconnect
 )
 
+//the connection state of a Network
+type ConnState int
+
+const (
+	Disconnected ConnState = iota
+	Connecting             //dialing the server
+	Registering            //sending PASS, NICK and USER
+	Connected
+	Closing //quitting and stopping the goroutines of the connection
+)
+
+var connStates = []string{"Disconnected", "Connecting", "Registering", "Connected", "Closing"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(connStates) {
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+	return connStates[s]
+}
+
+//ErrNotDisconnected is returned by Connect when the network is connected, or on its way
+var ErrNotDisconnected = os.NewError("Network is not disconnected")
+
+var errClosed = os.NewError("Closed while connecting")
+
 var (
 	IRCVERSION = "go-irc-chans v0.1" //customize this for any client
 	confdir    = os.Getenv("HOME") + "/.go-irc-chans"
@@ -31,23 +58,57 @@ var (
 
 type Network struct {
 	nick              string
+	version           string //CTCP VERSION reply
+	confdir           string
 	user              string
 	network, port     string
 	server            string
 	realname          string
 	password          string
 	lag               int64
+	away              bool
+	awayReason        string
+	autoAwayIdle      int64
+	autoAwayReason    string
 	queueOut          chan *IrcMessage
 	l                 *log.Logger
 	conn              net.Conn
-	Disconnected      bool
 	buf               *bufio.ReadWriter
+	state             ConnState
+	dialer            Dialer
+	tlsMode           TlsMode
+	tlsWays           map[string]int //how TLS went with each address under TlsTry, so that failures aren't tried again
+	keepalive         keepalive
+	secure            bool          //whether conn is encrypted
+	stsPort           string        //set to connect once with TLS on that port, when a server asks with sts
+	closing           chan bool     //closed when the running close is done
+	lock              *sync.RWMutex //guards the fields above and dccIP, dccPolicy
+	opers             *sync.Mutex   //one oper command at a time, their replies have no target
+	isupport          isupportMap
+	users             userMap
+	channels          chanMap
+	caps              capSet
+	ctcpHandlers      ctcpRegistry
+	dccIP             string
+	dccPending        dccPendingMap
+	dccPolicy         DccPolicy
+	encoding          encodingSettings
+	ignores           ignoreList
+	plugins           pluginRegistry
+	DccOffers         chan *DccOffer
+	LagEvents         chan *LagEvent
 	Listen, OutListen dispatchMap
 	Shutdown          shutdownDispatcher
 }
 
 
 func CustomTlsConf() (*tls.Config, os.Error) {
+	return customTlsConf(tlsconfdir)
+}
+
+//customTlsConf uses, or creates, the client certificate in dir
+func customTlsConf(tlsconfdir string) (*tls.Config, os.Error) {
+	certfile, keyfile := tlsconfdir+"/clientcert.pem", tlsconfdir+"/clientkey.pem"
 	err := os.MkdirAll(tlsconfdir, 0751)
 	if err != nil {
 		log.Fatalf("Couldn't create directory %s: %s", tlsconfdir, err.String())
@@ -110,10 +171,28 @@ func CustomTlsConf() (*tls.Config, os.Error) {
 	return conf, nil
 }
 
+//Connect connects and registers to the network. It fails with ErrNotDisconnected unless the
+//network is disconnected, and gives up if Close is called meanwhile.
 func (n *Network) Connect() os.Error {
-	if !n.Disconnected {
-		return nil
+	n.lock.RLock()
+	closes := n.keepalive.closes
+	n.lock.RUnlock()
+	return n.connect(closes)
+}
+
+//connect is Connect, giving up if Close was called since closes was read from keepalive
+func (n *Network) connect(closes int) os.Error {
+	n.lock.Lock()
+	if n.state != Disconnected {
+		n.lock.Unlock()
+		return ErrNotDisconnected
+	}
+	if n.keepalive.closes != closes {
+		n.lock.Unlock()
+		return errClosed
 	}
+	n.state = Connecting
+	n.lock.Unlock()
 	var err os.Error
 	for { //empty the write channel so we don't send out-of-context messages
 		select {
@@ -123,69 +202,201 @@ func (n *Network) Connect() os.Error {
 		}
 		break
 	}
-	if n.user == "" || n.nick == "" || n.realname == "" {
+	network, port, nick := n.getStr(&n.network), n.getStr(&n.port), n.GetNick()
+	if n.getStr(&n.user) == "" || nick == "" || n.getStr(&n.realname) == "" {
+		n.setState(Disconnected)
 		return os.NewError("Empty nick and/or user and/or real name")
 	}
-	tlsConfig, err := CustomTlsConf()
-	if err == nil {
-		n.conn, err = tls.Dial("tcp", "", strings.Join([]string{n.network, n.port}, ":"), tlsConfig)
+	n.lock.Lock()
+	mode, stsPort := n.tlsMode, n.stsPort
+	n.stsPort = ""
+	n.lock.Unlock()
+	if stsPort != "" {
+		port, mode = stsPort, TlsRequire
+	} else if p, ok := n.stsPolicy(network); ok && n.stsApplies() { //no plain text until it expires
+		port, mode = strconv.Itoa(p.Port), TlsRequire
 	}
+	addr := strings.Join([]string{network, port}, ":")
+	if isWsURL(network) { //the port, if any, is in the URL
+		addr = network
+	}
+	conn, secure, err := n.dial(addr, mode)
 	if err != nil {
-		n.l.Println("Problem connecting using tls, trying plain-text")
-		n.conn, err = net.Dial("tcp", "", strings.Join([]string{n.network, n.port}, ":"))
-		if err != nil {
-			return os.NewError(fmt.Sprintf("Couldn't connect to network %s: %s.\n", n.network, err.String()))
-		}
+		n.setState(Disconnected)
+		return os.NewError(fmt.Sprintf("Couldn't connect to network %s: %s.\n", network, err.String()))
 	}
-	n.buf = bufio.NewReadWriter(bufio.NewReader(n.conn), bufio.NewWriter(n.conn))
-	n.server = n.conn.RemoteAddr().String()
-	n.Disconnected = false
-	n.l.Printf("Connected to network %s, server %s\n", n.network, n.server)
+	n.isupport.reset()
+	n.users.reset()
+	n.channels.reset()
+	n.lock.Lock()
+	if n.keepalive.closes != closes {
+		n.state = Disconnected
+		n.lock.Unlock()
+		conn.Close()
+		return errClosed
+	}
+	n.conn = conn
+	n.buf = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	n.server = conn.RemoteAddr().String()
+	n.secure = secure
+	n.keepalive.reset()
+	n.away, n.awayReason = false, ""
+	n.state = Registering
+	n.lock.Unlock()
+	n.l.Printf("Connected to network %s, server %s\n", network, conn.RemoteAddr().String())
+	go n.logger()
 	go n.receiver()
 	go n.sender()
 	go n.pinger()
 	go n.ponger()
 	go n.ctcp()
+	go n.isupportTracker()
+	go n.tracker()
+	go n.autoAway()
 	err = n.Register()
+	if up, ok := err.(*stsUpgrade); ok {
+		n.l.Println(up.String())
+		if err := n.quit("Switching to TLS", closeTimeout); err != nil {
+			n.l.Println(err.String())
+		}
+		n.lock.Lock()
+		n.stsPort = up.port
+		n.lock.Unlock()
+		return n.connect(closes)
+	}
 	if err != nil {
-		n.Disconnect("Error during connection")
-		return os.NewError(fmt.Sprintf("Couldn't register to network %s: %s.\n", n.network, err.String()))
+		if err := n.quit("Error during connection", closeTimeout); err != nil {
+			n.l.Println(err.String())
+		}
+		return os.NewError(fmt.Sprintf("Couldn't register to network %s: %s.\n", network, err.String()))
+	}
+	n.lock.Lock()
+	if n.state == Registering {
+		n.state = Connected
+	}
+	n.lock.Unlock()
+	if val, ok := n.caps.offered("sts"); ok && secure && !isWsURL(network) {
+		p, _ := strconv.Atoi(port)
+		if err := n.updateSts(network, p, val); err != nil {
+			n.l.Println(err.String())
+		}
 	}
 	n.Ping()
-	n.l.Printf("Network lag is: %d nanoseconds", n.lag)
+	n.l.Printf("Network lag is: %d nanoseconds", n.Lag())
 	return nil
 }
 
+//Reconnect closes the connection, waiting for that to be done, and connects again
 func (n *Network) Reconnect(reason string) os.Error {
-	n.l.Printf("Connecting to irc network %s.\n", n.network)
-	if !n.Disconnected {
-		n.Disconnect(reason)
+	n.l.Printf("Connecting to irc network %s.\n", n.GetNetName())
+	if err := n.Close(reason, closeTimeout); err != nil {
+		n.l.Println(err.String())
 	}
 	return n.Connect()
 }
 
+//Disconnect is Close with the default timeout, logging the goroutines that didn't stop
 func (n *Network) Disconnect(reason string) {
-	if n.conn != nil {
-		n.Quit(reason)
-		time.Sleep(timeout(n.lag)) //FIXME: sleep 1 second to send QUIT message
-		if rem := n.Shutdown.do(); rem != 0 {
-			if rem := n.Shutdown.do(); rem != 0 {
-				os.Exit(1)
+	if err := n.Close(reason, closeTimeout); err != nil {
+		n.l.Println(err.String())
+	}
+}
+
+//Close quits with reason, waits for the QUIT to be written and stops the goroutines of the
+//connection, giving up after timeout nanoseconds. Goroutines still running then are
+//reported in the error. If the connection is already closing, Close waits for that instead.
+func (n *Network) Close(reason string, timeout int64) os.Error {
+	n.lock.Lock()
+	n.keepalive.closes++ //stops reconnect
+	n.lock.Unlock()
+	return n.quit(reason, timeout)
+}
+
+//quit is Close for the disconnections of the library itself, which don't stop reconnect
+func (n *Network) quit(reason string, timeout int64) os.Error {
+	n.lock.Lock()
+	if n.state == Closing { //wait for the close already running
+		closing := n.closing
+		n.lock.Unlock()
+		select {
+		case <-closing:
+			return nil
+		case <-time.After(timeout):
+			return os.NewError(fmt.Sprintf("Connection to %s still closing after the timeout", n.GetNetName()))
+		}
+	}
+	if n.conn == nil {
+		n.lock.Unlock()
+		return nil
+	}
+	n.startClosing()
+	n.lock.Unlock()
+	return n.close(reason, true, timeout)
+}
+
+//startClosing moves to the Closing state, with the lock held
+func (n *Network) startClosing() {
+	n.state = Closing
+	n.closing = make(chan bool)
+}
+
+//connError closes the connection after an error in one of its goroutines, which must
+//return right after
+func (n *Network) connError(reason string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.state == Closing || n.conn == nil {
+		return
+	}
+	n.startClosing()
+	go n.close(reason, false, closeTimeout)
+}
+
+func (n *Network) close(reason string, quit bool, timeout int64) os.Error {
+	deadline := time.Nanoseconds() + timeout
+	if quit {
+		sent := make(chan *IrcMessage, 1)
+		n.OutListen.RegListener("QUIT", "close", sent)
+		select { //the sender dispatches to OutListen once the line is flushed
+		case n.queueOut <- &IrcMessage{"", "QUIT", []string{reason}, nil}:
+			select {
+			case <-sent:
+			case <-time.After(remaining(deadline)):
 			}
+		case <-time.After(remaining(deadline)):
 		}
-		n.conn.Close()
+		n.OutListen.DelListener("QUIT", "close")
 	}
-	n.Disconnected = true
+	n.Shutdown.signal(deadline)
+	conn, _ := n.connection()
+	conn.Close() //stops the reader
+	stale := n.Shutdown.wait(deadline)
+	n.lock.Lock()
+	secure := n.secure
+	n.conn, n.buf = nil, nil
+	n.secure = false
+	n.state = Disconnected
 	n.lag = second * 3
-	return
+	close(n.closing)
+	n.closing = nil
+	n.lock.Unlock()
+	if secure {
+		n.refreshSts(n.GetNetName())
+	}
+	if len(stale) > 0 {
+		return os.NewError(fmt.Sprintf("Goroutines still running after closing the connection to %s: %s", n.GetNetName(), strings.Join(stale, ", ")))
+	}
+	return nil
 }
 
 func (n *Network) sender() {
-	exch := make(chan bool, 10)
-	err := n.Shutdown.Reg(exch)
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("sender", exch)
 	if err != nil {
 		return
 	}
+	defer close(done)
+	conn, buf := n.connection()
 	for {
 		var msg *IrcMessage
 		select {
@@ -196,21 +407,21 @@ func (n *Network) sender() {
 			}
 			continue
 		}
-		if n.conn == nil || n.buf == nil {
+		if conn == nil || buf == nil {
 			n.l.Printf("Error writing message (%s): No connection", msg)
-			n.Disconnect("Connection error")
+			n.connError("Connection error")
 			return
 		}
-		_, err = n.buf.WriteString(fmt.Sprintf("%s\r\n", msg.String()))
+		_, err = buf.WriteString(fmt.Sprintf("%s\r\n", n.encodeMsg(msg).String()))
 		if err != nil {
 			n.l.Printf("Error writing to socket (%s): %s", err.String(), msg)
-			n.Disconnect("Connection error")
+			n.connError("Connection error")
 			return
 		}
-		err = n.buf.Flush()
+		err = buf.Flush()
 		if err != nil {
 			n.l.Printf("Error flushing socket (%s): %s", err.String(), msg)
-			n.Disconnect("Connection error")
+			n.connError("Connection error")
 			return
 		}
 		go n.OutListen.dispatch(*msg)
@@ -219,30 +430,24 @@ func (n *Network) sender() {
 }
 
 func (n *Network) receiver() {
-	exch := make(chan bool, 10)
-	err := n.Shutdown.Reg(exch)
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("receiver", exch)
 	if err != nil {
 		return
 	}
+	defer close(done)
+	_, buf := n.connection()
+	if buf == nil {
+		n.connError("Connection error")
+		return
+	}
+	lines := make(chan string, 10)
+	errch := make(chan os.Error, 1)
+	stop := make(chan bool)
+	defer close(stop)
+	rdone, _ := n.Shutdown.regName("reader", nil)
+	go n.reader(buf, lines, errch, stop, rdone)
 	for {
-		if n.buf == nil {
-			n.Disconnect("Connection error")
-			return
-		}
-		retch := make(chan string)
-		errch := make(chan os.Error)
-		go func(ch chan string, errch chan os.Error) {
-			l, err := n.buf.ReadString('\n')
-			if err != nil {
-				if !closed(errch) {
-					errch <- err
-				}
-			} else {
-				if !closed(ch) {
-					ch <- l
-				}
-			}
-		}(retch, errch)
 		var l string
 		select {
 		case exit := <-exch:
@@ -252,9 +457,9 @@ func (n *Network) receiver() {
 			continue
 		case err := <-errch:
 			n.l.Println("Can't read: socket: ", err.String())
-			n.Disconnect("Connection error")
+			n.connError("Connection error")
 			return
-		case l = <-retch:
+		case l = <-lines:
 		}
 		l = strings.TrimRight(l, "\r\n")
 		msg, err := PackMsg(l)
@@ -262,12 +467,91 @@ func (n *Network) receiver() {
 			n.l.Printf("Couldn't unpack message: %s: %s", err.String(), l)
 			continue
 		}
-		//dispatch
-		go n.Listen.dispatch(msg)
+		n.decodeMsg(&msg)
+		//dispatch in order: numeric replies often only make sense in sequence (RPL_TOPIC, RPL_TOPICWHOTIME...)
+		n.Listen.dispatchIgnored(msg, n.IsIgnored(&msg))
 	}
 	return
 }
 
+//reader is the only goroutine reading the connection, it stops when the connection is
+//closed or when the receiver stops
+func (n *Network) reader(buf *bufio.ReadWriter, lines chan string, errch chan os.Error, stop, done chan bool) {
+	defer close(done)
+	for {
+		l, err := buf.ReadString('\n')
+		if err != nil {
+			errch <- err
+			return
+		}
+		select {
+		case lines <- l:
+		case <-stop:
+			return
+		}
+	}
+}
+
+//State returns the state of the connection
+func (n *Network) State() ConnState {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.state
+}
+
+func (n *Network) setState(s ConnState) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.state = s
+}
+
+//Secure reports whether the connection is encrypted, with TLS or STARTTLS
+func (n *Network) Secure() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.secure
+}
+
+//Lag returns the network lag in nanoseconds as last measured by Ping
+func (n *Network) Lag() int64 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.lag
+}
+
+//setLag records a lag measure, sending the thresholds it crossed on LagEvents
+func (n *Network) setLag(lag int64) {
+	n.lock.Lock()
+	n.lag = lag
+	events := n.keepalive.add(lag)
+	n.lock.Unlock()
+	for _, e := range events {
+		n.lagEvent(e)
+	}
+}
+
+//connection returns the connection and its buffer, nil when disconnected
+func (n *Network) connection() (net.Conn, *bufio.ReadWriter) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.conn, n.buf
+}
+
+//getStr and setStr access the string fields of n (nick, user...) under its lock
+func (n *Network) getStr(field *string) string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return *field
+}
+
+func (n *Network) setStr(field *string, value string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	*field = value
+}
+
+//NewNetwork returns a disconnected network. net is a host name, or a ws:// or wss:// URL
+//for IRC over WebSocket, in which case port is unused.
 func NewNetwork(net, port, nick, usr, rn, pass, logfp string) *Network {
 	n := new(Network)
 	err := os.MkdirAll(confdir, 0751)
@@ -275,19 +559,39 @@ func NewNetwork(net, port, nick, usr, rn, pass, logfp string) *Network {
 		log.Fatalf("Couldn't create directory %s: %s", confdir, err.String())
 	}
 	n.network = net
+	n.version = IRCVERSION
+	n.confdir = confdir
 	n.port = port
 	n.password = pass
 	n.nick = nick
 	n.user = usr
 	n.realname = rn
-	n.Listen = dispatchMap{new(sync.RWMutex), make(map[string]map[string]chan *IrcMessage)}
-	n.OutListen = dispatchMap{new(sync.RWMutex), make(map[string]map[string]chan *IrcMessage)}
-	n.Shutdown = shutdownDispatcher{new(sync.Mutex), make([]chan bool, 0)}
+	n.Listen = newDispatchMap()
+	n.OutListen = newDispatchMap()
+	n.Shutdown = newShutdownDispatcher()
+	n.lock = new(sync.RWMutex)
+	n.opers = new(sync.Mutex)
+	n.isupport = newIsupportMap()
+	n.users = newUserMap(func(s string) string { return n.Fold(s) })
+	n.channels = newChanMap(func(s string) string { return n.Fold(s) })
+	n.ctcpHandlers = newCtcpRegistry()
+	n.dccPending = newDccPendingMap()
+	n.DccOffers = make(chan *DccOffer, 10)
+	n.LagEvents = make(chan *LagEvent, 10)
+	n.dccPolicy = defDccPolicy
+	n.encoding = newEncodingSettings()
+	n.ignores = newIgnoreList()
+	n.plugins = newPluginRegistry()
+	n.caps = newCapSet("invite-notify", "away-notify", "account-notify", "account-tag", "extended-join", "multi-prefix")
 	n.queueOut = make(chan *IrcMessage, 100)
 	n.conn = nil
 	n.buf = nil
+	n.dialer = DirectDialer{}
+	n.tlsMode = TlsTry
+	n.tlsWays = make(map[string]int)
+	n.keepalive = newKeepalive(defKeepalive)
 	n.lag = second // initial lag of 1 second for all irc commands (a lot)
-	n.Disconnected = true
+	n.state = Disconnected
 	logflags := log.Ldate | log.Lmicroseconds | log.Llongfile
 	logprefix := fmt.Sprintf("%s ", n.network)
 	if logfp == "" {
@@ -301,6 +605,5 @@ func NewNetwork(net, port, nick, usr, rn, pass, logfp string) *Network {
 			n.l = log.New(f, logprefix, logflags)
 		}
 	}
-	go n.logger()
 	return n
 }
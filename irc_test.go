@@ -7,11 +7,19 @@ import (
 	"fmt"
 	"strings"
 	"os"
+	"net"
+	"bytes"
+	"bufio"
+	"io"
+	"strconv"
+	"sort"
+	"utf8"
+	"crypto/tls"
 )
+
 //test server
 import "bitbucket.org/kylelemons/jaid/src/pkg/irc"
 
-
 const (
 	maxchans   = 10
 	clients    = 100
@@ -128,13 +136,9 @@ func privmsgTests(t *testing.T, n *Network, tchs []string) {
 	return
 }
 
+//doIrcStuff runs the tests on n, which TestIrc connected
 func doIrcStuff(n *Network, t *testing.T, tchs []string, done chan bool) {
-	err := n.Connect()
 	net, _ := n.NetName("", "")
-	if err != nil {
-		t.Fatalf("Couldn't connect to network %s", net)
-		os.Exit(1)
-	}
 	jobs := 0
 	d := make(chan bool)
 	go runAsync(joinTests, t, n, tchs, d)
@@ -168,7 +172,9 @@ func doIrcStuff(n *Network, t *testing.T, tchs []string, done chan bool) {
 		<-d
 		jobs--
 	}
-	n.Disconnect("You're no fun anymore.")
+	if err := n.Close("You're no fun anymore.", 5*second); err != nil {
+		t.Errorf("Close error: %s", err.String())
+	}
 	done <- true
 }
 
@@ -196,8 +202,8 @@ func TestIrc(t *testing.T) {
 		return ret
 	}
 
-	network := "localhost:16667"
-	sslnetwork := "localhost:16697"
+	network := "localhost"
+	port, sslport := "16667", "16697"
 	nick := "test"
 	user := "nottelling"
 	realname := "I simply rock"
@@ -207,7 +213,7 @@ func TestIrc(t *testing.T) {
 	jobs := 0
 	done := make(chan bool)
 	for i := 0; i < clients; i++ {
-		cls[i] = NewNetwork(network, fmt.Sprintf("%s%d", nick, i), user, realname, password, logfile)
+		cls[i] = NewNetwork(network, port, fmt.Sprintf("%s%d", nick, i), user, realname, password, logfile)
 		go func(i int) {
 			err := cls[i].Connect()
 			if err != nil {
@@ -218,8 +224,7 @@ func TestIrc(t *testing.T) {
 		jobs++
 	}
 	for i := 0; i < sslclients; i++ {
-		sslcls[i] = NewNetwork(sslnetwork, fmt.Sprintf("%s%d", nick, i), user, realname, password, logfile)
-		sslcls[i].Connect()
+		sslcls[i] = NewNetwork(network, sslport, fmt.Sprintf("%s%d", nick, i), user, realname, password, logfile)
 		go func(i int) {
 			err := sslcls[i].Connect()
 			if err != nil {
@@ -247,4 +252,1588 @@ func TestIrc(t *testing.T) {
 		jobs--
 	}
 }
+
+func TestModeSpec(t *testing.T) {
+	spec := NewModeSpec("beI,k,l,imnpst", "(ov)@+")
+	changes, err := spec.Parse([]string{"+ov-b+l", "nick1", "nick2", "*!*@host", "10"})
+	if err != nil {
+		t.Fatalf("Mode error: couldn't parse modes: %s", err.String())
+	}
+	expected := []ModeChange{{true, 'o', "nick1"}, {true, 'v', "nick2"}, {false, 'b', "*!*@host"}, {true, 'l', "10"}}
+	if len(changes) != len(expected) {
+		t.Fatalf("Mode error: expected %#v, got %#v", expected, changes)
+	}
+	for i, c := range changes {
+		if c.Add != expected[i].Add || c.Mode != expected[i].Mode || c.Arg != expected[i].Arg {
+			t.Errorf("Mode error: expected %#v, got %#v", expected[i], c)
+		}
+	}
+	if _, err := spec.Parse([]string{"+X"}); err == nil {
+		t.Errorf("Mode error: parsed unknown mode X without error")
+	}
+	batches := spec.Format(expected, 3)
+	if len(batches) != 2 || strings.Join(batches[0], " ") != "+ov-b nick1 nick2 *!*@host" || strings.Join(batches[1], " ") != "+l 10" {
+		t.Errorf("Mode error: bad batches for MODES=3: %#v", batches)
+	}
+}
+
+func TestCtcpQuoting(t *testing.T) {
+	args := "back\\slash \x01delim\x01 \x10quote\r\n"
+	enc := CtcpEncode("ping", args)
+	if strings.IndexAny(enc[1:len(enc)-1], "\x01\r\n") > -1 {
+		t.Errorf("CTCP error: encoded message contains unquoted characters: %q", enc)
+	}
+	verb, dec, ok := ParseCtcp(enc)
+	if !ok || verb != "PING" || dec != args {
+		t.Errorf("CTCP error: expected PING %q, got %s %q (ok: %v)", args, verb, dec, ok)
+	}
+	if _, _, ok := ParseCtcp("just text"); ok {
+		t.Errorf("CTCP error: plain text parsed as CTCP")
+	}
+	if verb, _, ok := ParseCtcp("\x01VERSION"); !ok || verb != "VERSION" {
+		t.Errorf("CTCP error: couldn't parse CTCP without closing delimiter")
+	}
+}
+
+func TestCtcp(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	started, gate := make(chan bool, 10), make(chan bool)
+	n.RegCtcp("SLOW", func(n *Network, nick, args string) string {
+		started <- true
+		<-gate
+		return ""
+	})
+	go n.ctcp()
+	slow, _ := PackMsg(":a!u@h PRIVMSG bot :\x01SLOW\x01")
+	for running := false; !running; {
+		n.Listen.dispatch(slow) //until the ctcp goroutine listens
+		select {
+		case <-started:
+			running = true
+		case <-time.After(second / 20):
+		}
+	}
+	for i := 0; i < 3; i++ {
+		ping, _ := PackMsg(fmt.Sprintf(":a!u@h PRIVMSG bot :\x01PING %d\x01", i))
+		n.Listen.dispatch(ping)
+	}
+	close(gate)
+	for i := 0; i < 3; i++ {
+		select {
+		case out := <-n.queueOut:
+			if _, args, _ := ParseCtcp(out.Params[1]); args != strconv.Itoa(i) {
+				t.Errorf("CTCP error: expected PING reply %d, got %s", i, out.String())
+			}
+		case <-time.After(second):
+			t.Fatalf("CTCP error: request received during a running handler was dropped")
+		}
+	}
+	deadline := time.Nanoseconds() + second
+	n.Shutdown.signal(deadline)
+	n.Shutdown.wait(deadline)
+}
+
+func TestAction(t *testing.T) {
+	msg, _ := PackMsg(":nick!user@host PRIVMSG #chan :\x01ACTION waves\x01")
+	if text, ok := msg.Action(); !ok || text != "waves" || msg.Payload() != "\x01ACTION waves\x01" {
+		t.Errorf("Action error: expected action \"waves\", got %q (ok: %v, payload %q)", text, ok, msg.Payload())
+	}
+	parts := splitText("héhé héhé héhé", 5)
+	for _, p := range parts {
+		if len(p) > 5 || !utf8.RuneStart(p[0]) {
+			t.Errorf("Action error: bad split %#v", parts)
+			break
+		}
+	}
+	if strings.Replace(strings.Join(parts, ""), " ", "", -1) != "héhéhéhéhéhé" {
+		t.Errorf("Action error: split lost text: %#v", parts)
+	}
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.setLag(second / 10)
+	sent := make(chan string, 10)
+	stop := scripted(n, func(m *IrcMessage) []string {
+		sent <- m.Params[1]
+		return nil
+	})
+	defer close(stop)
+	text := strings.Repeat("\\\x01", 300) //twice as long once quoted
+	start := time.Nanoseconds()
+	if err := n.Action("#chan", text); err != nil {
+		t.Errorf("Action error: sending failed: %s", err.String())
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > 2*timeout(n.Lag()) {
+		t.Errorf("Action error: waited %d ms for the replies to %d messages", elapsed/1e6, len(sent))
+	}
+	got := ""
+	for len(sent) > 0 {
+		line := <-sent
+		if len(line) > n.maxText("PRIVMSG", "#chan") {
+			t.Errorf("Action error: %d bytes message, %d fit", len(line), n.maxText("PRIVMSG", "#chan"))
+		}
+		_, args, _ := ParseCtcp(line)
+		got += args
+	}
+	if got != text {
+		t.Errorf("Action error: quoted split lost text")
+	}
+}
+
+func TestDccChat(t *testing.T) {
+	o, err := ParseDcc("nick", "CHAT chat 2130706433 1234 42")
+	if err != nil || o.IP.String() != "127.0.0.1" || o.Port != 1234 || o.Token != "42" {
+		t.Fatalf("DCC error: bad parse of CHAT offer: %#v (%v)", o, err)
+	}
+	if o.String() != "CHAT chat 2130706433 1234 42" {
+		t.Errorf("DCC error: bad encoding of CHAT offer: %s", o.String())
+	}
+	passive, _ := ParseDcc("nick", "CHAT chat 2130706433 0 42")
+	if _, err := passive.Accept(); err != ErrNoNetwork {
+		t.Errorf("DCC error: accepted a passive offer without a network: %v", err)
+	}
+	if err := passive.Reject(); err != ErrNoNetwork {
+		t.Errorf("DCC error: rejected an offer without a network: %v", err)
+	}
+	l, port, err := dccListen()
+	if err != nil {
+		t.Fatalf("DCC error: couldn't listen: %s", err.String())
+	}
+	peerch := make(chan *DccChat)
+	go func() {
+		conn, err := dccAccept(l, []net.IP{net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Errorf("DCC error: couldn't accept: %s", err.String())
+			close(peerch)
+			return
+		}
+		peerch <- newDccChat("me", conn)
+	}()
+	o.Port = port
+	chat, err := o.Accept()
+	if err != nil {
+		t.Fatalf("DCC error: couldn't connect: %s", err.String())
+	}
+	peer := <-peerch
+	if peer == nil {
+		return
+	}
+	chat.Send("hello ☺")
+	if l := <-peer.In; l != "hello ☺" {
+		t.Errorf("DCC error: expected \"hello ☺\", got %q", l)
+	}
+	peer.Send("bye")
+	if l := <-chat.In; l != "bye" {
+		t.Errorf("DCC error: expected \"bye\", got %q", l)
+	}
+	chat.Close()
+	<-peer.In
+	if !closed(peer.In) {
+		t.Errorf("DCC error: closing one end didn't end the session")
+	}
+	peer.Close()
+	l, port, err = dccListen()
+	if err != nil {
+		t.Fatalf("DCC error: couldn't listen: %s", err.String())
+	}
+	errch := make(chan os.Error)
+	go func() {
+		_, err := dccAccept(l, []net.IP{net.IPv4(192, 0, 2, 1)})
+		errch <- err
+	}()
+	if conn, err := net.Dial("tcp", "", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("DCC error: connection from a stranger not closed")
+		}
+		conn.Close()
+	}
+	l.Close()
+	if err := <-errch; err == nil {
+		t.Errorf("DCC error: accepted a connection from a stranger")
+	}
+	n := NewNetwork("irc.example.org", "6667", "me", "user", "real name", "", "")
+	ch := n.dccPending.add(n.dccKey("Nick", "token", "42"))
+	n.dccRequest("other", "CHAT chat 2130706433 1234 42")
+	n.dccRequest("NICK", "CHAT chat 2130706433 1234 42")
+	select {
+	case reply := <-ch:
+		if reply.Nick != "NICK" {
+			t.Errorf("DCC error: passive offer answered by %s", reply.Nick)
+		}
+	default:
+		t.Errorf("DCC error: answer to a passive offer not delivered")
+	}
+	if o := <-n.DccOffers; o.Nick != "other" {
+		t.Errorf("DCC error: answer from another nick not treated as a new offer: %s", o.Nick)
+	}
+	if a, _ := dccToken(); a == "" {
+		t.Errorf("DCC error: no passive DCC token")
+	}
+}
+
+func TestDccSend(t *testing.T) {
+	for in, out := range map[string]string{"../../etc/passwd": "_.._etc_passwd", ".hidden": "hidden", "a\x01b": "a_b", "": "unnamed"} {
+		if s := SanitizeFilename(in); s != out {
+			t.Errorf("DCC error: sanitised %q to %q, expected %q", in, s, out)
+		}
+	}
+	o, err := ParseDcc("nick", "RESUME \"my file\" 1234 100")
+	if err != nil || o.Arg != "my file" || o.Port != 1234 || o.Size != 100 {
+		t.Fatalf("DCC error: bad parse of RESUME: %#v (%v)", o, err)
+	}
+	data := strings.Repeat("some data ", 10000)
+	dir := tempDir(t, "dccsend")
+	defer os.RemoveAll(dir)
+	src, dst := dir+"/dccsend.in", dir+"/dccsend.out"
+	f, err := os.Open(src, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("DCC error: %s", err.String())
+	}
+	f.WriteString(data)
+	f.Close()
+	l, port, err := dccListen()
+	if err != nil {
+		t.Fatalf("DCC error: couldn't listen: %s", err.String())
+	}
+	sendch := make(chan *DccTransfer)
+	go func() {
+		conn, err := dccAccept(l, []net.IP{net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Errorf("DCC error: couldn't accept: %s", err.String())
+			close(sendch)
+			return
+		}
+		f, size, _ := dccOpen(src)
+		s := newDccTransfer("me", src, size, 0, 0, conn)
+		go s.send(f)
+		sendch <- s
+	}()
+	conn, err := net.Dial("tcp", "", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("DCC error: couldn't connect: %s", err.String())
+	}
+	f, _ = os.Open(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	r := newDccTransfer("nick", dst, int64(len(data)), 0, 0, conn)
+	go r.receive(f)
+	s := <-sendch
+	if s == nil {
+		return
+	}
+	if err := <-r.Done; err != nil {
+		t.Errorf("DCC error: receiving failed: %s", err.String())
+	}
+	if err := <-s.Done; err != nil {
+		t.Errorf("DCC error: sending failed: %s", err.String())
+	}
+	if r.Bytes() != int64(len(data)) || r.Verify(s.Checksum()) != nil {
+		t.Errorf("DCC error: received %d bytes with checksum %s, expected %d with %s", r.Bytes(), r.Checksum(), len(data), s.Checksum())
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	c, ok := getCodec("CP1251")
+	if !ok {
+		t.Fatalf("Encoding error: no cp1251 codec")
+	}
+	enc, err := c.Encode("Привет, мир")
+	if err != nil || enc != "\xcf\xf0\xe8\xe2\xe5\xf2, \xec\xe8\xf0" {
+		t.Errorf("Encoding error: bad cp1251 encoding: %q (%v)", enc, err)
+	}
+	if dec, _ := c.Decode(enc); dec != "Привет, мир" {
+		t.Errorf("Encoding error: bad cp1251 decoding: %q", dec)
+	}
+	n := NewNetwork("irc.example.org", "6667", "nick", "user", "real name", "", "")
+	n.SetChannelEncoding("#ru", "cp1251")
+	msg, _ := PackMsg(":nick!user@host PRIVMSG #ru :" + enc)
+	n.decodeMsg(&msg)
+	if msg.Params[1] != "Привет, мир" {
+		t.Errorf("Encoding error: channel encoding not used: %q", msg.Params[1])
+	}
+	msg, _ = PackMsg(":nick!user@host PRIVMSG #fr :café ☺")
+	n.decodeMsg(&msg)
+	if msg.Params[1] != "café ☺" {
+		t.Errorf("Encoding error: valid UTF-8 mangled: %q", msg.Params[1])
+	}
+	msg, _ = PackMsg(":nick!user@host PRIVMSG #fr :caf\xe9")
+	n.decodeMsg(&msg)
+	if msg.Params[1] != "café" {
+		t.Errorf("Encoding error: fallback decoding failed: %q", msg.Params[1])
+	}
+	if out := n.encodeMsg(&IrcMessage{"", "PRIVMSG", []string{"#ru", "мир"}, nil}); out.Params[1] != "\xec\xe8\xf0" {
+		t.Errorf("Encoding error: message to #ru not encoded: %q", out.Params[1])
+	}
+	n.SetChannelEncoding("#a[b]", "latin1")
+	if enc := n.Encoding("#A{B}"); enc != "iso-8859-1" {
+		t.Errorf("Encoding error: channel encoding not found with rfc1459 casemapping: %s", enc)
+	}
+	if err := n.SetEncoding("ISO-2022-JP"); err == nil {
+		t.Errorf("Encoding error: ISO-2022-JP accepted without a registered codec")
+	}
+	n.isupport.update(&IrcMessage{"", replies["RPL_ISUPPORT"], []string{"nick", "UTF8ONLY", "are supported by this server"}, nil})
+	if out := n.encodeMsg(&IrcMessage{"", "PRIVMSG", []string{"#ru", "мир"}, nil}); out.Params[1] != "мир" {
+		t.Errorf("Encoding error: UTF8ONLY not respected: %q", out.Params[1])
+	}
+}
+
+func TestHostmask(t *testing.T) {
+	h := ParseHostmask("Nick[a]!~user@host.example.org")
+	if h.Nick != "Nick[a]" || h.User != "~user" || h.Host != "host.example.org" || h.IsServer() {
+		t.Errorf("Hostmask error: bad parse: %#v", h)
+	}
+	if s := ParseHostmask("irc.example.org"); !s.IsServer() || s.Name() != "irc.example.org" {
+		t.Errorf("Hostmask error: server prefix not recognised: %#v", s)
+	}
+	for mask, match := range map[string]bool{
+		"*!*@*.example.org": true,
+		"nick{A}!*@*":       true,
+		"nick?a?!~*@host.*": true,
+		"*!user@*":          false,
+		"*@*.example.com":   false,
+	} {
+		if h.Match(mask, "rfc1459") != match {
+			t.Errorf("Hostmask error: matching %s against %s should be %v", h, mask, match)
+		}
+	}
+	if h.Match("nick{a}!*@*", "ascii") {
+		t.Errorf("Hostmask error: ascii casemapping folded brackets")
+	}
+	if msg := (&IrcMessage{"nick!user@host", "PRIVMSG", []string{"#chan", "hi"}, nil}); msg.Origin() != "nick" {
+		t.Errorf("Hostmask error: bad origin: %s", msg.Origin())
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "nick", "user", "real name", "", "")
+	dir := tempDir(t, "ignore")
+	defer os.RemoveAll(dir)
+	store := NewIgnoreFile(dir + "/ignores.json")
+	if err := n.SetIgnoreStore(store); err != nil {
+		t.Fatalf("Ignore error: %s", err.String())
+	}
+	n.AddIgnore(Ignore{Mask: "*!*@spam.example.org", Scope: IgnorePrivmsg | IgnoreCtcp})
+	n.AddIgnore(Ignore{Mask: "troll!*@*", Scope: IgnoreAll, Channel: "#quiet"})
+	n.AddIgnore(Ignore{Mask: "old!*@*", Scope: IgnoreAll, Expires: time.Seconds() - 1})
+	for line, ignored := range map[string]bool{
+		":bot!b@spam.example.org PRIVMSG #chan :buy now":         true,
+		":bot!b@spam.example.org PRIVMSG #chan :\x01VERSION\x01": true,
+		":bot!b@spam.example.org NOTICE #chan :buy now":          false,
+		":troll!t@host JOIN #quiet":                              true,
+		":troll!t@host JOIN #loud":                               false,
+		":old!o@host PRIVMSG nick :hi":                           false,
+		":irc.example.org NOTICE nick :server notice":            false,
+	} {
+		msg, _ := PackMsg(line)
+		if n.IsIgnored(&msg) != ignored {
+			t.Errorf("Ignore error: %s should be ignored: %v", line, ignored)
+		}
+	}
+	if l, err := store.Load(); err != nil || len(l) != 2 {
+		t.Errorf("Ignore error: expected 2 stored entries, got %v (%v)", l, err)
+	}
+	internal, other := make(chan *IrcMessage, 1), make(chan *IrcMessage, 1)
+	n.Listen.regInternal("PRIVMSG", "internal", internal)
+	n.Listen.RegListener("PRIVMSG", "other", other)
+	msg, _ := PackMsg(":bot!b@spam.example.org PRIVMSG #chan :buy now")
+	n.Listen.dispatchIgnored(msg, n.IsIgnored(&msg))
+	if len(internal) != 1 || len(other) != 0 {
+		t.Errorf("Ignore error: ignored message reached %d internal and %d other listeners", len(internal), len(other))
+	}
+	n.DelIgnore("*!*@SPAM.example.org", "")
+	if n.IsIgnored(&msg) {
+		t.Errorf("Ignore error: still ignored after DelIgnore")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	args, err := SplitArgs(`kick "some nick" 'a\b' c\ d ""`)
+	if err != nil || len(args) != 5 || args[1] != "some nick" || args[2] != `a\b` || args[3] != "c d" || args[4] != "" {
+		t.Errorf("Router error: bad split: %q (%v)", args, err)
+	}
+	if _, err := SplitArgs(`"open`); err == nil {
+		t.Errorf("Router error: unterminated quote accepted")
+	}
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	r, err := n.NewRouter("!")
+	if err != nil {
+		t.Fatalf("Router error: %s", err.String())
+	}
+	defer r.Stop()
+	defer r.Stop() //twice is harmless
+	r.Handle(&Command{Name: "greet", Aliases: []string{"hi"}, Handler: func(c *CommandContext) os.Error { return nil }})
+	if err := r.Handle(&Command{Name: "HI"}); err == nil {
+		t.Errorf("Router error: duplicate alias accepted")
+	}
+	for line, expected := range map[string]string{
+		":u!u@h PRIVMSG #chan :!greet \"a b\" c":      "greet #chan a b|c",
+		":u!u@h PRIVMSG #chan :Bot: hi there":         "hi #chan there",
+		":u!u@h PRIVMSG bot :greet":                   "greet u ",
+		":u!u@h PRIVMSG #chan :greet":                 "",
+		":u!u@h PRIVMSG #chan :\x01ACTION !greet\x01": "",
+	} {
+		msg, _ := PackMsg(line)
+		c, _ := r.Parse(&msg)
+		got := ""
+		if c != nil {
+			got = fmt.Sprintf("%s %s %s", c.Command, c.Target, strings.Join(c.Args, "|"))
+		}
+		if got != expected {
+			t.Errorf("Router error: parsed %q as %q, expected %q", line, got, expected)
+		}
+	}
+	ran := make(chan string, 2)
+	r.Handle(&Command{Name: "secret", Roles: []string{"admin"}, Handler: func(c *CommandContext) os.Error {
+		ran <- c.Sender.Nick
+		return nil
+	}})
+	acl := n.NewACL()
+	audit := bytes.NewBufferString("")
+	acl.SetAuditLog(audit)
+	acl.GrantMask("*!*@admin.host", "admin")
+	r.SetACL(acl)
+	for _, line := range []string{":u!u@h PRIVMSG #chan :!secret", ":boss!b@admin.host PRIVMSG bot :secret"} {
+		msg, _ := PackMsg(line)
+		n.Listen.dispatch(msg)
+	}
+	select {
+	case nick := <-ran:
+		if nick != "boss" {
+			t.Errorf("Router error: %s ran a command restricted to admins", nick)
+		}
+	case <-time.After(second):
+		t.Errorf("Router error: the admin's command didn't run")
+	}
+	select {
+	case out := <-n.queueOut:
+		if out.Cmd != "NOTICE" || out.Params[0] != "u" || !strings.HasPrefix(out.Params[1], "Permission denied") {
+			t.Errorf("Router error: expected a denial, got %s", out.String())
+		}
+	case <-time.After(second):
+		t.Errorf("Router error: no denial noticed")
+	}
+	if len(ran) > 0 || strings.Count(audit.String(), "Audit: ") != 2 {
+		t.Errorf("Router error: bad audit %q", audit.String())
+	}
+}
+
+func TestTags(t *testing.T) {
+	msg, err := PackMsg("@account=alice;msgid=a\\sb\\:c :a!u@h PRIVMSG #chan :!op")
+	if err != nil || msg.Tags["account"] != "alice" || msg.Tags["msgid"] != "a b;c" || msg.Prefix != "a!u@h" || msg.Params[1] != "!op" {
+		t.Errorf("Tags error: bad tags: %#v (%v)", msg, err)
+	}
+	if back, _ := PackMsg(msg.String()); back.Tags["msgid"] != "a b;c" {
+		t.Errorf("Tags error: tags lost in %q", msg.String())
+	}
+	if msg, _ := PackMsg(":a!u@h PRIVMSG #chan :hi there"); msg.Tags != nil || msg.String() != ":a!u@h PRIVMSG #chan :hi there" {
+		t.Errorf("Tags error: untagged message became %#v", msg)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.users.seen("alice", "u", "h")
+	n.users.setAccount("alice", "Alice")
+	n.names("#chan", "@+alice")
+	n.names("#chan", "bob!b@host")
+	n.channels.setPrefix("#chan", "bob", '+', true, "@+")
+	if m, ok := n.ChannelMember("#CHAN", "Bob"); !ok || m.Prefixes != "+" || len(n.ChannelMembers("#chan")) != 2 {
+		t.Errorf("Channels error: bad membership: %#v", n.ChannelMembers("#chan"))
+	}
+	if u, _ := n.LookupUser("ALICE"); u.Account != "Alice" {
+		t.Errorf("Channels error: account not recorded: %#v", u)
+	}
+}
+
+func TestACL(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.users.seen("alice", "u", "h")
+	n.users.setAccount("alice", "Alice")
+	n.names("#chan", "@+alice")
+	n.names("#chan", "bob!b@host")
+	n.channels.setPrefix("#chan", "bob", '+', true, "@+")
+	a := n.NewACL()
+	a.SetAuditLog(bytes.NewBufferString(""))
+	a.GrantMask("*!*@host", "trusted")
+	c := &CommandContext{Net: n, Sender: Hostmask{"bob", "b", "host"}, Target: "bob", Private: true}
+	if a.Allowed(c, []string{"admin", "op"}) || !a.Allowed(c, []string{"trusted"}) || !a.Allowed(c, nil) {
+		t.Errorf("ACL error: wrong verdicts for bob in private")
+	}
+	c.Target, c.Private = "#chan", false
+	if roles := a.Roles(c); strings.Join(roles, " ") != "voice trusted" && strings.Join(roles, " ") != "trusted voice" {
+		t.Errorf("ACL error: bob has roles %v", roles)
+	}
+	a.RevokeMask("*!*@host", "trusted")
+	if a.Allowed(c, []string{"trusted"}) {
+		t.Errorf("ACL error: revoked role still allowed")
+	}
+	a.GrantAccount("alice", "admin") //known account, no WHOIS needed
+	c.Sender = Hostmask{"alice", "u", "h"}
+	roles := a.Roles(c)
+	sort.SortStrings(roles)
+	if strings.Join(roles, " ") != "admin op voice" {
+		t.Errorf("ACL error: alice has roles %v", roles)
+	}
+}
+
+type testPlugin struct {
+	c       *PluginContext
+	started bool
+	seen    chan string
+	onInit  func()
+}
+
+func (p *testPlugin) Init(c *PluginContext) os.Error {
+	p.c = c
+	if p.onInit != nil {
+		p.onInit()
+	}
+	return nil
+}
+func (p *testPlugin) Start() os.Error { p.started = true; return nil }
+func (p *testPlugin) Stop()           { p.started = false }
+func (p *testPlugin) Commands() []*Command {
+	return []*Command{&Command{Name: "count", Handler: func(c *CommandContext) os.Error { return nil }}}
+}
+func (p *testPlugin) Handlers() map[string]PluginHandler {
+	return map[string]PluginHandler{"PRIVMSG": func(msg *IrcMessage) {
+		if msg.Params[1] == "boom" {
+			panic("boom")
+		} else if msg.Params[1] == "slow" {
+			time.Sleep(second / 5)
+		}
+		p.seen <- msg.Params[1]
+	}}
+}
+
+func TestPlugin(t *testing.T) {
+	dir := tempDir(t, "plugin")
+	defer os.RemoveAll(dir)
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.SetConfDir(dir)
+	r, err := n.NewRouter("!")
+	if err != nil {
+		t.Fatalf("Plugin error: %s", err.String())
+	}
+	defer r.Stop()
+	n.SetPluginRouter(r)
+	p := &testPlugin{seen: make(chan string, 10)}
+	if err := n.RegisterPlugin("testplugin", p, true); err != nil || !p.started || !n.PluginEnabled("testplugin") {
+		t.Fatalf("Plugin error: not started: %v", err)
+	}
+	if err := n.RegisterPlugin("testplugin", p, true); err == nil {
+		t.Errorf("Plugin error: registered twice")
+	}
+	if _, ok := r.lookup("count"); !ok {
+		t.Errorf("Plugin error: command not added")
+	}
+	for _, text := range []string{"boom", "after"} {
+		msg, _ := PackMsg(":u!u@h PRIVMSG #chan :" + text)
+		n.Listen.dispatch(msg)
+	}
+	select {
+	case text := <-p.seen:
+		if text != "after" {
+			t.Errorf("Plugin error: handler got %q", text)
+		}
+	case <-time.After(second):
+		t.Errorf("Plugin error: handler stopped after a panic")
+	}
+	msg, _ := PackMsg(":u!u@h PRIVMSG #chan :slow")
+	n.Listen.dispatch(msg)
+	time.Sleep(second / 20)
+	if err := n.DisablePlugin("testplugin"); err != nil || p.started || n.PluginEnabled("testplugin") {
+		t.Errorf("Plugin error: not stopped: %v", err)
+	}
+	select {
+	case <-p.seen:
+	default:
+		t.Errorf("Plugin error: stopped while a handler was running")
+	}
+	if _, ok := r.lookup("count"); ok {
+		t.Errorf("Plugin error: command still there when disabled")
+	}
+	msg, _ = PackMsg(":u!u@h PRIVMSG #chan :disabled")
+	n.Listen.dispatch(msg)
+	select {
+	case text := <-p.seen:
+		t.Errorf("Plugin error: disabled handler got %q", text)
+	case <-time.After(second / 10):
+	}
+	if err := p.c.Store.Set("k", "v"); err != nil {
+		t.Errorf("Plugin error: can't store: %s", err.String())
+	}
+	if s, err := newPluginStore(n.getStr(&n.confdir), "testplugin"); err != nil || len(s.Keys()) != 1 {
+		t.Errorf("Plugin error: store not saved (%v)", err)
+	}
+	p.c.Store.Delete("k")
+	if s, err := newPluginStore(dir, "../../escape"); err != nil || s.file != dir+"/plugins/_.._escape.json" {
+		t.Errorf("Plugin error: store of ../../escape not sanitised (%v)", err)
+	}
+	n.UnregisterPlugin("testplugin")
+}
+
+func TestClient(t *testing.T) {
+	dir := tempDir(t, "client")
+	defer os.RemoveAll(dir)
+	c := NewClient()
+	c.AddPlugin("testplugin", func() Plugin { return &testPlugin{seen: make(chan string, 10)} })
+	a, err := c.AddNetwork(NetworkConfig{Name: "a", Server: "irc.a.example.org", Port: "6667", Nick: "bot", Version: "bot 1.0", ConfDir: dir + "/a"})
+	if err != nil {
+		t.Fatalf("Client error: %s", err.String())
+	}
+	//plugins may use the client
+	c.AddPlugin("lookup", func() Plugin { return &testPlugin{seen: make(chan string, 10), onInit: func() { c.Networks() }} })
+	b, _ := c.AddNetwork(NetworkConfig{Name: "b", Server: "irc.b.example.org", Port: "6667", Nick: "bot", ConfDir: dir + "/b"})
+	if _, err := c.AddNetwork(NetworkConfig{Name: "a", Server: "irc.example.org", Nick: "bot"}); err == nil {
+		t.Errorf("Client error: network added twice")
+	}
+	if n, ok := c.Network("b"); !ok || n != b || strings.Join(c.Networks(), " ") != "a b" {
+		t.Errorf("Client error: bad lookup: %v", c.Networks())
+	}
+	if a.GetVersion() != "bot 1.0" || b.GetVersion() != IRCVERSION || a.confdir == b.confdir {
+		t.Errorf("Client error: configuration shared: %s %s", a.confdir, b.confdir)
+	}
+	if !a.PluginEnabled("testplugin") || !b.PluginEnabled("testplugin") || !a.PluginEnabled("lookup") || !b.PluginEnabled("lookup") {
+		t.Errorf("Client error: plugin missing")
+	}
+	msg, _ := PackMsg(":u!u@h PRIVMSG #chan :hi")
+	b.Listen.dispatch(msg)
+	select {
+	case ev := <-c.Events:
+		if ev.Network != "b" || ev.Net != b || ev.Msg.Params[1] != "hi" {
+			t.Errorf("Client error: bad event %#v", ev)
+		}
+	case <-time.After(second):
+		t.Errorf("Client error: no event")
+	}
+	if err := c.Shutdown("bye", second); err != nil {
+		t.Errorf("Client error: %s", err.String())
+	}
+	if _, ok := c.Network("a"); ok || <-c.Events != nil {
+		t.Errorf("Client error: not shut down")
+	}
+	for _, n := range []*Network{a, b} {
+		n.UnregisterPlugin("testplugin")
+		n.UnregisterPlugin("lookup")
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	c1, c2 := net.Pipe()
+	n.conn, n.buf, n.state = c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), Connected
+	go n.sender()
+	go n.receiver()
+	time.Sleep(second / 10)
+	quit := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(c2).ReadString('\n')
+		quit <- l
+	}()
+	if err := n.Close("bye", second); err != nil || n.State() != Disconnected {
+		t.Errorf("Close error: %v", err)
+	}
+	if l := <-quit; l != "QUIT bye\r\n" {
+		t.Errorf("Close error: sent %q instead of QUIT", l)
+	}
+	if err := n.Close("again", second); err != nil {
+		t.Errorf("Close error: closing twice: %s", err.String())
+	}
+	stuck := make(chan bool)
+	n.Shutdown.regName("stuck", stuck)
+	start := time.Nanoseconds()
+	n.Shutdown.signal(start + second/10)
+	if stale := n.Shutdown.wait(start + second/5); len(stale) != 1 || stale[0] != "stuck" {
+		t.Errorf("Close error: stuck goroutine not reported: %v", stale)
+	}
+}
+
+//tempDir creates an empty directory for the files of a test, to be removed with os.RemoveAll
+func tempDir(t *testing.T, name string) string {
+	tmp := os.Getenv("TMPDIR")
+	if tmp == "" {
+		tmp = "/tmp"
+	}
+	dir := fmt.Sprintf("%s/go-irc-chans-%s-%d-%d", tmp, name, os.Getpid(), time.Nanoseconds())
+	if err := os.MkdirAll(dir, 0751); err != nil {
+		t.Fatalf("Can't create %s: %s", dir, err.String())
+	}
+	return dir
+}
+
+//serveFake answers just enough for Connect and Privmsg on c
+func serveFake(c net.Conn) {
+	serveFakeCaps(c, "", nil)
+}
+
+//serveFakeCaps is serveFake offering caps in CAP LS, if not empty, and accepting STARTTLS
+//with the server configuration starttls, if not nil
+func serveFakeCaps(c net.Conn, caps string, starttls *tls.Config) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	if b, err := r.ReadByte(); err != nil || b == 0x16 { //no TLS here
+		return
+	}
+	r.UnreadByte()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		msg, _ := PackMsg(strings.TrimRight(line, "\r\n"))
+		switch msg.Cmd {
+		case "CAP":
+			if caps != "" && msg.Params[0] == "LS" {
+				fmt.Fprintf(c, ":irc.example.org CAP * LS :%s\r\n", caps)
+			} else if caps == "" {
+				fmt.Fprintf(c, ":irc.example.org 421 * CAP :Unknown command\r\n")
+			}
+		case "STARTTLS":
+			if starttls == nil {
+				fmt.Fprintf(c, ":irc.example.org 691 * :STARTTLS not configured\r\n")
+				break
+			}
+			fmt.Fprintf(c, ":irc.example.org 670 * :STARTTLS successful, go ahead with TLS handshake\r\n")
+			c = tls.Server(c, starttls)
+			r = bufio.NewReader(c)
+		case "USER":
+			fmt.Fprintf(c, ":irc.example.org 001 bot :Welcome\r\n:irc.example.org 376 bot :End of MOTD\r\n")
+		case "PING":
+			fmt.Fprintf(c, ":irc.example.org PONG irc.example.org :%s\r\n", msg.Params[0])
+		case "PRIVMSG":
+			fmt.Fprintf(c, ":irc.example.org 401 bot %s :No such nick/channel\r\n", msg.Params[0])
+		case "QUIT":
+			return
+		}
+	}
+}
+
+//fakeServer runs serveFake on a local port, returning its host and port
+func fakeServer(t *testing.T) (string, string) {
+	return fakeServerCaps(t, "", nil)
+}
+
+func fakeServerCaps(t *testing.T, caps string, starttls *tls.Config) (string, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fake server error: %s", err.String())
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeCaps(c, caps, starttls)
+		}
+	}()
+	host, port, _ := splitAddr(l.Addr().String())
+	return host, strconv.Itoa(port)
+}
+
+//TestRace hammers a network from several goroutines, run it with the race detector
+func TestRace(t *testing.T) {
+	host, port := fakeServer(t)
+	n := NewNetwork(host, port, "bot", "user", "real name", "", "")
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			for j := 0; j < 5; j++ {
+				if i == 0 {
+					n.Connect() //fails whenever Close gets in the way
+				} else if i == 1 {
+					time.Sleep(second / 5)
+					if err := n.Close("Stressed", 5*second); err != nil {
+						t.Errorf("Race error: closing: %s", err.String())
+					}
+				} else {
+					time.Sleep(second / 10)
+					if n.State() == Connected {
+						n.Privmsg([]string{"#chan"}, "hello")
+					}
+				}
+				n.GetNick()
+				n.Lag()
+				n.IsAway()
+				n.State().String()
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if err := n.Close("Done", 5*second); err != nil || n.State() != Disconnected {
+		t.Errorf("Race error: %s after closing (%v)", n.State(), err)
+	}
+}
+
+//gateDialer connects to addr once gate lets it
+type gateDialer struct {
+	gate chan bool
+	addr string
+}
+
+func (d gateDialer) Dial(addr string) (net.Conn, os.Error) {
+	<-d.gate
+	return net.Dial("tcp", "", d.addr)
+}
+
+func TestConnState(t *testing.T) {
+	host, port := fakeServer(t)
+	n := NewNetwork(host, port, "bot", "user", "real name", "", "")
+	n.SetTls(TlsOff)
+	if err := n.Connect(); err != nil {
+		t.Fatalf("ConnState error: %s", err.String())
+	}
+	if err := n.Connect(); err != ErrNotDisconnected {
+		t.Errorf("ConnState error: connecting twice gave %v", err)
+	}
+	n.connError("Broken")
+	if err := n.Close("bye", 5*second); err != nil || n.State() != Disconnected {
+		t.Errorf("ConnState error: Close didn't wait for the running close: %s, %v", n.State(), err)
+	}
+	gate := make(chan bool)
+	n.SetDialer(gateDialer{gate, host + ":" + port})
+	connected := make(chan os.Error)
+	go func() {
+		connected <- n.Connect()
+	}()
+	for n.State() != Connecting {
+		time.Sleep(second / 100)
+	}
+	n.Close("Never mind", 5*second)
+	close(gate)
+	if err := <-connected; err == nil || n.State() != Disconnected {
+		t.Errorf("ConnState error: connected despite Close: %s", n.State())
+	}
+}
+
+func TestDialer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go serveFake(c2)
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.SetDialer(NewConnDialer(c1))
+	if err := n.Connect(); err != nil || n.State() != Connected {
+		t.Fatalf("Dialer error: can't connect over a pipe: %v", err)
+	}
+	n.Close("bye", second)
+	if err := n.Connect(); err == nil {
+		t.Errorf("Dialer error: pipe used twice")
+	}
+	c1, c2 = net.Pipe() //a peer that never answers the TLS handshake
+	defer c2.Close()
+	n.SetDialer(NewConnDialer(c1))
+	n.SetTls(TlsRequire)
+	tlsTimeout = second / 2
+	defer func() { tlsTimeout = 15 * second }()
+	if err := n.Connect(); err == nil || n.State() != Disconnected {
+		t.Errorf("Dialer error: connected to a silent TLS peer: %s", n.State())
+	}
+	proxy := func(handle func(c net.Conn, r *bufio.Reader)) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Dialer error: %s", err.String())
+		}
+		go func() {
+			c, err := l.Accept()
+			l.Close()
+			if err == nil {
+				handle(c, bufio.NewReader(c))
+			}
+		}()
+		return l.Addr().String()
+	}
+	expect := func(r *bufio.Reader, expected []byte) {
+		got := make([]byte, len(expected))
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, expected) {
+			t.Errorf("Dialer error: proxy got %v, expected %v", got, expected)
+		}
+	}
+	addr := proxy(func(c net.Conn, r *bufio.Reader) {
+		expect(r, []byte{5, 2, 0, 2})
+		c.Write([]byte{5, 2})
+		expect(r, []byte{1, 1, 'u', 2, 'p', 'w'})
+		c.Write([]byte{1, 0})
+		expect(r, []byte{5, 1, 0, 3, 15, 'i', 'r', 'c', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'o', 'r', 'g', 0x1a, 0x0b})
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0, ':', 'h', 'i', '\n'})
+	})
+	conn, err := Socks5Dialer{Proxy: addr, User: "u", Password: "pw"}.Dial("irc.example.org:6667")
+	if err != nil {
+		t.Fatalf("Dialer error: SOCKS5: %s", err.String())
+	}
+	if l, _ := bufio.NewReader(conn).ReadString('\n'); l != ":hi\n" {
+		t.Errorf("Dialer error: read %q through SOCKS5", l)
+	}
+	conn.Close()
+	addr = proxy(func(c net.Conn, r *bufio.Reader) {
+		if l, _ := r.ReadString('\n'); l != "CONNECT irc.example.org:6667 HTTP/1.1\r\n" {
+			t.Errorf("Dialer error: proxy got %q", l)
+		}
+		for l, _ := r.ReadString('\n'); l != "\r\n" && l != ""; l, _ = r.ReadString('\n') {
+		}
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\nVia: test\r\n\r\n:hi\n"))
+	})
+	conn, err = HttpDialer{Proxy: addr}.Dial("irc.example.org:6667")
+	if err != nil {
+		t.Fatalf("Dialer error: HTTP: %s", err.String())
+	}
+	if l, _ := bufio.NewReader(conn).ReadString('\n'); l != ":hi\n" {
+		t.Errorf("Dialer error: read %q through HTTP", l)
+	}
+	conn.Close()
+}
+
+//wsServer is a local IRC over WebSocket gateway in front of serveFake, returning its address
+func wsServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("WebSocket error: %s", err.String())
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		if l, _ := r.ReadString('\n'); l != "GET /irc HTTP/1.1\r\n" {
+			t.Errorf("WebSocket error: request %q", l)
+		}
+		key := ""
+		for l, _ := r.ReadString('\n'); l != "\r\n" && l != ""; l, _ = r.ReadString('\n') {
+			if strings.HasPrefix(l, "Sec-WebSocket-Key: ") {
+				key = strings.TrimSpace(l[len("Sec-WebSocket-Key: "):])
+			}
+		}
+		fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: %s\r\n\r\n", wsAccept(key), wsBinary)
+		c.Write([]byte{0x89, 2, 'h', 'i'}) //a ping, which the client must answer without bothering Network
+		serveFake(newWsConn(c, r, true, false))
+	}()
+	return l.Addr().String()
+}
+
+func TestWebSocket(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := newWsConn(c1, bufio.NewReader(c1), true, true), newWsConn(c2, bufio.NewReader(c2), true, false)
+	long := strings.Repeat("x", 300)
+	go func() {
+		client.Write([]byte("PRIVMSG #a :one\r\nPRIVMSG #a :"))
+		client.Write([]byte(long + "\r\n"))
+	}()
+	r := bufio.NewReader(server)
+	for _, expected := range []string{"PRIVMSG #a :one\r\n", "PRIVMSG #a :" + long + "\r\n"} {
+		if l, err := r.ReadString('\n'); l != expected {
+			t.Errorf("WebSocket error: read %q (%v), expected %q", l, err, expected)
+		}
+	}
+	go client.Close()
+	if _, err := r.ReadString('\n'); err != os.EOF {
+		t.Errorf("WebSocket error: %v after a close frame", err)
+	}
+	c1, c2 = net.Pipe() //a peer that doesn't read anymore
+	defer c2.Close()
+	client = newWsConn(c1, bufio.NewReader(c1), true, true)
+	go client.Write([]byte("PRIVMSG #a :stuck\r\n"))
+	closed := make(chan bool)
+	go func() {
+		client.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * second):
+		t.Errorf("WebSocket error: Close hangs on a blocked write")
+	}
+	if _, _, _, _, err := parseWsURL("http://example.org"); err == nil {
+		t.Errorf("WebSocket error: http URL accepted")
+	}
+	if secure, host, hostport, path, _ := parseWsURL("wss://[::1]"); !secure || host != "::1" || hostport != "[::1]:443" || path != "/" {
+		t.Errorf("WebSocket error: parsed wss://[::1] as %v %s %s %s", secure, host, hostport, path)
+	}
+	n := NewNetwork("ws://"+wsServer(t)+"/irc", "", "bot", "user", "real name", "", "")
+	n.SetTls(TlsRequire)
+	if err := n.Connect(); err == nil || n.State() != Disconnected {
+		t.Errorf("WebSocket error: plain text ws:// despite TlsRequire")
+	}
+	n.SetTls(TlsTry)
+	if err := n.Connect(); err != nil || n.State() != Connected {
+		t.Fatalf("WebSocket error: can't connect: %v", err)
+	}
+	if err := n.Close("bye", 5*second); err != nil {
+		t.Errorf("WebSocket error: %s", err.String())
+	}
+}
+
+func TestStartTls(t *testing.T) {
+	dir := tempDir(t, "starttls")
+	defer os.RemoveAll(dir)
+	conf, err := customTlsConf(dir + "/server")
+	if err != nil {
+		t.Fatalf("STARTTLS error: %s", err.String())
+	}
+	host, port := fakeServerCaps(t, "", conf)
+	n := NewNetwork(host, port, "bot", "user", "real name", "", "")
+	n.SetConfDir(dir)
+	for i := 0; i < 2; i++ { //the second time goes straight to STARTTLS
+		if err := n.Connect(); err != nil || !n.Secure() {
+			t.Fatalf("STARTTLS error: no secure connection: %v", err)
+		}
+		n.Close("bye", 5*second)
+	}
+	if n.tlsWays[host+":"+port] != tlsStarttls {
+		t.Errorf("STARTTLS error: success not remembered")
+	}
+}
+
+func TestSts(t *testing.T) {
+	dir := tempDir(t, "sts")
+	defer os.RemoveAll(dir)
+	host, port := fakeServer(t)
+	n := NewNetwork(host, port, "bot", "user", "real name", "", "")
+	n.SetConfDir(dir)
+	if err := n.Connect(); err != nil || n.Secure() {
+		t.Fatalf("STS error: no plain text connection after a refused STARTTLS: %v", err)
+	}
+	n.Close("bye", 5*second)
+	p, _ := strconv.Atoi(port)
+	if err := n.updateSts(host, p, "duration=60,preload"); err != nil {
+		t.Fatalf("STS error: %s", err.String())
+	}
+	m := NewNetwork(host, port, "bot", "user", "real name", "", "")
+	m.SetConfDir(dir)
+	if policy, ok := m.StsPolicy(); !ok || policy.Port != p || policy.Expires < time.Seconds()+50 {
+		t.Errorf("STS error: policy not persisted: %v", policy)
+	}
+	if err := m.Connect(); err == nil || m.State() != Disconnected {
+		t.Errorf("STS error: plain text connection despite the policy")
+	}
+	m.SetTls(TlsOff) //e.g. through an encrypted tunnel
+	if err := m.Connect(); err != nil {
+		t.Errorf("STS error: policy applied with TLS off: %s", err.String())
+	}
+	m.Close("bye", 5*second)
+	m.SetTls(TlsTry)
+	n.updateSts(host, p, "duration=0")
+	if err := m.Connect(); err != nil {
+		t.Errorf("STS error: can't connect after the policy was removed: %s", err.String())
+	}
+	m.Close("bye", 5*second)
+	host, port = fakeServerCaps(t, "sts=port="+port, nil)
+	n = NewNetwork(host, port, "bot", "user", "real name", "", "")
+	n.SetConfDir(dir)
+	if err := n.Connect(); err == nil || n.State() != Disconnected {
+		t.Errorf("STS error: registered in plain text with a server asking for TLS")
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.SetKeepalive(KeepaliveConfig{Thresholds: []int64{second}, History: 3})
+	for _, lag := range []int64{second / 2, 2 * second, second / 2, second} {
+		n.setLag(lag)
+	}
+	if min, avg, max, count := n.LagStats(); min != second/2 || avg != 7*second/6 || max != 2*second || count != 3 {
+		t.Errorf("Keepalive error: lag stats %d %d %d %d", min, avg, max, count)
+	}
+	for _, above := range []bool{true, false} {
+		select {
+		case e := <-n.LagEvents:
+			if e.Above != above || e.Threshold != second || e.Timeout {
+				t.Errorf("Keepalive error: unexpected event %v", e)
+			}
+		default:
+			t.Errorf("Keepalive error: no event for crossing the threshold")
+		}
+	}
+	if len(n.LagEvents) > 0 {
+		t.Errorf("Keepalive error: event without crossing the threshold")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Keepalive error: %s", err.String())
+	}
+	defer l.Close()
+	go func() { //the first server stops talking after answering the PING of Connect
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r, pinged := bufio.NewReader(c), false
+		for line, err := r.ReadString('\n'); err == nil; line, err = r.ReadString('\n') {
+			msg, _ := PackMsg(strings.TrimRight(line, "\r\n"))
+			switch {
+			case msg.Cmd == "CAP":
+				fmt.Fprintf(c, ":irc.example.org 421 * CAP :Unknown command\r\n")
+			case msg.Cmd == "USER":
+				fmt.Fprintf(c, ":irc.example.org 001 bot :Welcome\r\n:irc.example.org 376 bot :End of MOTD\r\n")
+			case msg.Cmd == "PING" && !pinged:
+				fmt.Fprintf(c, ":irc.example.org PONG irc.example.org :%s\r\n", msg.Params[0])
+				pinged = true
+			}
+		}
+	}()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			serveFake(c)
+		}
+	}()
+	host, port, _ := splitAddr(l.Addr().String())
+	n = NewNetwork(host, strconv.Itoa(port), "bot", "user", "real name", "", "")
+	n.SetTls(TlsOff)
+	n.SetKeepalive(KeepaliveConfig{Interval: second / 5, Timeout: second / 2, Reconnect: true})
+	if err := n.Connect(); err != nil {
+		t.Fatalf("Keepalive error: %s", err.String())
+	}
+	select {
+	case e := <-n.LagEvents:
+		if !e.Timeout || e.Lag < second/2 {
+			t.Errorf("Keepalive error: unexpected event %v", e)
+		}
+	case <-time.After(5 * second):
+		t.Fatalf("Keepalive error: no ping timeout")
+	}
+	measured := func() bool {
+		_, _, _, count := n.LagStats()
+		return n.State() == Connected && count > 0
+	}
+	for i := 0; i < 50 && !measured(); i++ {
+		time.Sleep(second / 10)
+	}
+	if !measured() {
+		t.Errorf("Keepalive error: not reconnected after a ping timeout, or no lag measured since")
+	}
+	n.Close("bye", 5*second)
+}
+
 //TODO: test ctcp(?), ping, ..
+
+//scripted answers what n sends with the lines reply returns, as if they came from the
+//server, until stop is closed
+func scripted(n *Network, reply func(*IrcMessage) []string) (stop chan bool) {
+	stop = make(chan bool)
+	go func() {
+		for {
+			select {
+			case msg := <-n.queueOut:
+				for _, line := range reply(msg) {
+					if m, err := PackMsg(line); err == nil {
+						n.Listen.dispatch(m)
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return
+}
+
+func TestQuery(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stop := scripted(n, func(m *IrcMessage) []string {
+		switch {
+		case m.Cmd == "WHOIS":
+			return []string{":srv 401 bot someone :No such nick", ":srv 318 bot " + m.Params[0] + " :End of WHOIS"}
+		case m.Cmd == "PING":
+			return []string{":srv PONG srv :" + m.Params[0]}
+		case m.Cmd == "TOPIC" && len(m.Params) > 1 && m.Params[0] == "#locked":
+			return []string{":srv 482 bot #locked :You're not channel operator"}
+		case m.Cmd == "TOPIC" && len(m.Params) > 1:
+			return []string{":bot!u@h TOPIC " + m.Params[0] + " :" + m.Params[1]}
+		case m.Cmd == "TOPIC" && m.Params[0] == "#full":
+			return []string{":srv 332 bot #full :the topic", ":srv 333 bot #full alice 1300000000"}
+		case m.Cmd == "TOPIC" && m.Params[0] == "#short":
+			return []string{":srv 332 bot #short :no whotime"}
+		case m.Cmd == "TOPIC" && m.Params[0] == "#none":
+			return []string{":srv 331 bot #none :No topic is set"}
+		}
+		return nil
+	})
+	defer close(stop)
+	msgs, err := n.query(&IrcMessage{"", "WHOIS", []string{"nick"}, nil}, []string{"ERR_NOSUCHNICK", "RPL_ENDOFWHOIS"}, nil, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Cmd != "318" {
+		t.Errorf("Query error: took another command's error: %v %v", msgs, err)
+	}
+	start := time.Nanoseconds()
+	if topic, err := n.GetTopic("#full"); err != nil || topic.Text != "the topic" || topic.SetBy != "alice" || topic.SetAt != 1300000000 {
+		t.Errorf("Query error: bad topic %#v (%v)", topic, err)
+	}
+	if topic, err := n.GetTopic("#short"); err != nil || topic.Text != "no whotime" || topic.SetBy != "" {
+		t.Errorf("Query error: bad topic %#v (%v)", topic, err)
+	}
+	if _, err := n.GetTopic("#none"); err != ErrNoTopic {
+		t.Errorf("Query error: expected ErrNoTopic, got %v", err)
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > second {
+		t.Errorf("Query error: getting topics took %d ms", elapsed/1e6)
+	}
+	if err := n.SetTopic("#chan", "new topic"); err != nil {
+		t.Errorf("Query error: SetTopic failed: %s", err.String())
+	}
+	if err, ok := n.SetTopic("#locked", "new topic").(*ReplyError); !ok || err.Reply != "ERR_CHANOPRIVSNEEDED" {
+		t.Errorf("Query error: expected ERR_CHANOPRIVSNEEDED, got %v", err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stop := scripted(n, func(m *IrcMessage) []string {
+		switch m.Cmd {
+		case "ISON":
+			return []string{":srv 303 bot :someone", ":srv 303 bot :Alice"}
+		case "USERHOST":
+			return []string{":srv 302 bot :someone=+u@h", ":srv 302 bot :alice*=-a@host"}
+		}
+		return nil
+	})
+	defer close(stop)
+	if users, err := n.Userhost([]string{"alice"}); err != nil || len(users) != 1 || users[0].Nick != "alice" || !users[0].Oper || !users[0].Away {
+		t.Errorf("Watcher error: bad USERHOST reply %v (%v)", users, err)
+	}
+	w := n.NewWatcher(minute)
+	if w.Method() != "ISON" {
+		t.Errorf("Watcher error: method %s without MONITOR nor WATCH", w.Method())
+	}
+	w.Add("alice", "bob")
+	for _, expected := range []PresenceEvent{PresenceEvent{"Alice", true, "", ""}, PresenceEvent{"alice", false, "", ""}} {
+		select {
+		case e := <-w.Events:
+			if e.Nick != expected.Nick || e.Online != expected.Online {
+				t.Errorf("Watcher error: got %v, expected %v", e, expected)
+			}
+		case <-time.After(5 * second):
+			t.Fatalf("Watcher error: no event, expected %v", expected)
+		}
+		if online := w.Online(); expected.Online != (len(online) == 1 && online[0] == "alice") {
+			t.Errorf("Watcher error: online %v", online)
+		}
+		msg, _ := PackMsg(":srv 731 bot :alice,carol") //MONITOR offline
+		n.Listen.dispatch(msg)
+	}
+	w.Stop()
+	w.Stop()
+	words := make([]string, 30)
+	for i := range words {
+		words[i] = strings.Repeat(string('a'+i%26), 40)
+	}
+	all := make([]string, 0)
+	for _, batch := range batches(words, len("ISON :"), 1) {
+		if l := len("ISON :" + strings.Join(batch, " ")); l > 510 {
+			t.Errorf("Watcher error: %d bytes batch", l)
+		}
+		all = append(all, batch...)
+	}
+	if strings.Join(all, " ") != strings.Join(words, " ") {
+		t.Errorf("Watcher error: batches lost words")
+	}
+}
+
+func TestAutoAway(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	mute := make(chan bool) //closed to stop answering AWAY
+	stop := scripted(n, func(m *IrcMessage) []string {
+		select {
+		case <-mute:
+			return nil
+		default:
+		}
+		if m.Cmd == "AWAY" && len(m.Params) > 0 {
+			return []string{":srv 306 bot :You have been marked as being away"}
+		} else if m.Cmd == "AWAY" {
+			return []string{":srv 305 bot :You are no longer marked as being away"}
+		}
+		return nil
+	})
+	defer close(stop)
+	if err := n.Away("gone"); err != nil {
+		t.Fatalf("Away error: %s", err.String())
+	}
+	if away, reason := n.IsAway(); !away || reason != "gone" {
+		t.Errorf("Away error: not away after AWAY: %v %q", away, reason)
+	}
+	if err := n.Away(""); err != nil {
+		t.Fatalf("Away error: %s", err.String())
+	}
+	if away, _ := n.IsAway(); away {
+		t.Errorf("Away error: still away")
+	}
+	autoAwayCheck = second / 20
+	defer func() { autoAwayCheck = minute / 4 }()
+	n.SetAutoAway(second/2, "")
+	go n.autoAway()
+	waitAway := func(expected bool) {
+		for start := time.Nanoseconds(); time.Nanoseconds()-start < 5*second; time.Sleep(second / 20) {
+			if away, reason := n.IsAway(); away == expected {
+				if away && reason != defAutoAwayReason {
+					t.Errorf("Away error: auto-away reason %q", reason)
+				}
+				return
+			}
+		}
+		t.Errorf("Away error: away state not %v", expected)
+	}
+	waitAway(true)
+	msg, _ := PackMsg("PRIVMSG #chan :back")
+	n.OutListen.dispatch(msg)
+	waitAway(false)
+	close(mute)
+	time.Sleep(second) //auto-away sends an AWAY that gets no answer
+	deadline := time.Nanoseconds() + second
+	n.Shutdown.signal(deadline)
+	if stale := n.Shutdown.wait(deadline); len(stale) > 0 {
+		t.Errorf("Away error: %v held up the shutdown", stale)
+	}
+}
+
+func TestLists(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stop := scripted(n, func(m *IrcMessage) []string {
+		switch {
+		case m.Cmd == "MODE" && m.Params[0] == "#locked":
+			return []string{":srv 482 bot #locked :You're not channel operator"}
+		case m.Cmd == "MODE":
+			return []string{":srv 367 bot #chan *!*@bad.host op!o@h 1300000000", ":srv 367 bot #other *!*@elsewhere",
+				":srv 367 bot #chan *!*@worse.host", ":srv 368 bot #chan :End of channel ban list"}
+		case m.Cmd == "WHOIS":
+			return []string{":srv 311 bot Carol ~carol carol.host * :Carol", ":srv 318 bot carol :End of WHOIS"}
+		}
+		return nil
+	})
+	defer close(stop)
+	bans, err := n.Bans("#chan")
+	if err != nil || len(bans) != 2 || bans[0].Mask != "*!*@bad.host" || bans[0].SetBy != "op!o@h" || bans[0].SetAt != 1300000000 || bans[1].Mask != "*!*@worse.host" {
+		t.Errorf("Lists error: bad ban list %v (%v)", bans, err)
+	}
+	if _, err := n.Bans("#locked"); err == nil {
+		t.Errorf("Lists error: no error without ops")
+	}
+	if _, err := n.BanExceptions("#chan"); err == nil {
+		t.Errorf("Lists error: +e list without CHANMODES support")
+	}
+	for style, expected := range map[int]string{MaskHost: "*!*@carol.host", MaskIdentHost: "*!*carol@carol.host", MaskNick: "Carol!*@*"} {
+		if mask, err := n.BanMask("carol", style); mask != expected {
+			t.Errorf("Lists error: mask %q (%v), expected %q", mask, err, expected)
+		}
+	}
+	n.isupport.update(&IrcMessage{"", replies["RPL_ISUPPORT"], []string{"bot", "CHANMODES=bg,k,l,imnst", "MAXLIST=bg:5", "are supported by this server"}, nil})
+	if _, err := n.listMode("#chan", 'g'); err == nil {
+		t.Errorf("Lists error: list mode without known replies accepted")
+	}
+	go n.tracker()
+	for _, line := range []string{":bot!b@h JOIN #chan", ":dave!d@dave.host JOIN #chan", ":erin!e@h PRIVMSG bot :hi"} {
+		msg, _ := PackMsg(line)
+		n.Listen.dispatch(msg)
+	}
+	known := func(nick string, expected bool) {
+		for start := time.Nanoseconds(); time.Nanoseconds()-start < 5*second; time.Sleep(second / 20) {
+			if _, ok := n.LookupUser(nick); ok == expected {
+				return
+			}
+		}
+		t.Errorf("Lists error: %s known is not %v", nick, expected)
+	}
+	known("dave", true)
+	if _, ok := n.LookupUser("erin"); ok {
+		t.Errorf("Lists error: user outside our channels tracked")
+	}
+	msg, _ := PackMsg(":dave!d@dave.host PART #chan")
+	n.Listen.dispatch(msg)
+	known("dave", false)
+	deadline := time.Nanoseconds() + second
+	n.Shutdown.signal(deadline)
+	n.Shutdown.wait(deadline)
+}
+
+func TestOper(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.setLag(second / 10)
+	dead := false
+	stop := scripted(n, func(m *IrcMessage) []string {
+		switch m.Cmd {
+		case "OPER":
+			if m.Params[1] == "secret" {
+				return []string{":srv 381 bot :You are now an IRC operator"}
+			}
+			return []string{":srv 464 bot :Password incorrect"}
+		case "REHASH":
+			return []string{":srv 382 bot ircd.conf :Rehashing"}
+		case "KILL":
+			if m.Params[0] == "ghost" {
+				return []string{":srv 401 bot ghost :No such nick"}
+			}
+		case "WALLOPS":
+			return []string{":srv 401 bot bob :No such nick"}
+		case "DIE":
+			dead = true
+		case "PING":
+			if !dead {
+				return []string{":srv PONG srv :" + m.Params[0]}
+			}
+		case "STATS":
+			switch m.Params[0] {
+			case "l":
+				return []string{":srv 211 bot hub.example.org 0 120 15 130 16 3600", ":srv 219 bot l :End of STATS report"}
+			case "m":
+				return []string{":srv 212 bot PRIVMSG 42 1000 0", ":srv 219 bot m :End of STATS report"}
+			case "u":
+				return []string{":srv 242 bot :Server Up 1 days 2:03:04", ":srv 219 bot u :End of STATS report"}
+			}
+		case "TRACE":
+			return []string{":srv 205 bot User 1 alice[u@h] :0", ":srv 262 bot srv 1.0 :End of TRACE"}
+		case "LINKS":
+			return []string{":srv 364 bot * hub.example.org :1 The hub", ":srv 365 bot * :End of LINKS list"}
+		case "ADMIN":
+			return []string{":srv 256 bot srv :Administrative info", ":srv 257 bot :Somewhere",
+				":srv 258 bot :Example Org", ":srv 259 bot :admin@example.org"}
+		case "LUSERS":
+			return []string{":srv 251 bot :There are 3 users and 2 invisible on 1 servers",
+				":srv 252 bot 1 :operator(s) online", ":srv 254 bot 4 :channels formed",
+				":srv 255 bot :I have 5 clients and 0 servers", ":srv 265 bot 5 7 :Current local users 5, max 7"}
+		}
+		return nil
+	})
+	defer close(stop)
+	if err := n.Oper("admin", "secret"); err != nil {
+		t.Errorf("Oper error: OPER failed: %s", err.String())
+	}
+	if err, ok := n.Oper("admin", "wrong").(*ReplyError); !ok || err.Reply != "ERR_PASSWDMISMATCH" {
+		t.Errorf("Oper error: expected ERR_PASSWDMISMATCH, got %v", err)
+	}
+	if err := n.Rehash(); err != nil {
+		t.Errorf("Oper error: REHASH failed: %s", err.String())
+	}
+	if err := n.Kill("alice", "bye"); err != nil {
+		t.Errorf("Oper error: KILL failed: %s", err.String())
+	}
+	if err, ok := n.Kill("ghost", "bye").(*ReplyError); !ok || err.Reply != "ERR_NOSUCHNICK" {
+		t.Errorf("Oper error: expected ERR_NOSUCHNICK, got %v", err)
+	}
+	if err := n.Wallops("hello"); err != nil {
+		t.Errorf("Oper error: took another command's error for WALLOPS: %s", err.String())
+	}
+	if s, err := n.Stats("l", ""); err != nil || len(s.Links) != 1 || s.Links[0].Name != "hub.example.org" || s.Links[0].SentMsgs != 120 || s.Links[0].RecvKB != 16 || s.Links[0].TimeOpen != 3600 {
+		t.Errorf("Oper error: bad STATS l %v (%v)", s, err)
+	}
+	if s, err := n.Stats("m", ""); err != nil || s.Commands["PRIVMSG"] != 42 {
+		t.Errorf("Oper error: bad STATS m %v (%v)", s, err)
+	}
+	if s, err := n.Stats("u", ""); err != nil || s.Uptime != ((24+2)*60+3)*60+4 {
+		t.Errorf("Oper error: bad STATS u %v (%v)", s, err)
+	}
+	if lines, err := n.Trace(""); err != nil || len(lines) != 1 || lines[0].Reply != "RPL_TRACEUSER" || lines[0].Class != "User" || len(lines[0].Fields) != 3 {
+		t.Errorf("Oper error: bad TRACE %v (%v)", lines, err)
+	}
+	if links, err := n.Links(""); err != nil || len(links) != 1 || links[0].Server != "hub.example.org" || links[0].Hops != 1 || links[0].Info != "The hub" {
+		t.Errorf("Oper error: bad LINKS %v (%v)", links, err)
+	}
+	if a, err := n.Admin(""); err != nil || a.Server != "srv" || a.Loc1 != "Somewhere" || a.Loc2 != "Example Org" || a.Email != "admin@example.org" {
+		t.Errorf("Oper error: bad ADMIN %v (%v)", a, err)
+	}
+	l, err := n.Lusers() //no RPL_GLOBALUSERS: ends on the timeout
+	if err != nil || l.Users != 3 || l.Invisible != 2 || l.Servers != 1 || l.Opers != 1 || l.Channels != 4 || l.LocalClients != 5 || l.MaxLocalUsers != 7 {
+		t.Errorf("Oper error: bad LUSERS %v (%v)", l, err)
+	}
+	if err := n.Die(); err != ErrTimeout {
+		t.Errorf("Oper error: expected a timeout once the server is gone, got %v", err)
+	}
+}
+
+func TestCaps(t *testing.T) {
+	ended := make(chan string, 3)
+	script := func(m *IrcMessage, ack string) []string {
+		if m.Cmd != "CAP" {
+			return nil
+		}
+		switch m.Params[0] {
+		case "LS":
+			return []string{":srv CAP * LS * :multi-prefix sasl", ":srv CAP * LS :away-notify foo=bar"}
+		case "REQ":
+			return []string{":srv CAP * " + ack + " :" + m.Params[1]}
+		case "END":
+			ended <- ack
+		}
+		return nil
+	}
+	checkEnd := func(ack string) {
+		select {
+		case got := <-ended:
+			if got != ack {
+				t.Errorf("Caps error: CAP END of the %s server seen after %s", got, ack)
+			}
+		case <-time.After(second):
+			t.Errorf("Caps error: no CAP END after %s", ack)
+		}
+	}
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stop := scripted(n, func(m *IrcMessage) []string { return script(m, "ACK") })
+	defer close(stop)
+	if err := n.negotiateCaps(); err != nil {
+		t.Errorf("Caps error: negotiation failed: %s", err.String())
+	}
+	if !n.HasCap("multi-prefix") || !n.HasCap("away-notify") || n.HasCap("sasl") || n.HasCap("foo") {
+		t.Errorf("Caps error: bad capabilities %v", n.caps.enabled)
+	}
+	if val, ok := n.caps.offered("foo"); !ok || val != "bar" {
+		t.Errorf("Caps error: bad value %q for an offered capability", val)
+	}
+	checkEnd("ACK")
+	n = NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stopNak := scripted(n, func(m *IrcMessage) []string { return script(m, "NAK") })
+	defer close(stopNak)
+	if err := n.negotiateCaps(); err != nil || n.HasCap("multi-prefix") {
+		t.Errorf("Caps error: refused capabilities enabled (%v)", err)
+	}
+	checkEnd("NAK")
+	n = NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	stopOld := scripted(n, func(m *IrcMessage) []string {
+		return []string{":srv 421 * " + m.Cmd + " :Unknown command"}
+	})
+	defer close(stopOld)
+	start := time.Nanoseconds()
+	if err := n.negotiateCaps(); err != nil || n.HasCap("multi-prefix") {
+		t.Errorf("Caps error: server without CAP gave %v", err)
+	}
+	if elapsed := time.Nanoseconds() - start; elapsed > second {
+		t.Errorf("Caps error: ERR_UNKNOWNCOMMAND was waited out (%d ms)", elapsed/1e6)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	n := NewNetwork("irc.example.org", "6667", "bot", "user", "real name", "", "")
+	n.setLag(second / 10)
+	stop := scripted(n, func(m *IrcMessage) []string {
+		switch {
+		case m.Cmd == "PART":
+			return []string{":alice!u@h PART #c", ":bot!u@h PART #A", ":srv 442 bot #b :You're not on that channel"}
+		case m.Cmd == "KICK" && m.Params[1] == "alice":
+			return []string{":srv 401 bot bob :No such nick", ":carol!u@h KICK #chan alice :mine", ":bot!u@h KICK #chan alice :" + m.Params[2]}
+		case m.Cmd == "KICK":
+			return []string{":srv 441 bot " + m.Params[1] + " #chan :They aren't on that channel"}
+		case m.Cmd == "INVITE" && m.Params[0] == "alice":
+			return []string{":srv 482 bot #other :You're not channel operator", ":srv 341 bot alice #chan"}
+		case m.Cmd == "INVITE":
+			return []string{":srv 443 bot " + m.Params[0] + " #chan :is already on channel"}
+		}
+		return nil
+	})
+	defer close(stop)
+	res, err := n.Part([]string{"#a", "#b", "#c"}, "bye")
+	if err == nil || res["#a"] != nil || res["#c"] != ErrTimeout {
+		t.Errorf("Confirm error: bad PART outcome %v (%v)", res, err)
+	}
+	if err, ok := res["#b"].(*ReplyError); !ok || err.Reply != "ERR_NOTONCHANNEL" {
+		t.Errorf("Confirm error: expected ERR_NOTONCHANNEL for #b, got %v", res["#b"])
+	}
+	if err := n.Kick("#chan", "alice", "bye"); err != nil {
+		t.Errorf("Confirm error: KICK failed: %s", err.String())
+	}
+	if err, ok := n.Kick("#chan", "ghost", "bye").(*ReplyError); !ok || err.Reply != "ERR_USERNOTINCHANNEL" {
+		t.Errorf("Confirm error: expected ERR_USERNOTINCHANNEL, got %v", err)
+	}
+	if err := n.Invite("alice", "#chan"); err != nil {
+		t.Errorf("Confirm error: INVITE failed: %s", err.String())
+	}
+	if err, ok := n.Invite("bob", "#chan").(*ReplyError); !ok || err.Reply != "ERR_USERONCHANNEL" {
+		t.Errorf("Confirm error: expected ERR_USERONCHANNEL, got %v", err)
+	}
+}
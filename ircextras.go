@@ -47,12 +47,17 @@ var replies = map[string]string{
 	"ERR_INVITEONLYCHAN":   "473",
 	"ERR_BANNEDFROMCHAN":   "474",
 	"ERR_BADCHANNELKEY":    "475",
+	"ERR_BADCHANMASK":      "476",
+	"ERR_BANLISTFULL":      "478",
 	"ERR_NOPRIVILEGES":     "481",
 	"ERR_CHANOPRIVSNEEDED": "482",
 	"ERR_CANTKILLSERVER":   "483",
 	"ERR_NOOPERHOST":       "491",
 	"ERR_UMODEUNKNOWNFLAG": "501",
 	"ERR_USERSDONTMATCH":   "502",
+	"ERR_TOOMANYWATCH":     "512",
+	"ERR_MONLISTFULL":      "734",
+	"RPL_ISUPPORT":         "005",
 	"RPL_NONE":             "300",
 	"RPL_USERHOST":         "302",
 	"RPL_ISON":             "303",
@@ -65,6 +70,7 @@ var replies = map[string]string{
 	"RPL_WHOISIDLE":        "317",
 	"RPL_ENDOFWHOIS":       "318",
 	"RPL_WHOISCHANNELS":    "319",
+	"RPL_WHOISACCOUNT":     "330",
 	"RPL_WHOWASUSER":       "314",
 	"RPL_ENDOFWHOWAS":      "369",
 	"RPL_LISTSTART":        "321",
@@ -73,6 +79,7 @@ var replies = map[string]string{
 	"RPL_CHANNELMODEIS":    "324",
 	"RPL_NOTOPIC":          "331",
 	"RPL_TOPIC":            "332",
+	"RPL_TOPICWHOTIME":     "333",
 	"RPL_INVITING":         "341",
 	"RPL_SUMMONING":        "342",
 	"RPL_VERSION":          "351",
@@ -84,6 +91,12 @@ var replies = map[string]string{
 	"RPL_ENDOFLINKS":       "365",
 	"RPL_BANLIST":          "367",
 	"RPL_ENDOFBANLIST":     "368",
+	"RPL_INVITELIST":       "346",
+	"RPL_ENDOFINVITELIST":  "347",
+	"RPL_EXCEPTLIST":       "348",
+	"RPL_ENDOFEXCEPTLIST":  "349",
+	"RPL_QUIETLIST":        "728",
+	"RPL_ENDOFQUIETLIST":   "729",
 	"RPL_INFO":             "371",
 	"RPL_ENDOFINFO":        "374",
 	"RPL_MOTDSTART":        "375",
@@ -103,20 +116,29 @@ var replies = map[string]string{
 	"RPL_TRACEOPERATOR":    "204",
 	"RPL_TRACEUSER":        "205",
 	"RPL_TRACESERVER":      "206",
+	"RPL_TRACESERVICE":     "207",
 	"RPL_TRACENEWTYPE":     "208",
+	"RPL_TRACECLASS":       "209",
+	"RPL_TRACERECONNECT":   "210",
 	"RPL_TRACELOG":         "261",
+	"RPL_TRACEEND":         "262",
 	"RPL_STATSLINKINFO":    "211",
 	"RPL_STATSCOMMANDS":    "212",
 	"RPL_STATSCLINE":       "213",
 	"RPL_STATSNLINE":       "214",
 	"RPL_STATSILINE":       "215",
 	"RPL_STATSKLINE":       "216",
+	"RPL_STATSQLINE":       "217",
 	"RPL_STATSYLINE":       "218",
 	"RPL_ENDOFSTATS":       "219",
+	"RPL_STATSVLINE":       "240",
 	"RPL_STATSLLINE":       "241",
 	"RPL_STATSUPTIME":      "242",
 	"RPL_STATSOLINE":       "243",
 	"RPL_STATSHLINE":       "244",
+	"RPL_STATSPING":        "246",
+	"RPL_STATSBLINE":       "247",
+	"RPL_STATSDLINE":       "250",
 	"RPL_UMODEIS":          "221",
 	"RPL_LUSERCLIENT":      "251",
 	"RPL_LUSEROP":          "252",
@@ -124,7 +146,52 @@ var replies = map[string]string{
 	"RPL_LUSERCHANNELS":    "254",
 	"RPL_LUSERME":          "255",
 	"RPL_ADMINME":          "256",
-	"RPL_ADMINEMAIL":       "259"}
+	"RPL_ADMINLOC1":        "257",
+	"RPL_ADMINLOC2":        "258",
+	"RPL_ADMINEMAIL":       "259",
+	"RPL_LOCALUSERS":       "265",
+	"RPL_GLOBALUSERS":      "266",
+	"RPL_LOGON":            "600",
+	"RPL_LOGOFF":           "601",
+	"RPL_NOWON":            "604",
+	"RPL_NOWOFF":           "605",
+	"RPL_STARTTLS":         "670",
+	"ERR_STARTTLS":         "691",
+	"RPL_MONONLINE":        "730",
+	"RPL_MONOFFLINE":       "731"}
+
+var ErrTimeout = os.NewError("Timeout in receiving reply")
+
+//ReplyError is returned when the server answers a command with an error numeric
+type ReplyError struct {
+	Reply string //symbolic name of the numeric, e.g. ERR_NOTONCHANNEL
+	Msg   *IrcMessage
+}
+
+func (e *ReplyError) String() string {
+	if e.Msg != nil && len(e.Msg.Params) > 0 {
+		return fmt.Sprintf("%s: %s", e.Reply, strings.Join(e.Msg.Params[1:], " "))
+	}
+	return e.Reply
+}
+
+//replyName returns the symbolic name of a numeric, or the numeric itself if it is unknown
+func replyName(cmd string) string {
+	for key, _ := range replies {
+		if replies[key] == cmd {
+			return key
+		}
+	}
+	return cmd
+}
+
+//replyError returns a *ReplyError if msg is an error numeric, nil otherwise
+func replyError(msg *IrcMessage) os.Error {
+	if key := replyName(msg.Cmd); strings.HasPrefix(key, "ERR_") {
+		return &ReplyError{key, msg}
+	}
+	return nil
+}
 
 func timeout(lag int64) int64 {
 	t := lag * 3
@@ -134,6 +201,109 @@ func timeout(lag int64) int64 {
 	return t
 }
 
+//listen registers ch for every reply in myreplies under the name t. Names that are not in
+//the replies map (JOIN, TOPIC...) are registered as plain commands.
+func (n *Network) listen(myreplies []string, t string, ch chan *IrcMessage) os.Error {
+	for _, rep := range myreplies {
+		cmd, ok := replies[rep]
+		if !ok {
+			cmd = rep
+		}
+		if err := n.Listen.RegListener(cmd, t, ch); err != nil {
+			n.unlisten(myreplies, t)
+			return os.NewError(fmt.Sprintf("Couldn't register listener %s: %s", cmd, err.String()))
+		}
+	}
+	return nil
+}
+
+func (n *Network) unlisten(myreplies []string, t string) {
+	for _, rep := range myreplies {
+		cmd, ok := replies[rep]
+		if !ok {
+			cmd = rep
+		}
+		n.Listen.DelListener(cmd, t)
+	}
+	return
+}
+
+//query sends msg and collects the replies in myreplies that match until done returns true.
+//An error numeric about msg ends the query with a *ReplyError; every reply restarts the
+//timeout. On timeout the replies collected so far are returned along with ErrTimeout.
+func (n *Network) query(msg *IrcMessage, myreplies []string, match, done func(*IrcMessage) bool) ([]*IrcMessage, os.Error) {
+	return n.queryAll([]*IrcMessage{msg}, myreplies, match, done)
+}
+
+//queryAll is query sending several messages, e.g. a PING after a command whose last reply
+//is optional so that its PONG ends the query
+func (n *Network) queryAll(msgs []*IrcMessage, myreplies []string, match, done func(*IrcMessage) bool) ([]*IrcMessage, os.Error) {
+	t := strconv.Itoa64(time.Nanoseconds())
+	ret := make([]*IrcMessage, 0)
+	repch := make(chan *IrcMessage, 100)
+	if err := n.listen(myreplies, t, repch); err != nil {
+		return ret, err
+	}
+	defer n.unlisten(myreplies, t)
+	ticker := time.NewTicker(timeout(n.Lag()))
+	defer func() { ticker.Stop() }()
+	for _, msg := range msgs {
+		n.queueOut <- msg
+	}
+	for {
+		select {
+		case m := <-repch:
+			err := replyError(m)
+			if err != nil && !n.errorAbout(m, msgs) && (match == nil || !match(m)) {
+				continue //another command's error
+			} else if err == nil && match != nil && !match(m) {
+				continue
+			}
+			ret = append(ret, m)
+			if err != nil {
+				return ret, err
+			}
+			if done == nil || done(m) {
+				return ret, nil
+			}
+			ticker.Stop()
+			ticker = time.NewTicker(timeout(n.Lag()))
+		case <-ticker.C:
+			return ret, ErrTimeout
+		}
+	}
+	return ret, ErrTimeout
+}
+
+//errorAbout tells whether the error numeric m can be about one of msgs: its target (the
+//parameter after our nick) must be their command or one of their parameters. Errors
+//without a target, like "me :Permission Denied", can't be told apart and are taken.
+func (n *Network) errorAbout(m *IrcMessage, msgs []*IrcMessage) bool {
+	if len(m.Params) < 3 {
+		return true
+	}
+	for _, msg := range msgs {
+		if n.EqualFold(m.Params[1], msg.Cmd) {
+			return true
+		}
+		for _, p := range msg.Params {
+			for _, word := range strings.FieldsFunc(p, func(r int) bool { return r == ' ' || r == ',' }) {
+				if n.EqualFold(m.Params[1], word) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+//paramIs returns a match function for query that checks parameter i against val (case-insensitively)
+func paramIs(i int, val string) func(*IrcMessage) bool {
+	return func(m *IrcMessage) bool {
+		return len(m.Params) > i && strings.ToLower(m.Params[i]) == strings.ToLower(val)
+	}
+}
+
 func (n *Network) Register() os.Error {
 	var err os.Error
 	welcome := make(chan *IrcMessage, 1)
@@ -141,30 +311,34 @@ func (n *Network) Register() os.Error {
 		return os.NewError("Couldn't register listener for welcome messages (001)")
 	}
 	defer n.Listen.DelListener("001", "register")
-	if n.password != "" {
+	if n.getStr(&n.password) != "" {
 		err = n.Pass()
 		if err != nil {
 			return os.NewError("Couldn't register with password")
 		}
 	}
+	if err = n.negotiateCaps(); err != nil {
+		return err
+	}
 	nret := make(chan bool, 1)
 	go func(n *Network, ret chan bool) {
-		_, err = n.Nick(n.nick)
+		nick := n.GetNick()
+		_, err := n.Nick(nick)
 		i := 0
 		for err != nil {
 			if i > 8 {
 				ret <- false
 				return
 			}
-			n.nick = fmt.Sprintf("_%s", n.nick)
-			_, err = n.Nick(n.nick)
+			nick = fmt.Sprintf("_%s", nick)
+			_, err = n.Nick(nick)
 			i++
 		}
 		ret <- true
 		return
 	}(n, nret)
 	//TODO: reglistener for cmd 001 (welcome) which means user and nick commands were successful
-	n.user, err = n.User(n.user)
+	_, err = n.User(n.getStr(&n.user))
 	if err != nil {
 		return os.NewError("Unable to register username")
 	}
@@ -189,7 +363,7 @@ func (n *Network) Pass() os.Error {
 			err = os.NewError(fmt.Sprintf("Couldn't authenticate with password, exiting: %s", err.String()))
 		}
 	}
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	defer func(myreplies []string, t string, tick *time.Ticker) {
 		for _, rep := range myreplies {
 			n.Listen.DelListener(replies[rep], t)
@@ -197,7 +371,7 @@ func (n *Network) Pass() os.Error {
 		tick.Stop()
 		return
 	}(myreplies, t, ticker)
-	n.queueOut <- &IrcMessage{"", "PASS", []string{n.password}}
+	n.queueOut <- &IrcMessage{"", "PASS", []string{n.getStr(&n.password)}, nil}
 	select {
 	case msg := <-repch:
 		if msg.Cmd == replies["ERR_NEEDMOREPARAMS"] {
@@ -212,16 +386,16 @@ func (n *Network) Pass() os.Error {
 
 
 func (n *Network) GetNick() string {
-	return n.nick
+	return n.getStr(&n.nick)
 }
 
 func (n *Network) Nick(newnick string) (string, os.Error) {
 	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	defer ticker.Stop()
 	myreplies := []string{"ERR_NONICKNAMEGIVEN", "ERR_ERRONEUSNICKNAME", "ERR_NICKNAMEINUSE", "ERR_NICKCOLLISION"}
 	if newnick == "" {
-		return n.nick, os.NewError("Empty nicknames are not accepted in IRC")
+		return n.GetNick(), os.NewError("Empty nicknames are not accepted in IRC")
 	}
 	//TODO: check for correct nick (illegal characters)
 	if len(newnick) > 9 {
@@ -239,38 +413,38 @@ func (n *Network) Nick(newnick string) (string, os.Error) {
 			for _, rep := range myreplies {
 				n.Listen.DelListener(replies[rep], t)
 			}
-			return n.nick, os.NewError("Unable to register new listener")
+			return n.GetNick(), os.NewError("Unable to register new listener")
 		}
 	}
-	n.queueOut <- &IrcMessage{"", "NICK", []string{newnick}}
+	n.queueOut <- &IrcMessage{"", "NICK", []string{newnick}, nil}
 	select {
 	case msg := <-repch:
 		if msg.Cmd == replies["ERR_ERRONEUSNICKNAME"] || msg.Cmd == replies["ERR_NICKNAMEINUSE"] || msg.Cmd == replies["ERR_NICKCOLLISION"] {
 			for key, _ := range replies {
 				if replies[key] == msg.Cmd {
-					return n.nick, os.NewError(key)
+					return n.GetNick(), os.NewError(key)
 				}
 			}
-			return n.nick, os.NewError("Unknown error")
+			return n.GetNick(), os.NewError("Unknown error")
 		}
 	case <-ticker.C:
 		break
 	}
-	n.nick = newnick
-	return n.nick, nil
+	n.setStr(&n.nick, newnick)
+	return newnick, nil
 }
 
 func (n *Network) GetUser(newuser string) string {
-	return n.user
+	return n.getStr(&n.user)
 }
 
 func (n *Network) User(newuser string) (string, os.Error) {
 	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	defer ticker.Stop()
 	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_ALREADYREGISTRED", "RPL_ENDOFMOTD", "ERR_NOTREGISTERED"}
 	if newuser == "" {
-		return n.user, os.NewError("Can't have an empty user field")
+		return n.getStr(&n.user), os.NewError("Can't have an empty user field")
 	} else if len(newuser) > 9 {
 		newuser = newuser[:9]
 	}
@@ -286,57 +460,55 @@ func (n *Network) User(newuser string) (string, os.Error) {
 			return "", os.NewError(fmt.Sprintf("Couldn't register Listener for %s: %s", replies[rep], err.String()))
 		}
 	}
-	n.queueOut <- &IrcMessage{"", "USER", []string{n.user, "0.0.0.0", "0.0.0.0", n.realname}}
+	user := n.getStr(&n.user)
+	n.queueOut <- &IrcMessage{"", "USER", []string{user, "0.0.0.0", "0.0.0.0", n.getStr(&n.realname)}, nil}
 	select {
 	case msg := <-repch:
 		if msg.Cmd == replies["ERR_NEEDMOREPARAMS"] {
-			return n.user, os.NewError("ERR_NEEDMOREPARAMS")
+			return user, os.NewError("ERR_NEEDMOREPARAMS")
 		} else if msg.Cmd == replies["ERR_ALREADYREGISTRED"] {
-			return n.user, os.NewError("ERR_ALREADYREGISTRED")
+			return user, os.NewError("ERR_ALREADYREGISTRED")
 		} else if msg.Cmd == replies["ERR_NOTREGISTERED"] {
-			return n.user, os.NewError("ERR_NOTREGISTERED")
+			return user, os.NewError("ERR_NOTREGISTERED")
 		} else if msg.Cmd == replies["RPL_ENDOFMOTD"] {
-			return n.user, nil
+			return user, nil
 		}
 	case <-ticker.C:
-		n.user = newuser
+		n.setStr(&n.user, newuser)
+		user = newuser
 	}
-	return n.user, nil
+	return user, nil
 }
 
 func (n *Network) Realname(newrn string) string {
 	//TODO: call user from here
-	if n.conn == nil {
+	if conn, _ := n.connection(); conn == nil {
 		//TODO: see User: can we change realname after we are connected? -> if we can change the user after connected
-		n.realname = newrn
+		n.setStr(&n.realname, newrn)
 	}
-	return n.realname
+	return n.getStr(&n.realname)
 }
 
 func (n *Network) GetNetName() string {
-	return n.network
+	return n.getStr(&n.network)
 }
 
 func (n *Network) NetName(newname string, reason string) (string, os.Error) {
 	if newname != "" {
-		n.network = newname
-		return n.network, n.Reconnect(reason)
+		n.setStr(&n.network, newname)
+		return newname, n.Reconnect(reason)
 	} else {
-		return n.network, os.NewError("Empty name")
+		return n.GetNetName(), os.NewError("Empty name")
 	}
-	return n.network, nil //BUG: why do we need this?
+	return n.GetNetName(), nil //BUG: why do we need this?
 }
 
-func (n *Network) SysOpMe(user, pass string) {
-	n.queueOut <- &IrcMessage{"", "OPER", []string{user, pass}}
-	//TODO: replies:
-	//ERR_NEEDMOREPARAMS              RPL_YOUREOPER
-	//ERR_NOOPERHOST                  ERR_PASSWDMISMATCH
-	return
+func (n *Network) SysOpMe(user, pass string) os.Error {
+	return n.Oper(user, pass)
 }
 
 func (n *Network) Quit(reason string) {
-	n.queueOut <- &IrcMessage{"", "QUIT", []string{reason}}
+	n.queueOut <- &IrcMessage{"", "QUIT", []string{reason}, nil}
 	return
 }
 
@@ -345,7 +517,7 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 		return os.NewError("No channels given")
 	}
 	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_BANNEDFROMCHAN",
 		"ERR_INVITEONLYCHAN", "ERR_BADCHANNELKEY",
 		"ERR_CHANNELISFULL", "ERR_BADCHANMASK",
@@ -383,7 +555,7 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 			}
 		}
 	}
-	n.queueOut <- &IrcMessage{"", "JOIN", []string{strings.Join(chans, ","), strings.Join(keys, ",")}}
+	n.queueOut <- &IrcMessage{"", "JOIN", []string{strings.Join(chans, ","), strings.Join(keys, ",")}, nil}
 	joined := 0
 	for {
 		select {
@@ -410,7 +582,7 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 				return nil
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag))
+			ticker = time.NewTicker(timeout(n.Lag()))
 		case <-ticker.C:
 			ticker.Stop()
 			return os.NewError("Didn't receive join reply")
@@ -420,85 +592,146 @@ func (n *Network) Join(chans []string, keys []string) os.Error { //return: topic
 	return nil
 }
 
-func (n *Network) Part(chans []string, reason string) {
-	n.queueOut <- &IrcMessage{"", "PART", []string{strings.Join(chans, ","), reason}}
-	//TODO: replies:
-	//ERR_NEEDMOREPARAMS              ERR_NOSUCHCHANNEL
-	//ERR_NOTONCHANNEL
-	return
-}
-
-func (n *Network) Mode(target, mode, params string) {
-	chmodes := []byte{'o', 'p', 's', 'i', 't', 'n', 'm', 'l', 'b', 'v', 'k'}
-	usrmodes := []byte{'i', 's', 'w', 'o'}
-	var found bool
-	for _, c := range mode { //is it a channel mode?
-		found = false
-		for _, m := range chmodes {
-			if m == byte(c) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			break
-		}
+//Part leaves chans and waits for the server to confirm each of them. The returned map holds
+//the outcome for every channel (nil on success); the error is set if any of them failed.
+func (n *Network) Part(chans []string, reason string) (map[string]os.Error, os.Error) {
+	ret := make(map[string]os.Error)
+	if len(chans) == 0 {
+		return ret, os.NewError("No channels given")
 	}
-	if !found { //maybe it's a user mode?
-		for _, c := range mode {
-			found := false
-			for _, m := range usrmodes {
-				if m == byte(c) {
-					found = true
-					break
+	t := strconv.Itoa64(time.Nanoseconds())
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOSUCHCHANNEL",
+		"ERR_NOTONCHANNEL", "PART"}
+	repch := make(chan *IrcMessage, 10)
+	if err := n.listen(myreplies, t, repch); err != nil {
+		return ret, err
+	}
+	defer n.unlisten(myreplies, t)
+	pending := make(map[string]string) //lower case -> as given
+	for _, ch := range chans {
+		pending[n.Fold(ch)] = ch
+	}
+	ticker := time.NewTicker(timeout(n.Lag()))
+	defer func() { ticker.Stop() }()
+	n.queueOut <- &IrcMessage{"", "PART", []string{strings.Join(chans, ","), reason}, nil}
+	for len(pending) > 0 {
+		select {
+		case msg := <-repch:
+			var ch string
+			var err os.Error
+			if msg.Cmd == "PART" {
+				if !n.EqualFold(msg.Origin(), n.GetNick()) || len(msg.Params) == 0 {
+					continue
 				}
+				ch = msg.Params[0]
+			} else if err = replyError(msg); len(msg.Params) > 1 {
+				ch = msg.Params[1]
 			}
-			if !found { //neither a channel nor a user mode, don't touch this
-				return
-				//TODO: return error?
+			if orig, ok := pending[n.Fold(ch)]; ok {
+				ret[orig] = err
+				pending[n.Fold(ch)] = "", false
+			} else if msg.Cmd == replies["ERR_NEEDMOREPARAMS"] {
+				return ret, err
 			}
+			ticker.Stop()
+			ticker = time.NewTicker(timeout(n.Lag()))
+		case <-ticker.C:
+			for _, orig := range pending {
+				ret[orig] = ErrTimeout
+			}
+			pending = make(map[string]string)
 		}
 	}
-	n.queueOut <- &IrcMessage{"", "MODE", []string{target, mode, params}}
-	//TODO: replies:
-	//ERR_NEEDMOREPARAMS              RPL_CHANNELMODEIS
-	//ERR_CHANOPRIVSNEEDED            ERR_NOSUCHNICK
-	//ERR_NOTONCHANNEL                ERR_KEYSET
-	//RPL_BANLIST                     RPL_ENDOFBANLIST
-	//ERR_UNKNOWNMODE                 ERR_NOSUCHCHANNEL
-	//
-	//ERR_USERSDONTMATCH              RPL_UMODEIS
-	//ERR_UMODEUNKNOWNFLAG
-	return
+	failed := 0
+	for _, err := range ret {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return ret, os.NewError(fmt.Sprintf("Couldn't part %d of %d channels", failed, len(chans)))
+	}
+	return ret, nil
 }
 
-func (n *Network) SetTopic(ch, topic string) {
-	n.queueOut <- &IrcMessage{"", "TOPIC", []string{ch, topic}}
-	//TODO: replies
-	//ERR_NEEDMOREPARAMS              ERR_NOTONCHANNEL
-	//RPL_NOTOPIC                     RPL_TOPIC
-	//ERR_CHANOPRIVSNEEDED
-	return
+var ErrNoTopic = os.NewError("RPL_NOTOPIC")
+
+type Topic struct {
+	Channel string
+	Text    string
+	SetBy   string //may be a full nick!user@host or just a nick, depending on the server
+	SetAt   int64  //seconds since the epoch, 0 if the server didn't tell
 }
 
-func (n *Network) GetTopic(ch string) string {
-	n.queueOut <- &IrcMessage{"", "TOPIC", []string{ch}}
-	//TODO: replies
-	//ERR_NEEDMOREPARAMS              ERR_NOTONCHANNEL
-	//RPL_NOTOPIC                     RPL_TOPIC
-	//ERR_CHANOPRIVSNEEDED
-	return ""
+//SetTopic changes the topic of ch and waits for the server to echo it back.
+//Topics longer than the server's TOPICLEN are refused.
+func (n *Network) SetTopic(ch, topic string) os.Error {
+	if max := n.isupportInt("TOPICLEN", 0); max > 0 && len(topic) > max {
+		return os.NewError(fmt.Sprintf("Topic too long: %d bytes, TOPICLEN is %d", len(topic), max))
+	}
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOTONCHANNEL",
+		"ERR_NOSUCHCHANNEL", "ERR_CHANOPRIVSNEEDED",
+		"TOPIC"}
+	match := func(m *IrcMessage) bool {
+		if m.Cmd == "TOPIC" {
+			return paramIs(0, ch)(m)
+		}
+		return m.Cmd == replies["ERR_NEEDMOREPARAMS"] || paramIs(1, ch)(m)
+	}
+	_, err := n.query(&IrcMessage{"", "TOPIC", []string{ch, topic}, nil}, myreplies, match, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive topic reply")
+	}
+	return err
+}
+
+//GetTopic asks the server for the topic of ch. If no topic is set, the returned error is ErrNoTopic.
+func (n *Network) GetTopic(ch string) (*Topic, os.Error) {
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOTONCHANNEL",
+		"ERR_NOSUCHCHANNEL", "RPL_NOTOPIC",
+		"RPL_TOPIC", "RPL_TOPICWHOTIME", "PONG"}
+	token := "topic" + strconv.Itoa64(time.Nanoseconds()) //not every server sends RPL_TOPICWHOTIME, its PONG tells we got all
+	match := func(m *IrcMessage) bool {
+		if m.Cmd == "PONG" {
+			return len(m.Params) > 0 && m.Params[len(m.Params)-1] == token
+		}
+		return m.Cmd == replies["ERR_NEEDMOREPARAMS"] || paramIs(1, ch)(m)
+	}
+	done := func(m *IrcMessage) bool {
+		return m.Cmd == "PONG" || m.Cmd == replies["RPL_NOTOPIC"] || m.Cmd == replies["RPL_TOPICWHOTIME"]
+	}
+	msgs, err := n.queryAll([]*IrcMessage{&IrcMessage{"", "TOPIC", []string{ch}, nil}, &IrcMessage{"", "PING", []string{token}, nil}}, myreplies, match, done)
+	ret := &Topic{Channel: ch}
+	for _, m := range msgs {
+		switch m.Cmd {
+		case replies["RPL_NOTOPIC"]:
+			return ret, ErrNoTopic
+		case replies["RPL_TOPIC"]:
+			if len(m.Params) > 2 {
+				ret.Text = m.Params[2]
+			}
+		case replies["RPL_TOPICWHOTIME"]:
+			if len(m.Params) > 3 {
+				ret.SetBy = m.Params[2]
+				ret.SetAt, _ = strconv.Atoi64(m.Params[3])
+			}
+		}
+	}
+	if err == ErrTimeout && len(msgs) > 0 { //the server doesn't answer PINGs
+		err = nil
+	}
+	return ret, err
 }
 
 func (n *Network) Names(chans []string) {
-	n.queueOut <- &IrcMessage{"", "NAMES", []string{strings.Join(chans, ",")}}
+	n.queueOut <- &IrcMessage{"", "NAMES", []string{strings.Join(chans, ",")}, nil}
 	//TODO: replies:
 	//RPL_NAMREPLY                    RPL_ENDOFNAMES
 	return
 }
 
 func (n *Network) List(chans []string, server string) {
-	msg := &IrcMessage{"", "LIST", []string{}}
+	msg := &IrcMessage{"", "LIST", []string{}, nil}
 	if len(chans) > 0 {
 		msg.Params = append(msg.Params, strings.Join(chans, ","))
 	}
@@ -512,28 +745,75 @@ func (n *Network) List(chans []string, server string) {
 	return
 }
 
-func (n *Network) Invite(target, ch string) {
-	n.queueOut <- &IrcMessage{"", "INVITE", []string{target, ch}}
-	//TODO: replies:
-	//ERR_NEEDMOREPARAMS              ERR_NOSUCHNICK
-	//ERR_NOTONCHANNEL                ERR_USERONCHANNEL
-	//ERR_CHANOPRIVSNEEDED
-	//RPL_INVITING                    RPL_AWAY
-	return
+//Invite invites target to ch and waits for RPL_INVITING
+func (n *Network) Invite(target, ch string) os.Error {
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOSUCHNICK",
+		"ERR_NOTONCHANNEL", "ERR_USERONCHANNEL",
+		"ERR_CHANOPRIVSNEEDED", "ERR_NOSUCHCHANNEL",
+		"RPL_INVITING"}
+	match := func(m *IrcMessage) bool { //errors are taken when about target or ch, see errorAbout
+		return m.Cmd == replies["RPL_INVITING"] && ((paramIs(1, target)(m) && paramIs(2, ch)(m)) || (paramIs(1, ch)(m) && paramIs(2, target)(m)))
+	}
+	_, err := n.query(&IrcMessage{"", "INVITE", []string{target, ch}, nil}, myreplies, match, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive invite reply")
+	}
+	return err
 }
 
-func (n *Network) Kick(ch, target, reason string) {
-	n.queueOut <- &IrcMessage{"", "KICK", []string{ch, target, reason}}
-	//TODO: replies:
-	//ERR_NEEDMOREPARAMS              ERR_NOSUCHCHANNEL
-	//ERR_BADCHANMASK                 ERR_CHANOPRIVSNEEDED
-	//ERR_NOTONCHANNEL
-	return
+type Invitation struct {
+	By      string //nick of the inviting user
+	Target  string //nick of the invited user
+	Channel string
+	ForUs   bool //false for invites sent by others, seen with the invite-notify capability
+}
+
+//ParseInvite interprets an incoming INVITE message
+func (n *Network) ParseInvite(msg *IrcMessage) (*Invitation, os.Error) {
+	if msg.Cmd != "INVITE" || len(msg.Params) < 2 {
+		return nil, os.NewError(fmt.Sprintf("Not an invite: %s", msg.String()))
+	}
+	by := msg.Origin()
+	return &Invitation{by, msg.Params[0], msg.Params[1], n.EqualFold(msg.Params[0], n.GetNick())}, nil
+}
+
+//Kick kicks target from ch and waits for the server to echo the KICK
+func (n *Network) Kick(ch, target, reason string) os.Error {
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOSUCHCHANNEL",
+		"ERR_BADCHANMASK", "ERR_CHANOPRIVSNEEDED",
+		"ERR_NOTONCHANNEL", "ERR_USERNOTINCHANNEL",
+		"ERR_NOSUCHNICK", "KICK"}
+	match := func(m *IrcMessage) bool { //errors are taken when about ch or target, see errorAbout
+		return m.Cmd == "KICK" && n.EqualFold(m.Origin(), n.GetNick()) && paramIs(0, ch)(m) && paramIs(1, target)(m)
+	}
+	_, err := n.query(&IrcMessage{"", "KICK", []string{ch, target, reason}, nil}, myreplies, match, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive kick reply")
+	}
+	return err
+}
+
+func (n *Network) Privmsg(target []string, msg string) os.Error {
+	_, err := n.PrivmsgAway(target, msg)
+	return err
+}
+
+//a user we sent a message to is away (RPL_AWAY)
+type AwayReply struct {
+	Nick    string
+	Message string
 }
 
-func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make privmsg hack up messages that are too long
+//PrivmsgAway works like Privmsg, but also returns the away messages of the recipients
+func (n *Network) PrivmsgAway(target []string, msg string) ([]AwayReply, os.Error) { //BUG: make privmsg hack up messages that are too long
+	return n.privmsgs(target, []string{msg})
+}
+
+//privmsgs sends every text of msgs to target, then waits once for the errors and away replies
+func (n *Network) privmsgs(target []string, msgs []string) ([]AwayReply, os.Error) {
 	t := strconv.Itoa64(time.Nanoseconds())
-	ticker := time.NewTicker(timeout(n.lag))
+	aways := make([]AwayReply, 0)
+	ticker := time.NewTicker(timeout(n.Lag()))
 	myreplies := []string{"ERR_NORECIPIENT", "ERR_NOTEXTTOSEND",
 		"ERR_CANNOTSENDTOCHAN", "ERR_NOTOPLEVEL",
 		"ERR_WILDTOPLEVEL", "ERR_TOOMANYTARGETS",
@@ -541,7 +821,7 @@ func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make pr
 	repch := make(chan *IrcMessage, 10)
 	for _, rep := range myreplies {
 		if err := n.Listen.RegListener(replies[rep], t, repch); err != nil {
-			return os.NewError(fmt.Sprintf("Couldn't register nick %s: %s", replies[rep], err.String()))
+			return aways, os.NewError(fmt.Sprintf("Couldn't register nick %s: %s", replies[rep], err.String()))
 		}
 	}
 	defer func(myreplies []string, t string) {
@@ -550,29 +830,37 @@ func (n *Network) Privmsg(target []string, msg string) os.Error { //BUG: make pr
 		}
 		return
 	}(myreplies, t)
-	n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{strings.Join(target, ","), msg}}
+	for _, msg := range msgs {
+		n.queueOut <- &IrcMessage{"", "PRIVMSG", []string{strings.Join(target, ","), msg}, nil}
+	}
 	for {
 		select {
 		case msg := <-repch:
-			for key, _ := range replies {
-				if replies[key] == msg.Cmd && key[:3] == "ERR" {
-					ticker.Stop()
-					return os.NewError(key)
+			if msg.Cmd == replies["RPL_AWAY"] {
+				if len(msg.Params) > 2 {
+					aways = append(aways, AwayReply{msg.Params[1], msg.Params[2]})
+				}
+			} else {
+				for key, _ := range replies {
+					if replies[key] == msg.Cmd && key[:3] == "ERR" {
+						ticker.Stop()
+						return aways, os.NewError(key)
+					}
 				}
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag))
+			ticker = time.NewTicker(timeout(n.Lag()))
 		case <-ticker.C:
 			ticker.Stop()
-			return nil
+			return aways, nil
 		}
 	}
 	ticker.Stop()
-	return nil
+	return aways, nil
 }
 
 func (n *Network) Notice(target, text string) { //BUG: make notice hack up messages that are too long
-	n.queueOut <- &IrcMessage{"", "NOTICE", []string{target, text}}
+	n.queueOut <- &IrcMessage{"", "NOTICE", []string{target, text}, nil}
 	//TODO: replies:
 	//ERR_NORECIPIENT                 ERR_NOTEXTTOSEND
 	//ERR_CANNOTSENDTOCHAN            ERR_NOTOPLEVEL
@@ -583,7 +871,7 @@ func (n *Network) Notice(target, text string) { //BUG: make notice hack up messa
 }
 
 func (n *Network) Who(target string) {
-	n.queueOut <- &IrcMessage{"", "WHO", []string{target}}
+	n.queueOut <- &IrcMessage{"", "WHO", []string{target}, nil}
 	//TODO: replies:
 	//ERR_NOSUCHSERVER
 	//RPL_WHOREPLY                    RPL_ENDOFWHO
@@ -593,12 +881,13 @@ func (n *Network) Who(target string) {
 func (n *Network) Whois(target []string, server string) (map[string][]string, os.Error) { //TODO: return a map[string][][]string? map[string][]IrcMessage?
 	t := strconv.Itoa64(time.Nanoseconds())
 	ret := make(map[string][]string)
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	myreplies := []string{"ERR_NOSUCHSERVER", "ERR_NONICKNAMEGIVEN",
 		"RPL_WHOISUSER", "RPL_WHOISCHANNELS",
 		"RPL_WHOISSERVER", "RPL_AWAY",
 		"RPL_WHOISOPERATOR", "RPL_WHOISIDLE",
-		"ERR_NOSUCHNICK", "RPL_ENDOFWHOIS"}
+		"RPL_WHOISACCOUNT", "ERR_NOSUCHNICK",
+		"RPL_ENDOFWHOIS"}
 	repch := make(chan *IrcMessage, 10)
 	defer func(myreplies []string, t string) {
 		for _, rep := range myreplies {
@@ -614,9 +903,9 @@ func (n *Network) Whois(target []string, server string) (map[string][]string, os
 	}
 
 	if server == "" {
-		n.queueOut <- &IrcMessage{"", "WHOIS", []string{strings.Join(target, ",")}}
+		n.queueOut <- &IrcMessage{"", "WHOIS", []string{strings.Join(target, ",")}, nil}
 	} else {
-		n.queueOut <- &IrcMessage{"", "WHOIS", []string{server, strings.Join(target, ",")}}
+		n.queueOut <- &IrcMessage{"", "WHOIS", []string{server, strings.Join(target, ",")}, nil}
 	}
 	for _, rep := range myreplies {
 		ret[replies[rep]] = make([]string, 0)
@@ -646,7 +935,7 @@ func (n *Network) Whois(target []string, server string) (map[string][]string, os
 				}
 			}
 			ticker.Stop()
-			ticker = time.NewTicker(timeout(n.lag)) //restart the ticker to timeout correctly
+			ticker = time.NewTicker(timeout(n.Lag())) //restart the ticker to timeout correctly
 		case <-ticker.C:
 			ticker.Stop()
 			return ret, err
@@ -657,7 +946,7 @@ func (n *Network) Whois(target []string, server string) (map[string][]string, os
 }
 
 func (n *Network) Whowas(target string, count int, server string) {
-	msg := &IrcMessage{"", "WHOIS", []string{}}
+	msg := &IrcMessage{"", "WHOIS", []string{}, nil}
 	msg.Params = append(msg.Params, target)
 	if count != 0 {
 		msg.Params = append(msg.Params, strconv.Itoa(count))
@@ -674,7 +963,7 @@ func (n *Network) Whowas(target string, count int, server string) {
 }
 
 func (n *Network) PingNick(nick string) {
-	n.queueOut <- &IrcMessage{"", "PING", []string{nick}}
+	n.queueOut <- &IrcMessage{"", "PING", []string{nick}, nil}
 	//TODO: replies:
 	//ERR_NOORIGIN                    ERR_NOSUCHSERVER
 	return
@@ -684,7 +973,7 @@ func (n *Network) Ping() (int64, os.Error) {
 	myreplies := []string{"ERR_NOORIGIN", "ERR_NOSUCHSERVER"}
 	t := strconv.Itoa64(time.Nanoseconds())
 	repch := make(chan *IrcMessage, 10)
-	ticker := time.NewTicker(timeout(n.lag))
+	ticker := time.NewTicker(timeout(n.Lag()))
 	defer ticker.Stop()
 	defer func(myreplies []string, t string, n *Network) {
 		for _, rep := range myreplies {
@@ -698,7 +987,7 @@ func (n *Network) Ping() (int64, os.Error) {
 	}
 	n.Listen.RegListener("PONG", t, repch)
 	var rep *IrcMessage
-	n.queueOut <- &IrcMessage{"", "PING", []string{strconv.Itoa64(time.Nanoseconds())}}
+	n.queueOut <- &IrcMessage{"", "PING", []string{strconv.Itoa64(time.Nanoseconds())}, nil}
 	select {
 	case <-ticker.C:
 		return 0, os.NewError("Timeout in receiving reply")
@@ -707,8 +996,9 @@ func (n *Network) Ping() (int64, os.Error) {
 	if rep.Cmd == "PONG" {
 		origtime, err := strconv.Atoi64(rep.Params[len(rep.Params)-1])
 		if err == nil {
-			n.lag = time.Nanoseconds() - origtime
-			return n.lag, err
+			lag := time.Nanoseconds() - origtime
+			n.setLag(lag)
+			return lag, err
 		} else {
 			return 0, err
 		}
@@ -726,24 +1016,39 @@ func (n *Network) Ping() (int64, os.Error) {
 }
 
 func (n *Network) Pong(msg string) {
-	n.queueOut <- &IrcMessage{"", "PONG", []string{msg}}
+	n.queueOut <- &IrcMessage{"", "PONG", []string{msg}, nil}
 	//TODO: numeric replies? PingNick?
 	return
 }
 
-func (n *Network) Away(reason string) {
-	msg := &IrcMessage{"", "AWAY", []string{}}
+//Away marks us away with reason, or back if reason is empty, and waits for the server to confirm
+func (n *Network) Away(reason string) os.Error {
+	msg := &IrcMessage{"", "AWAY", []string{}, nil}
 	if reason != "" {
 		msg.Params = append(msg.Params, reason)
 	}
-	n.queueOut <- msg
-	//TODO: replies:
-	//RPL_UNAWAY                      RPL_NOWAWAY
-	return
+	myreplies := []string{"RPL_UNAWAY", "RPL_NOWAWAY"}
+	msgs, err := n.query(msg, myreplies, nil, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive away reply")
+	} else if err == nil {
+		n.lock.Lock()
+		n.away = msgs[0].Cmd == replies["RPL_NOWAWAY"]
+		n.awayReason = reason
+		n.lock.Unlock()
+	}
+	return err
+}
+
+//IsAway returns our away state as last confirmed by the server, and the reason we gave
+func (n *Network) IsAway() (bool, string) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.away, n.awayReason
 }
 
 func (n *Network) Users(server string) {
-	msg := &IrcMessage{"", "USERS", []string{}}
+	msg := &IrcMessage{"", "USERS", []string{}, nil}
 	if server != "" {
 		msg.Params = append(msg.Params, server)
 	}
@@ -751,25 +1056,112 @@ func (n *Network) Users(server string) {
 	return
 }
 
-func (n *Network) Userhost(users []string) {
-	if len(users) > 5 {
-		//todo cycle them 5-by-5?
-		return
+type UserhostReply struct {
+	Nick string
+	User string
+	Host string
+	Oper bool
+	Away bool
+}
+
+//Userhost returns user and host of users, asking the server 5 nicks at a time
+func (n *Network) Userhost(users []string) ([]UserhostReply, os.Error) {
+	ret := make([]UserhostReply, 0)
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "RPL_USERHOST"}
+	for len(users) > 0 {
+		batch := users
+		if len(batch) > 5 {
+			batch = batch[:5]
+		}
+		users = users[len(batch):]
+		userhostNick := func(r string) string {
+			if i := strings.Index(r, "="); i > -1 {
+				r = r[:i]
+			}
+			return strings.TrimRight(r, "*")
+		}
+		msgs, err := n.query(&IrcMessage{"", "USERHOST", batch, nil}, myreplies, n.nicksAmong(batch, userhostNick), nil)
+		if err != nil {
+			return ret, err
+		}
+		//nick[*]=[+-]user@host, * for operators, - for away users
+		for _, r := range strings.Fields(msgs[0].Params[len(msgs[0].Params)-1]) {
+			i := strings.Index(r, "=")
+			j := strings.Index(r, "@")
+			if i < 1 || j < i+2 {
+				continue
+			}
+			u := UserhostReply{Nick: r[:i], User: r[i+2 : j], Host: r[j+1:]}
+			if strings.HasSuffix(u.Nick, "*") {
+				u.Nick, u.Oper = u.Nick[:len(u.Nick)-1], true
+			}
+			u.Away = r[i+1] == '-'
+			n.seen(u.Nick, u.User, u.Host)
+			ret = append(ret, u)
+		}
 	}
-	n.queueOut <- &IrcMessage{"", "USERHOST", []string{strings.Join(users, " ")}}
-	//TODO: replies
-	//RPL_USERHOST                    ERR_NEEDMOREPARAMS
-	return
+	return ret, nil
 }
 
-func (n *Network) Ison(users []string) {
-	if len(users) > 53 { //maximum number of nicks: 512/9 9 is max length of a nick
-		return
+//nicksAmong returns a match function for query accepting replies like RPL_USERHOST and
+//RPL_ISON whose last parameter only has nicks among nicks, once nickOf (if not nil) got them
+//out of its words. An empty reply can't be told apart and is accepted.
+func (n *Network) nicksAmong(nicks []string, nickOf func(string) string) func(*IrcMessage) bool {
+	return func(m *IrcMessage) bool {
+		if len(m.Params) < 2 {
+			return false
+		}
+		for _, word := range strings.Fields(m.Params[len(m.Params)-1]) {
+			if nickOf != nil {
+				word = nickOf(word)
+			}
+			found := false
+			for _, nick := range nicks {
+				if n.EqualFold(word, nick) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
 	}
-	n.queueOut <- &IrcMessage{"", "ISON", []string{strings.Join(users, " ")}}
-	//TODO: replies
-	//RPL_ISON                ERR_NEEDMOREPARAMS
-	return
+}
+
+//batches splits words into lists that fit on one line after a command prefix of the given length
+func batches(words []string, prefixlen, sep int) [][]string {
+	ret := make([][]string, 0)
+	batch := make([]string, 0)
+	length := prefixlen
+	for _, w := range words {
+		if len(batch) > 0 && length+sep+len(w) > 510 {
+			ret = append(ret, batch)
+			batch = make([]string, 0)
+			length = prefixlen
+		}
+		batch = append(batch, w)
+		length += sep + len(w)
+	}
+	if len(batch) > 0 {
+		ret = append(ret, batch)
+	}
+	return ret
+}
+
+//Ison returns the nicks of users that are online, in as many ISON messages as needed
+func (n *Network) Ison(users []string) ([]string, os.Error) {
+	ret := make([]string, 0)
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "RPL_ISON"}
+	for _, batch := range batches(users, len("ISON :"), 1) {
+		msgs, err := n.query(&IrcMessage{"", "ISON", []string{strings.Join(batch, " ")}, nil}, myreplies, n.nicksAmong(batch, nil), nil)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, strings.Fields(msgs[0].Params[len(msgs[0].Params)-1])...)
+	}
+	return ret, nil
 }
 
 func (n *Network) SendRaw(raw string) {
@@ -779,20 +1171,36 @@ func (n *Network) SendRaw(raw string) {
 	}
 }
 
-func (n *Network) SetPort(port string) {
-	n.port = port
-	n.Reconnect("Changing server.")
+func (n *Network) SetPort(port string) os.Error {
+	n.setStr(&n.port, port)
+	return n.Reconnect("Changing server.")
 }
 
-func (n *Network) SetNetwork(net string) {
-	n.network = net
-	n.Reconnect("Changing server.")
+func (n *Network) SetNetwork(net string) os.Error {
+	n.setStr(&n.network, net)
+	return n.Reconnect("Changing server.")
 }
 
+//SetVersion sets the CTCP VERSION reply of this network, IRCVERSION is the default of new ones
 func (n *Network) SetVersion(newversion string) {
-	IRCVERSION = newversion
+	n.setStr(&n.version, newversion)
 }
 
 func (n *Network) GetVersion() string {
-	return IRCVERSION
+	return n.getStr(&n.version)
+}
+
+//SetConfDir makes this network keep its files (TLS certificate, downloads, plugin data) in dir
+//instead of the shared configuration directory
+func (n *Network) SetConfDir(dir string) os.Error {
+	if err := os.MkdirAll(dir, 0751); err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.dccPolicy.Dir == n.confdir+"/downloads" {
+		n.dccPolicy.Dir = dir + "/downloads"
+	}
+	n.confdir = dir
+	return nil
 }
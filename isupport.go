@@ -0,0 +1,115 @@
+package ircchans
+
+import (
+	"strings"
+	"strconv"
+	"sync"
+)
+
+//tokens advertised by the server in RPL_ISUPPORT (005)
+type isupportMap struct {
+	lock   *sync.RWMutex
+	tokens map[string]string
+}
+
+func newIsupportMap() isupportMap {
+	return isupportMap{new(sync.RWMutex), make(map[string]string)}
+}
+
+func (s *isupportMap) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens = make(map[string]string)
+}
+
+func (s *isupportMap) get(key string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	val, ok := s.tokens[key]
+	return val, ok
+}
+
+//parse one RPL_ISUPPORT line: the first parameter is our nick and the last one is the
+//human readable "are supported by this server"
+func (s *isupportMap) update(msg *IrcMessage) {
+	if len(msg.Params) < 3 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, tok := range msg.Params[1 : len(msg.Params)-1] {
+		if tok == "" {
+			continue
+		}
+		if tok[0] == '-' {
+			s.tokens[tok[1:]] = "", false
+			continue
+		}
+		if i := strings.Index(tok, "="); i > -1 {
+			s.tokens[tok[:i]] = isupportUnescape(tok[i+1:])
+		} else {
+			s.tokens[tok] = ""
+		}
+	}
+}
+
+//values may contain \xHH escapes (usually \x20 for a space)
+func isupportUnescape(val string) string {
+	if !strings.Contains(val, "\\x") {
+		return val
+	}
+	ret := make([]byte, 0, len(val))
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' && i+3 < len(val) && val[i+1] == 'x' {
+			if b, err := strconv.Btoui64(val[i+2:i+4], 16); err == nil {
+				ret = append(ret, byte(b))
+				i += 3
+				continue
+			}
+		}
+		ret = append(ret, val[i])
+	}
+	return string(ret)
+}
+
+func (n *Network) isupportTracker() {
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("isupportTracker", exch)
+	if err != nil {
+		return
+	}
+	defer close(done)
+	ch := make(chan *IrcMessage, 10)
+	n.Listen.RegListener(replies["RPL_ISUPPORT"], "isupport", ch)
+	defer n.Listen.DelListener(replies["RPL_ISUPPORT"], "isupport")
+	for {
+		select {
+		case msg := <-ch:
+			n.isupport.update(msg)
+		case exit := <-exch:
+			if exit {
+				return
+			}
+			continue
+		}
+	}
+	return
+}
+
+//ISupport returns the value of an RPL_ISUPPORT token and whether the server advertised it at all
+func (n *Network) ISupport(key string) (string, bool) {
+	return n.isupport.get(key)
+}
+
+//isupportInt returns the numeric value of an RPL_ISUPPORT token, or def if it is missing or empty
+func (n *Network) isupportInt(key string, def int) int {
+	val, ok := n.isupport.get(key)
+	if !ok || val == "" {
+		return def
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return def
+	}
+	return i
+}
@@ -0,0 +1,194 @@
+package ircchans
+
+import (
+	"time"
+	"strconv"
+)
+
+//KeepaliveConfig decides how a network checks that its connection is alive
+type KeepaliveConfig struct {
+	Interval   int64   //nanoseconds without receiving anything after which we PING the server
+	Timeout    int64   //nanoseconds without receiving anything after which the connection is dead, more than Interval
+	Reconnect  bool    //reconnect after a ping timeout, instead of just closing
+	Thresholds []int64 //lags in nanoseconds whose crossing is sent on LagEvents
+	History    int     //number of lag measures LagStats is computed on
+}
+
+var defKeepalive = KeepaliveConfig{4 * minute, 6 * minute, true, nil, 20}
+
+//LagEvent tells that the lag went above Threshold, or back below it. Timeout events tell
+//that nothing was received for Lag nanoseconds, more than the Threshold of the keepalive.
+type LagEvent struct {
+	Lag       int64
+	Threshold int64
+	Above     bool
+	Timeout   bool
+}
+
+//the keepalive settings and lag measures of a network, guarded by its lock
+type keepalive struct {
+	conf    KeepaliveConfig
+	samples []int64 //the last lags measured, a ring starting at next once full
+	next    int
+	last    int64 //the last lag measured on this connection, 0 before the first
+	closes  int   //calls to Close, so that reconnect knows when to give up
+}
+
+func newKeepalive(conf KeepaliveConfig) keepalive {
+	if conf.Interval <= 0 {
+		conf.Interval = defKeepalive.Interval
+	}
+	if conf.Timeout <= conf.Interval {
+		conf.Timeout = 2 * conf.Interval
+	}
+	if conf.History <= 0 {
+		conf.History = defKeepalive.History
+	}
+	conf.Thresholds = append([]int64{}, conf.Thresholds...)
+	return keepalive{conf, make([]int64, 0, conf.History), 0, 0, 0}
+}
+
+//reset forgets the lags measured on the previous connection
+func (k *keepalive) reset() {
+	k.samples, k.next, k.last = k.samples[:0], 0, 0
+}
+
+//add records a lag measure, returning the thresholds it crossed
+func (k *keepalive) add(lag int64) []*LagEvent {
+	if len(k.samples) < cap(k.samples) {
+		k.samples = append(k.samples, lag)
+	} else {
+		k.samples[k.next] = lag
+		k.next = (k.next + 1) % len(k.samples)
+	}
+	events := make([]*LagEvent, 0)
+	for _, t := range k.conf.Thresholds {
+		if above := lag > t; above != (k.last > t) {
+			events = append(events, &LagEvent{lag, t, above, false})
+		}
+	}
+	k.last = lag
+	return events
+}
+
+//SetKeepalive sets how the connection is checked, from the next connection on. A zero
+//Interval or History gets the default, a Timeout not above Interval is made twice Interval.
+func (n *Network) SetKeepalive(conf KeepaliveConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	closes := n.keepalive.closes
+	n.keepalive = newKeepalive(conf)
+	n.keepalive.closes = closes
+}
+
+func (n *Network) Keepalive() KeepaliveConfig {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	conf := n.keepalive.conf
+	conf.Thresholds = append([]int64{}, conf.Thresholds...)
+	return conf
+}
+
+//LagStats returns the lowest, average and highest of the last lags measured, and how many
+//there were
+func (n *Network) LagStats() (min, avg, max int64, count int) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for i, lag := range n.keepalive.samples {
+		if i == 0 || lag < min {
+			min = lag
+		}
+		if lag > max {
+			max = lag
+		}
+		avg += lag
+	}
+	if count = len(n.keepalive.samples); count > 0 {
+		avg /= int64(count)
+	}
+	return
+}
+
+func (n *Network) lagEvent(e *LagEvent) {
+	select {
+	case n.LagEvents <- e:
+	default:
+		n.l.Printf("Dropping lag event: nobody is listening")
+	}
+}
+
+//pinger PINGs the server when it has been quiet for the keepalive interval, and every 15
+//minutes anyway to measure the lag. When nothing at all was received for the keepalive
+//timeout, the connection is dead: it is closed, and replaced if the keepalive says so.
+func (n *Network) pinger() {
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("pinger", exch)
+	if err != nil {
+		return
+	}
+	defer close(done)
+	conf := n.Keepalive()
+	ticker := time.NewTicker(conf.Interval / 4)
+	defer ticker.Stop()
+	received := make(chan *IrcMessage, 10)
+	n.Listen.regInternal("*", "keepalive", received) //ignored users are data too
+	defer n.Listen.DelListener("*", "keepalive")
+	lastData := time.Nanoseconds()
+	lastPing, token := lastData, "" //token is the parameter of the PING waiting for its PONG
+	for {
+		select {
+		case msg := <-received:
+			lastData = time.Nanoseconds()
+			if msg != nil && msg.Cmd == "PONG" && token != "" && len(msg.Params) > 0 && msg.Params[len(msg.Params)-1] == token {
+				n.setLag(lastData - lastPing)
+				token = ""
+			}
+		case <-ticker.C:
+			now := time.Nanoseconds()
+			if idle := now - lastData; idle >= conf.Timeout {
+				n.l.Printf("Ping timeout: nothing received for %d seconds", idle/second)
+				n.lagEvent(&LagEvent{idle, conf.Timeout, true, true})
+				if conf.Reconnect {
+					go n.reconnect("Ping timeout")
+				} else {
+					n.connError("Ping timeout")
+				}
+				return
+			} else if (token == "" || now-lastPing >= conf.Timeout) && (idle >= conf.Interval || now-lastPing >= 15*minute) {
+				lastPing, token = now, strconv.Itoa64(now)
+				select {
+				case n.queueOut <- &IrcMessage{"", "PING", []string{token}, nil}:
+				default:
+				}
+			}
+		case exit := <-exch:
+			if exit {
+				return
+			}
+			continue
+		}
+	}
+	return
+}
+
+//reconnect replaces a dead connection, trying again less and less often until it works,
+//the network gets connected otherwise, or Close is called
+func (n *Network) reconnect(reason string) {
+	n.lock.RLock()
+	closes := n.keepalive.closes
+	n.lock.RUnlock()
+	if err := n.quit(reason, closeTimeout); err != nil {
+		n.l.Println(err.String())
+	}
+	for delay := int64(second); ; delay *= 2 {
+		err := n.connect(closes) //fails once Close was called, or someone else connected
+		if err == nil || err == errClosed || err == ErrNotDisconnected {
+			return
+		}
+		if delay > 5*minute {
+			delay = 5 * minute
+		}
+		n.l.Printf("Reconnection failed, next try in %d seconds: %s", delay/second, err.String())
+		time.Sleep(delay)
+	}
+}
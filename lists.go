@@ -0,0 +1,185 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"strconv"
+)
+
+//ban mask styles for Ban and Unban
+const (
+	MaskHost      = iota // *!*@host
+	MaskIdent            // *!ident@*
+	MaskIdentHost        // *!ident@host
+	MaskNick             // nick!*@*
+)
+
+//an entry of a channel list mode (bans, exceptions, invite exceptions, quiets)
+type ListEntry struct {
+	Mask  string
+	SetBy string
+	SetAt int64 //seconds since the epoch, 0 if the server didn't tell
+}
+
+//list replies: entry and end of list numerics for each list mode
+var listReplies = map[byte][]string{
+	'b': []string{"RPL_BANLIST", "RPL_ENDOFBANLIST"},
+	'e': []string{"RPL_EXCEPTLIST", "RPL_ENDOFEXCEPTLIST"},
+	'I': []string{"RPL_INVITELIST", "RPL_ENDOFINVITELIST"},
+	'q': []string{"RPL_QUIETLIST", "RPL_ENDOFQUIETLIST"},
+}
+
+func (n *Network) listMode(ch string, mode byte) ([]ListEntry, os.Error) {
+	ret := make([]ListEntry, 0)
+	spec := n.ModeSpec(ch)
+	r, ok := listReplies[mode]
+	if !ok || !spec.IsList(mode) || strings.IndexRune(spec.Prefix, int(mode)) > -1 {
+		return ret, os.NewError(fmt.Sprintf("List mode %c is not supported", mode))
+	}
+	rpl, end := r[0], r[1]
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOSUCHCHANNEL",
+		"ERR_NOTONCHANNEL", "ERR_CHANOPRIVSNEEDED",
+		rpl, end}
+	done := func(m *IrcMessage) bool {
+		return m.Cmd == replies[end]
+	}
+	msgs, err := n.query(&IrcMessage{"", "MODE", []string{ch, fmt.Sprintf("+%c", mode)}, nil}, myreplies, paramIs(1, ch), done)
+	if err != nil {
+		return ret, err
+	}
+	for _, m := range msgs {
+		if m.Cmd != replies[rpl] {
+			continue
+		}
+		params := m.Params[2:] //me chan [mode] mask [setter time]
+		if m.Cmd == replies["RPL_QUIETLIST"] && len(params) > 1 && params[0] == "q" {
+			params = params[1:]
+		}
+		if len(params) == 0 {
+			continue
+		}
+		e := ListEntry{Mask: params[0]}
+		if len(params) > 2 {
+			e.SetBy = params[1]
+			e.SetAt, _ = strconv.Atoi64(params[2])
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+//Bans returns the ban list of ch
+func (n *Network) Bans(ch string) ([]ListEntry, os.Error) {
+	return n.listMode(ch, 'b')
+}
+
+//BanExceptions returns the ban exception list (+e) of ch
+func (n *Network) BanExceptions(ch string) ([]ListEntry, os.Error) {
+	return n.listMode(ch, 'e')
+}
+
+//InviteExceptions returns the invite exception list (+I) of ch
+func (n *Network) InviteExceptions(ch string) ([]ListEntry, os.Error) {
+	return n.listMode(ch, 'I')
+}
+
+//Quiets returns the quiet list (+q) of ch on servers where q is a list mode rather than a prefix
+func (n *Network) Quiets(ch string) ([]ListEntry, os.Error) {
+	return n.listMode(ch, 'q')
+}
+
+//maxList returns the modes sharing a MAXLIST limit with mode, and the limit (0 if unknown)
+func (n *Network) maxList(mode byte) (string, int) {
+	val, ok := n.ISupport("MAXLIST") //e.g. beI:100,q:50
+	if !ok {
+		if max := n.isupportInt("MAXBANS", 0); max > 0 && mode == 'b' {
+			return "b", max
+		}
+		return string(mode), 0
+	}
+	for _, lim := range strings.Split(val, ",", -1) {
+		i := strings.Index(lim, ":")
+		if i < 0 || strings.IndexRune(lim[:i], int(mode)) < 0 {
+			continue
+		}
+		max, err := strconv.Atoi(lim[i+1:])
+		if err != nil {
+			return string(mode), 0
+		}
+		return lim[:i], max
+	}
+	return string(mode), 0
+}
+
+//BanMask builds a ban mask for nick in the given style from what we know about the user,
+//asking the server with WHOIS if nick isn't on our channels
+func (n *Network) BanMask(nick string, style int) (string, os.Error) {
+	usr, ok := n.LookupUser(nick)
+	if !ok {
+		whois, err := n.Whois([]string{nick}, "")
+		if err != nil {
+			return "", err
+		}
+		for _, line := range whois[replies["RPL_WHOISUSER"]] { //me nick user host * realname
+			if fields := strings.Fields(line); len(fields) > 3 && n.EqualFold(fields[1], nick) {
+				usr, ok = User{Nick: fields[1], User: fields[2], Host: fields[3]}, true
+			}
+		}
+		if !ok {
+			return "", os.NewError(fmt.Sprintf("Couldn't find user and host of %s", nick))
+		}
+	}
+	ident := usr.User
+	if strings.HasPrefix(ident, "~") { //no identd, anybody on that host can pick the same user name
+		ident = "*" + ident[1:]
+	}
+	h := Hostmask{"*", "*", "*"}
+	switch style {
+	case MaskHost:
+		h.Host = usr.Host
+	case MaskIdent:
+		h.User = ident
+	case MaskIdentHost:
+		h.User, h.Host = ident, usr.Host
+	case MaskNick:
+		h.Nick = usr.Nick
+	default:
+		return "", os.NewError(fmt.Sprintf("Unknown ban mask style %d", style))
+	}
+	return h.String(), nil
+}
+
+//Ban bans nick from ch with a mask in the given style and returns the mask.
+//The ban is refused if the channel lists sharing the MAXLIST limit with +b are full.
+func (n *Network) Ban(ch, nick string, style int) (string, os.Error) {
+	mask, err := n.BanMask(nick, style)
+	if err != nil {
+		return "", err
+	}
+	if modes, max := n.maxList('b'); max > 0 {
+		count := 0
+		for i := 0; i < len(modes); i++ {
+			l, err := n.listMode(ch, modes[i])
+			if err != nil && modes[i] == 'b' {
+				return mask, err
+			}
+			count += len(l)
+		}
+		if count >= max {
+			return mask, os.NewError(fmt.Sprintf("Channel lists %s of %s are full (MAXLIST %d)", modes, ch, max))
+		}
+	}
+	_, err = n.Mode(ch, []ModeChange{{true, 'b', mask}})
+	return mask, err
+}
+
+//Unban removes the ban on nick built in the given style and returns the mask
+func (n *Network) Unban(ch, nick string, style int) (string, os.Error) {
+	mask, err := n.BanMask(nick, style)
+	if err != nil {
+		return "", err
+	}
+	_, err = n.Mode(ch, []ModeChange{{false, 'b', mask}})
+	return mask, err
+}
@@ -5,18 +5,48 @@ import (
 	"strings"
 	"bytes"
 	"fmt"
+	"utf8"
 )
 
 type IrcMessage struct {
 	Prefix string
 	Cmd    string
 	Params []string
+	Tags   map[string]string //IRCv3 message tags, nil if there are none
+}
+
+//tag values escape the characters that separate tags and params
+var tagEscapes = map[byte]byte{';': ':', ' ': 's', '\\': '\\', '\r': 'r', '\n': 'n'}
+
+//parseTags parses the tags part of a message, without the leading @
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";", -1) {
+		if tag == "" {
+			continue
+		}
+		kv := strings.Split(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+		} else {
+			tags[kv[0]] = dequote(kv[1], '\\', tagEscapes)
+		}
+	}
+	return tags
 }
 
 
 func PackMsg(msg string) (IrcMessage, os.Error) { //TODO: this needs work?
 	var ret IrcMessage
 	err := "Errors encountered during message packing: "
+	if strings.HasPrefix(msg, "@") {
+		if i := strings.Index(msg, " "); i > -1 {
+			ret.Tags = parseTags(msg[1:i])
+			msg = strings.TrimLeft(msg[i+1:], " ")
+		} else {
+			err += "Malformed tags, "
+		}
+	}
 	if strings.HasPrefix(msg, ":") {
 		if i := strings.Index(msg, " "); i > -1 {
 			ret.Prefix = msg[1:i]
@@ -69,18 +99,27 @@ func (m *IrcMessage) String() string {
 	if msg.Len() > 510 {
 		return ""
 	}
+	if len(m.Tags) > 0 { //tags have their own length limit
+		tags := make([]string, 0, len(m.Tags))
+		for k, v := range m.Tags {
+			if v != "" {
+				k += "=" + quote(v, '\\', tagEscapes)
+			}
+			tags = append(tags, k)
+		}
+		return "@" + strings.Join(tags, ";") + " " + msg.String()
+	}
 	return msg.String()
 }
 
+//Origin returns the nick of the user who sent m, or the server name, or "" if m has no prefix
 func (m *IrcMessage) Origin() string {
-	if m.Prefix != "" {
-		return m.Prefix
-	} else {
-		if m.Cmd == "PRIVMSG" {
-			return m.Params[0]
-		}
-	}
-	return ""
+	return m.Hostmask().Name()
+}
+
+//Hostmask returns the parsed prefix of m
+func (m *IrcMessage) Hostmask() Hostmask {
+	return ParseHostmask(m.Prefix)
 }
 
 func (m *IrcMessage) Destination() string {
@@ -96,3 +135,46 @@ func (m *IrcMessage) Payload() string {
 	}
 	return ""
 }
+
+//Action returns the text of a CTCP ACTION (/me) and whether m is one. Payload keeps the CTCP framing.
+func (m *IrcMessage) Action() (string, bool) {
+	if m.Cmd != "PRIVMSG" || len(m.Params) < 2 {
+		return "", false
+	}
+	verb, args, ok := ParseCtcp(m.Params[1])
+	if !ok || verb != "ACTION" {
+		return "", false
+	}
+	return args, true
+}
+
+func (m *IrcMessage) IsAction() bool {
+	_, ok := m.Action()
+	return ok
+}
+
+//splitText cuts text in pieces of at most max bytes, preferably at spaces and never inside a utf-8 character
+func splitText(text string, max int) []string {
+	ret := make([]string, 0)
+	if max < 1 {
+		max = 1
+	}
+	for len(text) > max {
+		i := max
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		if sp := strings.LastIndex(text[:i], " "); sp > max/2 {
+			i = sp
+		}
+		if i == 0 {
+			i = max
+		}
+		ret = append(ret, text[:i])
+		text = strings.TrimLeft(text[i:], " ")
+	}
+	if len(text) > 0 || len(ret) == 0 {
+		ret = append(ret, text)
+	}
+	return ret
+}
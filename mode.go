@@ -0,0 +1,278 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"bytes"
+)
+
+const (
+	defChanModes = "b,k,l,imnpst" //rfc1459
+	defPrefix    = "(ov)@+"
+	defChanTypes = "#&+!"
+	defModes     = 3
+)
+
+type ModeChange struct {
+	Add  bool
+	Mode byte
+	Arg  string
+}
+
+func (c ModeChange) String() string {
+	sign := "-"
+	if c.Add {
+		sign = "+"
+	}
+	if c.Arg == "" {
+		return fmt.Sprintf("%s%c", sign, c.Mode)
+	}
+	return fmt.Sprintf("%s%c %s", sign, c.Mode, c.Arg)
+}
+
+//ModeSpec tells which modes take an argument, see CHANMODES and PREFIX in RPL_ISUPPORT
+type ModeSpec struct {
+	List       string //type A: lists (bans...), always take an argument
+	Arg        string //type B: always take an argument (key)
+	SetArg     string //type C: take an argument only when set (limit)
+	Flag       string //type D: never take an argument
+	Prefix     string //membership modes (ov), always take a nick
+	PrefixSyms string //the corresponding nick prefixes (@+)
+	user       bool   //user modes: anything unknown is a flag
+}
+
+//NewModeSpec builds a ModeSpec from the values of the CHANMODES and PREFIX tokens
+func NewModeSpec(chanmodes, prefix string) *ModeSpec {
+	s := new(ModeSpec)
+	types := strings.Split(chanmodes, ",", -1)
+	for i, t := range types {
+		switch i {
+		case 0:
+			s.List = t
+		case 1:
+			s.Arg = t
+		case 2:
+			s.SetArg = t
+		case 3:
+			s.Flag = t
+		}
+	}
+	if strings.HasPrefix(prefix, "(") {
+		if i := strings.Index(prefix, ")"); i > -1 {
+			s.Prefix = prefix[1:i]
+			s.PrefixSyms = prefix[i+1:]
+		}
+	}
+	return s
+}
+
+var userModeSpec = &ModeSpec{user: true}
+
+//takesArg reports whether mode takes an argument when added (or removed) and whether the mode is known at all
+func (s *ModeSpec) takesArg(mode byte, add bool) (arg bool, known bool) {
+	switch {
+	case strings.IndexRune(s.List, int(mode)) > -1,
+		strings.IndexRune(s.Arg, int(mode)) > -1,
+		strings.IndexRune(s.Prefix, int(mode)) > -1:
+		return true, true
+	case strings.IndexRune(s.SetArg, int(mode)) > -1:
+		return add, true
+	case strings.IndexRune(s.Flag, int(mode)) > -1:
+		return false, true
+	}
+	return false, s.user
+}
+
+//IsList reports whether mode is a list mode (type A), such as b
+func (s *ModeSpec) IsList(mode byte) bool {
+	return strings.IndexRune(s.List, int(mode)) > -1
+}
+
+//Parse turns mode parameters as found in a MODE message ("+ov-b", "nick1", "nick2", "mask")
+//into a list of changes. List modes without an argument are list queries and get an empty Arg.
+func (s *ModeSpec) Parse(params []string) ([]ModeChange, os.Error) {
+	ret := make([]ModeChange, 0)
+	args := make([]string, 0)
+	modestrs := make([]string, 0)
+	for i, p := range params { //extra "+x"/"-x" strings may be interleaved with arguments
+		if i == 0 || (len(p) > 0 && (p[0] == '+' || p[0] == '-') && len(args) == 0) {
+			modestrs = append(modestrs, p)
+		} else {
+			args = append(args, p)
+		}
+	}
+	add := true
+	for _, modes := range modestrs {
+		for i := 0; i < len(modes); i++ {
+			switch modes[i] {
+			case '+':
+				add = true
+				continue
+			case '-':
+				add = false
+				continue
+			}
+			c := ModeChange{add, modes[i], ""}
+			arg, known := s.takesArg(modes[i], add)
+			if !known {
+				return ret, os.NewError(fmt.Sprintf("Unknown mode %c", modes[i]))
+			}
+			if arg {
+				if len(args) > 0 {
+					c.Arg = args[0]
+					args = args[1:]
+				} else if !s.IsList(modes[i]) {
+					return ret, os.NewError(fmt.Sprintf("Missing argument for mode %c", modes[i]))
+				}
+			}
+			ret = append(ret, c)
+		}
+	}
+	if len(args) > 0 {
+		return ret, os.NewError(fmt.Sprintf("Too many mode arguments: %s", strings.Join(args, " ")))
+	}
+	return ret, nil
+}
+
+//Format serializes changes into batches of MODE parameters carrying at most max modes each
+func (s *ModeSpec) Format(changes []ModeChange, max int) [][]string {
+	if max <= 0 {
+		max = defModes
+	}
+	ret := make([][]string, 0)
+	for len(changes) > 0 {
+		modes := bytes.NewBufferString("")
+		args := make([]string, 0)
+		sign := byte(0)
+		length := 0
+		i := 0
+		for ; i < len(changes) && i < max; i++ {
+			c := changes[i]
+			if i > 0 && length+len(c.Arg)+3 > 400 { //keep clear of the 512 byte line limit
+				break
+			}
+			if c.Add && sign != '+' {
+				sign = '+'
+				modes.WriteByte(sign)
+			} else if !c.Add && sign != '-' {
+				sign = '-'
+				modes.WriteByte(sign)
+			}
+			modes.WriteByte(c.Mode)
+			if c.Arg != "" {
+				args = append(args, c.Arg)
+			}
+			length += len(c.Arg) + 3
+		}
+		ret = append(ret, append([]string{modes.String()}, args...))
+		changes = changes[i:]
+	}
+	return ret
+}
+
+//IsChannel reports whether target is a channel name according to the server's CHANTYPES
+func (n *Network) IsChannel(target string) bool {
+	types, ok := n.ISupport("CHANTYPES")
+	if !ok {
+		types = defChanTypes
+	}
+	return len(target) > 0 && strings.IndexRune(types, int(target[0])) > -1
+}
+
+//ModeSpec returns the mode description for target: channel modes as advertised by the server, or user modes
+func (n *Network) ModeSpec(target string) *ModeSpec {
+	if !n.IsChannel(target) {
+		return userModeSpec
+	}
+	chanmodes, ok := n.ISupport("CHANMODES")
+	if !ok {
+		chanmodes = defChanModes
+	}
+	prefix, ok := n.ISupport("PREFIX")
+	if !ok {
+		prefix = defPrefix
+	}
+	return NewModeSpec(chanmodes, prefix)
+}
+
+//ParseModes parses mode parameters for target, e.g. ParseModes("#chan", []string{"+ov-b", "nick1", "nick2", "mask"})
+func (n *Network) ParseModes(target string, params []string) ([]ModeChange, os.Error) {
+	if len(params) == 0 {
+		return []ModeChange{}, nil
+	}
+	return n.ModeSpec(target).Parse(params)
+}
+
+//ParseModeMsg interprets an incoming MODE message, or an RPL_CHANNELMODEIS/RPL_UMODEIS reply
+func (n *Network) ParseModeMsg(msg *IrcMessage) (string, []ModeChange, os.Error) {
+	params := msg.Params
+	switch msg.Cmd {
+	case "MODE":
+	case replies["RPL_CHANNELMODEIS"]:
+		if len(params) > 0 {
+			params = params[1:]
+		}
+	case replies["RPL_UMODEIS"]:
+	default:
+		return "", nil, os.NewError(fmt.Sprintf("Not a mode message: %s", msg.Cmd))
+	}
+	if len(params) < 2 {
+		return "", nil, os.NewError(fmt.Sprintf("Not enough parameters in mode message: %s", msg.String()))
+	}
+	changes, err := n.ParseModes(params[0], params[1:])
+	return params[0], changes, err
+}
+
+//Mode applies changes to target (channel or nick) and returns the changes confirmed by the server.
+//Changes are split into several MODE messages according to the server's MODES limit.
+//With no changes, Mode returns the current modes of target (RPL_CHANNELMODEIS or RPL_UMODEIS).
+func (n *Network) Mode(target string, changes []ModeChange) ([]ModeChange, os.Error) {
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_CHANOPRIVSNEEDED",
+		"ERR_NOSUCHNICK", "ERR_NOTONCHANNEL",
+		"ERR_KEYSET", "ERR_UNKNOWNMODE",
+		"ERR_NOSUCHCHANNEL", "ERR_USERNOTINCHANNEL",
+		"ERR_USERSDONTMATCH", "ERR_UMODEUNKNOWNFLAG",
+		"ERR_BANLISTFULL"}
+	spec := n.ModeSpec(target)
+	ret := make([]ModeChange, 0)
+	if len(changes) == 0 {
+		myreplies = append(myreplies, "RPL_CHANNELMODEIS", "RPL_UMODEIS")
+		match := func(m *IrcMessage) bool {
+			return m.Cmd != replies["RPL_CHANNELMODEIS"] || paramIs(1, target)(m)
+		}
+		msgs, err := n.query(&IrcMessage{"", "MODE", []string{target}, nil}, myreplies, match, nil)
+		if err != nil {
+			return ret, err
+		}
+		_, modes, err := n.ParseModeMsg(msgs[len(msgs)-1])
+		return modes, err
+	}
+	for _, c := range changes {
+		arg, known := spec.takesArg(c.Mode, c.Add)
+		if !known {
+			return ret, os.NewError(fmt.Sprintf("Unknown mode %c for %s", c.Mode, target))
+		}
+		if arg && c.Arg == "" && !spec.IsList(c.Mode) {
+			return ret, os.NewError(fmt.Sprintf("Missing argument for mode %c", c.Mode))
+		}
+	}
+	myreplies = append(myreplies, "MODE")
+	match := func(m *IrcMessage) bool {
+		return m.Cmd != "MODE" || paramIs(0, target)(m)
+	}
+	for _, batch := range spec.Format(changes, n.isupportInt("MODES", defModes)) {
+		msgs, err := n.query(&IrcMessage{"", "MODE", append([]string{target}, batch...), nil}, myreplies, match, nil)
+		if err == ErrTimeout { //nothing changed (modes already set), or list query
+			continue
+		} else if err != nil {
+			return ret, err
+		}
+		applied, err := spec.Parse(msgs[len(msgs)-1].Params[1:])
+		ret = append(ret, applied...)
+		if err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,386 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"strconv"
+	"time"
+)
+
+//targetless matches the replies of oper commands, which only tell about us: while the
+//opers lock is held, they can only be ours
+func targetless(m *IrcMessage) bool {
+	return len(m.Params) < 3
+}
+
+//Oper asks for operator privileges and waits for RPL_YOUREOPER
+func (n *Network) Oper(user, pass string) os.Error {
+	n.opers.Lock()
+	defer n.opers.Unlock()
+	myreplies := []string{"ERR_NEEDMOREPARAMS", "ERR_NOOPERHOST",
+		"ERR_PASSWDMISMATCH", "RPL_YOUREOPER"}
+	_, err := n.query(&IrcMessage{"", "OPER", []string{user, pass}, nil}, myreplies, targetless, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive oper reply")
+	}
+	return err
+}
+
+//operCommand sends an operator command that has no positive reply, followed by a PING:
+//getting its PONG before any error means success
+func (n *Network) operCommand(msg *IrcMessage, myreplies ...string) os.Error {
+	n.opers.Lock()
+	defer n.opers.Unlock()
+	myreplies = append(myreplies, "ERR_NEEDMOREPARAMS", "ERR_NOPRIVILEGES", "PONG")
+	token := "oper" + strconv.Itoa64(time.Nanoseconds())
+	match := func(m *IrcMessage) bool {
+		if m.Cmd == "PONG" {
+			return len(m.Params) > 0 && m.Params[len(m.Params)-1] == token
+		}
+		return targetless(m)
+	}
+	_, err := n.queryAll([]*IrcMessage{msg, &IrcMessage{"", "PING", []string{token}, nil}}, myreplies, match, nil)
+	return err
+}
+
+//Kill disconnects nick from the network
+func (n *Network) Kill(nick, reason string) os.Error {
+	return n.operCommand(&IrcMessage{"", "KILL", []string{nick, reason}, nil}, "ERR_NOSUCHNICK", "ERR_CANTKILLSERVER")
+}
+
+func (n *Network) Wallops(text string) os.Error {
+	return n.operCommand(&IrcMessage{"", "WALLOPS", []string{text}, nil})
+}
+
+//Rehash makes the server reread its configuration and waits for RPL_REHASHING
+func (n *Network) Rehash() os.Error {
+	n.opers.Lock()
+	defer n.opers.Unlock()
+	myreplies := []string{"ERR_NOPRIVILEGES", "RPL_REHASHING"}
+	match := func(m *IrcMessage) bool {
+		return m.Cmd == replies["RPL_REHASHING"] || targetless(m)
+	}
+	_, err := n.query(&IrcMessage{"", "REHASH", []string{}, nil}, myreplies, match, nil)
+	if err == ErrTimeout {
+		return os.NewError("Didn't receive rehash reply")
+	}
+	return err
+}
+
+//Die shuts the server down. The connection is lost if it succeeds, before the PONG that
+//confirms it: ErrTimeout is then the expected outcome.
+func (n *Network) Die() os.Error {
+	return n.operCommand(&IrcMessage{"", "DIE", []string{}, nil})
+}
+
+//Restart restarts the server. As with Die, success loses the connection and gives ErrTimeout.
+func (n *Network) Restart() os.Error {
+	return n.operCommand(&IrcMessage{"", "RESTART", []string{}, nil})
+}
+
+//Squit breaks the link to server
+func (n *Network) Squit(server, comment string) os.Error {
+	return n.operCommand(&IrcMessage{"", "SQUIT", []string{server, comment}, nil}, "ERR_NOSUCHSERVER")
+}
+
+//ConnectServer makes remote (or our server if remote is empty) connect to target
+func (n *Network) ConnectServer(target string, port int, remote string) os.Error {
+	msg := &IrcMessage{"", "CONNECT", []string{target, strconv.Itoa(port)}, nil}
+	if remote != "" {
+		msg.Params = append(msg.Params, remote)
+	}
+	return n.operCommand(msg, "ERR_NOSUCHSERVER")
+}
+
+//numbers extracts the integers from a human readable reply ("There are 3 users and 2 invisible...")
+func numbers(s string) []int {
+	ret := make([]int, 0)
+	for _, f := range strings.Fields(s) {
+		if i, err := strconv.Atoi(strings.TrimRight(f, ",.:")); err == nil {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+//serverQuery sends msg to target (if any) and collects myreplies until end is received
+func (n *Network) serverQuery(msg *IrcMessage, target string, myreplies []string, end string) ([]*IrcMessage, os.Error) {
+	if target != "" {
+		msg.Params = append(msg.Params, target)
+	}
+	myreplies = append(myreplies, "ERR_NOSUCHSERVER", end)
+	done := func(m *IrcMessage) bool {
+		return m.Cmd == replies[end]
+	}
+	return n.query(msg, myreplies, nil, done)
+}
+
+type StatsLine struct {
+	Reply  string   //symbolic name of the numeric, e.g. RPL_STATSLINKINFO
+	Fields []string //parameters after our nick
+}
+
+type StatsLink struct {
+	Name             string
+	SendQ            int
+	SentMsgs, SentKB int
+	RecvMsgs, RecvKB int
+	TimeOpen         int64 //seconds
+}
+
+type Stats struct {
+	Query    string
+	Lines    []StatsLine
+	Links    []StatsLink    //STATS l
+	Commands map[string]int //STATS m: command usage counts
+	Uptime   int64          //STATS u: seconds
+}
+
+//Stats runs the STATS query on server (ours if empty)
+func (n *Network) Stats(query, server string) (*Stats, os.Error) {
+	n.opers.Lock() //ERR_NOPRIVILEGES has no target
+	defer n.opers.Unlock()
+	myreplies := []string{"ERR_NOPRIVILEGES"}
+	for key, _ := range replies {
+		if strings.HasPrefix(key, "RPL_STATS") {
+			myreplies = append(myreplies, key)
+		}
+	}
+	ret := &Stats{query, make([]StatsLine, 0), make([]StatsLink, 0), make(map[string]int), 0}
+	msgs, err := n.serverQuery(&IrcMessage{"", "STATS", []string{query}, nil}, server, myreplies, "RPL_ENDOFSTATS")
+	if err != nil {
+		return ret, err
+	}
+	for _, m := range msgs {
+		if m.Cmd == replies["RPL_ENDOFSTATS"] || len(m.Params) < 2 {
+			continue
+		}
+		f := m.Params[1:]
+		ret.Lines = append(ret.Lines, StatsLine{replyName(m.Cmd), f})
+		switch m.Cmd {
+		case replies["RPL_STATSLINKINFO"]: //linkname sendq sentmsgs sentkb recvmsgs recvkb timeopen
+			if len(f) > 6 {
+				l := StatsLink{Name: f[0]}
+				l.SendQ, _ = strconv.Atoi(f[1])
+				l.SentMsgs, _ = strconv.Atoi(f[2])
+				l.SentKB, _ = strconv.Atoi(f[3])
+				l.RecvMsgs, _ = strconv.Atoi(f[4])
+				l.RecvKB, _ = strconv.Atoi(f[5])
+				l.TimeOpen, _ = strconv.Atoi64(f[6])
+				ret.Links = append(ret.Links, l)
+			}
+		case replies["RPL_STATSCOMMANDS"]: //command count ...
+			if len(f) > 1 {
+				ret.Commands[f[0]], _ = strconv.Atoi(f[1])
+			}
+		case replies["RPL_STATSUPTIME"]: //Server Up 3 days 12:34:56
+			nums := numbers(strings.Replace(f[0], ":", " ", -1))
+			if len(nums) == 4 {
+				ret.Uptime = int64(((nums[0]*24+nums[1])*60+nums[2])*60 + nums[3])
+			}
+		}
+	}
+	return ret, nil
+}
+
+type TraceLine struct {
+	Reply  string //symbolic name of the numeric, e.g. RPL_TRACEUSER
+	Class  string //Link, Try., H.S., ????, Oper, User, Serv...
+	Fields []string
+}
+
+//Trace follows the route to target (our server if empty)
+func (n *Network) Trace(target string) ([]TraceLine, os.Error) {
+	myreplies := []string{}
+	for key, _ := range replies {
+		if strings.HasPrefix(key, "RPL_TRACE") && key != "RPL_TRACEEND" {
+			myreplies = append(myreplies, key)
+		}
+	}
+	ret := make([]TraceLine, 0)
+	msgs, err := n.serverQuery(&IrcMessage{"", "TRACE", []string{}, nil}, target, myreplies, "RPL_TRACEEND")
+	if err == ErrTimeout && len(msgs) > 0 { //RPL_TRACEEND is not sent by older servers
+		err = nil
+	}
+	for _, m := range msgs {
+		if m.Cmd == replies["RPL_TRACEEND"] || len(m.Params) < 2 {
+			continue
+		}
+		ret = append(ret, TraceLine{replyName(m.Cmd), m.Params[1], m.Params[2:]})
+	}
+	return ret, err
+}
+
+type Link struct {
+	Mask   string
+	Server string
+	Hops   int
+	Info   string
+}
+
+//Links lists the servers matching mask (all if empty)
+func (n *Network) Links(mask string) ([]Link, os.Error) {
+	msg := &IrcMessage{"", "LINKS", []string{}, nil}
+	if mask != "" {
+		msg.Params = append(msg.Params, mask)
+	}
+	ret := make([]Link, 0)
+	msgs, err := n.serverQuery(msg, "", []string{"RPL_LINKS"}, "RPL_ENDOFLINKS")
+	for _, m := range msgs {
+		if m.Cmd != replies["RPL_LINKS"] || len(m.Params) < 4 { //me mask server :hops info
+			continue
+		}
+		l := Link{Mask: m.Params[1], Server: m.Params[2]}
+		info := strings.Split(m.Params[3], " ", 2)
+		l.Hops, _ = strconv.Atoi(info[0])
+		if len(info) > 1 {
+			l.Info = info[1]
+		}
+		ret = append(ret, l)
+	}
+	return ret, err
+}
+
+type AdminInfo struct {
+	Server string
+	Loc1   string
+	Loc2   string
+	Email  string
+}
+
+//Admin returns the administrative info of target (our server if empty)
+func (n *Network) Admin(target string) (*AdminInfo, os.Error) {
+	myreplies := []string{"ERR_NOADMININFO", "RPL_ADMINME", "RPL_ADMINLOC1", "RPL_ADMINLOC2"}
+	ret := new(AdminInfo)
+	msgs, err := n.serverQuery(&IrcMessage{"", "ADMIN", []string{}, nil}, target, myreplies, "RPL_ADMINEMAIL")
+	for _, m := range msgs {
+		if len(m.Params) < 2 {
+			continue
+		}
+		switch m.Cmd {
+		case replies["RPL_ADMINME"]:
+			ret.Server = m.Params[1]
+		case replies["RPL_ADMINLOC1"]:
+			ret.Loc1 = m.Params[1]
+		case replies["RPL_ADMINLOC2"]:
+			ret.Loc2 = m.Params[1]
+		case replies["RPL_ADMINEMAIL"]:
+			ret.Email = m.Params[1]
+		}
+	}
+	return ret, err
+}
+
+//text collects the last parameter of every reply of type rpl
+func text(msgs []*IrcMessage, rpl string) []string {
+	ret := make([]string, 0)
+	for _, m := range msgs {
+		if m.Cmd == replies[rpl] && len(m.Params) > 1 {
+			ret = append(ret, m.Params[len(m.Params)-1])
+		}
+	}
+	return ret
+}
+
+//Info returns the server's INFO text
+func (n *Network) Info(target string) ([]string, os.Error) {
+	msgs, err := n.serverQuery(&IrcMessage{"", "INFO", []string{}, nil}, target, []string{"RPL_INFO"}, "RPL_ENDOFINFO")
+	return text(msgs, "RPL_INFO"), err
+}
+
+//Motd returns the message of the day of target (our server if empty)
+func (n *Network) Motd(target string) ([]string, os.Error) {
+	myreplies := []string{"ERR_NOMOTD", "RPL_MOTDSTART", "RPL_MOTD"}
+	msgs, err := n.serverQuery(&IrcMessage{"", "MOTD", []string{}, nil}, target, myreplies, "RPL_ENDOFMOTD")
+	ret := text(msgs, "RPL_MOTD")
+	for i, l := range ret {
+		ret[i] = strings.TrimLeft(strings.TrimLeft(l, "-"), " ")
+	}
+	return ret, err
+}
+
+//Time returns the local time of target (our server if empty) as the server formats it
+func (n *Network) Time(target string) (server, t string, err os.Error) {
+	msgs, err := n.serverQuery(&IrcMessage{"", "TIME", []string{}, nil}, target, []string{}, "RPL_TIME")
+	if err != nil {
+		return "", "", err
+	}
+	m := msgs[len(msgs)-1]
+	if len(m.Params) < 3 {
+		return "", "", os.NewError(fmt.Sprintf("Malformed time reply: %s", m.String()))
+	}
+	return m.Params[1], m.Params[len(m.Params)-1], nil
+}
+
+type ServerVersion struct {
+	Version  string
+	Server   string
+	Comments string
+}
+
+//ServerVersion returns the software version of target (our server if empty)
+func (n *Network) ServerVersion(target string) (*ServerVersion, os.Error) {
+	msgs, err := n.serverQuery(&IrcMessage{"", "VERSION", []string{}, nil}, target, []string{}, "RPL_VERSION")
+	if err != nil {
+		return nil, err
+	}
+	m := msgs[len(msgs)-1]
+	if len(m.Params) < 3 {
+		return nil, os.NewError(fmt.Sprintf("Malformed version reply: %s", m.String()))
+	}
+	ret := &ServerVersion{Version: m.Params[1], Server: m.Params[2]}
+	if len(m.Params) > 3 {
+		ret.Comments = m.Params[3]
+	}
+	return ret, nil
+}
+
+type Lusers struct {
+	Users, Invisible, Servers   int
+	Opers, Unknown, Channels    int
+	LocalClients, LocalServers  int
+	LocalUsers, MaxLocalUsers   int
+	GlobalUsers, MaxGlobalUsers int
+}
+
+//Lusers returns the network size statistics
+func (n *Network) Lusers() (*Lusers, os.Error) {
+	myreplies := []string{"RPL_LUSERCLIENT", "RPL_LUSEROP",
+		"RPL_LUSERUNKNOWN", "RPL_LUSERCHANNELS",
+		"RPL_LUSERME", "RPL_LOCALUSERS"}
+	ret := new(Lusers)
+	msgs, err := n.serverQuery(&IrcMessage{"", "LUSERS", []string{}, nil}, "", myreplies, "RPL_GLOBALUSERS")
+	if err == ErrTimeout && len(msgs) > 0 { //265 and 266 are not rfc2812
+		err = nil
+	}
+	for _, m := range msgs {
+		if len(m.Params) < 2 {
+			continue
+		}
+		nums := numbers(strings.Join(m.Params[1:], " "))
+		get := func(i int) int {
+			if i < len(nums) {
+				return nums[i]
+			}
+			return 0
+		}
+		switch m.Cmd {
+		case replies["RPL_LUSERCLIENT"]:
+			ret.Users, ret.Invisible, ret.Servers = get(0), get(1), get(2)
+		case replies["RPL_LUSEROP"]:
+			ret.Opers = get(0)
+		case replies["RPL_LUSERUNKNOWN"]:
+			ret.Unknown = get(0)
+		case replies["RPL_LUSERCHANNELS"]:
+			ret.Channels = get(0)
+		case replies["RPL_LUSERME"]:
+			ret.LocalClients, ret.LocalServers = get(0), get(1)
+		case replies["RPL_LOCALUSERS"]:
+			ret.LocalUsers, ret.MaxLocalUsers = get(0), get(1)
+		case replies["RPL_GLOBALUSERS"]:
+			ret.GlobalUsers, ret.MaxGlobalUsers = get(0), get(1)
+		}
+	}
+	return ret, err
+}
@@ -0,0 +1,316 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//PluginHandler handles the messages of an IRC command (or * for all)
+type PluginHandler func(msg *IrcMessage)
+
+//Plugin is an independent behaviour of a bot, added with RegisterPlugin
+type Plugin interface {
+	Init(c *PluginContext) os.Error     //once, when registered
+	Start() os.Error                    //when enabled, before the commands and handlers are wired
+	Stop()                              //when disabled or unregistered, after they are unwired and the handlers returned
+	Commands() []*Command               //added to the plugin router while enabled
+	Handlers() map[string]PluginHandler //by IRC command, called while enabled
+}
+
+//PluginContext is what a plugin gets in Init
+type PluginContext struct {
+	Net   *Network
+	Name  string
+	Log   *log.Logger  //the network log, prefixed with the plugin name
+	Store *PluginStore //persistent storage of the plugin
+}
+
+//PluginStore keeps the data of a plugin in a JSON file in the network configuration directory
+type PluginStore struct {
+	file string
+	lock *sync.RWMutex
+	data map[string]string
+}
+
+func newPluginStore(dir, name string) (*PluginStore, os.Error) {
+	if err := os.MkdirAll(dir+"/plugins", 0751); err != nil {
+		return nil, err
+	}
+	s := &PluginStore{dir + "/plugins/" + SanitizeFilename(name) + ".json", new(sync.RWMutex), make(map[string]string)}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//save writes the store, with the lock held
+func (s *PluginStore) save() os.Error {
+	data, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.file, data, 0600)
+}
+
+func (s *PluginStore) Get(key string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+//Set stores value under key and saves the store
+func (s *PluginStore) Set(key, value string) os.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data[key] = value
+	return s.save()
+}
+
+func (s *PluginStore) Delete(key string) os.Error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data[key] = "", false
+	return s.save()
+}
+
+func (s *PluginStore) Keys() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.SortStrings(keys)
+	return keys
+}
+
+//writes to a logger through Output, so its prefix and flags come first
+type logWriter struct {
+	l *log.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, os.Error) {
+	return len(p), w.l.Output(4, string(p))
+}
+
+type pluginEntry struct {
+	p        Plugin
+	c        *PluginContext
+	enabled  bool
+	commands []*Command //as added to router
+	router   *Router
+	exch     chan bool       //closed to stop the handlers
+	toggle   *sync.Mutex     //held while enabling or disabling
+	running  *sync.WaitGroup //the handler goroutines
+}
+
+type pluginRegistry struct {
+	lock    *sync.Mutex
+	plugins map[string]*pluginEntry
+	router  *Router
+}
+
+func newPluginRegistry() pluginRegistry {
+	return pluginRegistry{new(sync.Mutex), make(map[string]*pluginEntry), nil}
+}
+
+//SetPluginRouter sets the router plugin commands are added to. Without one, plugins only
+//get their handlers.
+func (n *Network) SetPluginRouter(r *Router) {
+	n.plugins.lock.Lock()
+	defer n.plugins.lock.Unlock()
+	n.plugins.router = r
+}
+
+//protect runs f, logging a panic as an error of the plugin instead of crashing
+func (e *pluginEntry) protect(what string, f func() os.Error) (err os.Error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e.c.Log.Printf("%s panicked: %v", what, x)
+			err = os.NewError(fmt.Sprintf("Plugin %s: %s panicked: %v", e.c.Name, what, x))
+		}
+	}()
+	return f()
+}
+
+//RegisterPlugin initialises p under name, and enables it if enable is true
+func (n *Network) RegisterPlugin(name string, p Plugin, enable bool) os.Error {
+	store, err := newPluginStore(n.getStr(&n.confdir), name)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("Plugin %s: can't open its store: %s", name, err.String()))
+	}
+	c := &PluginContext{n, name, log.New(logWriter{n.l}, "["+name+"] ", 0), store}
+	e := &pluginEntry{p, c, false, nil, nil, nil, new(sync.Mutex), new(sync.WaitGroup)}
+	n.plugins.lock.Lock()
+	if _, ok := n.plugins.plugins[name]; ok {
+		n.plugins.lock.Unlock()
+		return os.NewError(fmt.Sprintf("Plugin %s already registered", name))
+	}
+	n.plugins.plugins[name] = e
+	n.plugins.lock.Unlock()
+	if err := e.protect("Init", func() os.Error { return p.Init(c) }); err != nil {
+		n.plugins.lock.Lock()
+		n.plugins.plugins[name] = nil, false
+		n.plugins.lock.Unlock()
+		return err
+	}
+	if enable {
+		return n.EnablePlugin(name)
+	}
+	return nil
+}
+
+//UnregisterPlugin disables and forgets a plugin
+func (n *Network) UnregisterPlugin(name string) os.Error {
+	if err := n.DisablePlugin(name); err != nil {
+		return err
+	}
+	n.plugins.lock.Lock()
+	defer n.plugins.lock.Unlock()
+	n.plugins.plugins[name] = nil, false
+	return nil
+}
+
+func (n *Network) plugin(name string) (*pluginEntry, os.Error) {
+	n.plugins.lock.Lock()
+	defer n.plugins.lock.Unlock()
+	e, ok := n.plugins.plugins[name]
+	if !ok {
+		return nil, os.NewError(fmt.Sprintf("No such plugin: %s", name))
+	}
+	return e, nil
+}
+
+//EnablePlugin starts a plugin and wires its commands and handlers
+func (n *Network) EnablePlugin(name string) os.Error {
+	e, err := n.plugin(name)
+	if err != nil {
+		return err
+	}
+	e.toggle.Lock()
+	defer e.toggle.Unlock()
+	if e.enabled {
+		return nil
+	}
+	if err := e.protect("Start", func() os.Error { return e.p.Start() }); err != nil {
+		return err
+	}
+	var handlers map[string]PluginHandler
+	e.protect("Handlers", func() os.Error {
+		handlers = e.p.Handlers()
+		return nil
+	})
+	e.exch = make(chan bool)
+	listener := "plugin:" + name + ":" + strconv.Itoa64(time.Nanoseconds())
+	for cmd, h := range handlers {
+		ch := make(chan *IrcMessage, 100)
+		if err := n.Listen.RegListener(cmd, listener, ch); err != nil {
+			e.c.Log.Printf("Can't handle %s: %s", cmd, err.String())
+			continue
+		}
+		e.running.Add(1)
+		go e.run(cmd, listener, h, ch, e.exch)
+	}
+	n.plugins.lock.Lock()
+	e.commands, e.router = make([]*Command, 0), n.plugins.router
+	n.plugins.lock.Unlock()
+	if r := e.router; r != nil {
+		var cmds []*Command
+		e.protect("Commands", func() os.Error {
+			cmds = e.p.Commands()
+			return nil
+		})
+		for _, cmd := range cmds {
+			if err := r.Handle(cmd); err != nil {
+				e.c.Log.Printf("Can't add command: %s", err.String())
+				continue
+			}
+			e.commands = append(e.commands, cmd)
+		}
+	}
+	n.plugins.lock.Lock()
+	e.enabled = true
+	n.plugins.lock.Unlock()
+	return nil
+}
+
+//DisablePlugin unwires the commands and handlers of a plugin, waits for the handlers that are
+//running and stops it. It stays registered and can be enabled again. A handler waiting for
+//itself would never return: plugins disable themselves from a new goroutine.
+func (n *Network) DisablePlugin(name string) os.Error {
+	e, err := n.plugin(name)
+	if err != nil {
+		return err
+	}
+	e.toggle.Lock()
+	defer e.toggle.Unlock()
+	if !e.enabled {
+		return nil
+	}
+	close(e.exch) //stops all the handlers once they are done with their message
+	for _, cmd := range e.commands {
+		e.router.Remove(cmd.Name)
+	}
+	e.commands = nil
+	n.plugins.lock.Lock()
+	e.enabled = false
+	n.plugins.lock.Unlock()
+	e.running.Wait()
+	return e.protect("Stop", func() os.Error {
+		e.p.Stop()
+		return nil
+	})
+}
+
+//PluginEnabled reports whether the plugin name is registered and enabled
+func (n *Network) PluginEnabled(name string) bool {
+	n.plugins.lock.Lock()
+	defer n.plugins.lock.Unlock()
+	e, ok := n.plugins.plugins[name]
+	return ok && e.enabled
+}
+
+//Plugins returns the names of the registered plugins
+func (n *Network) Plugins() []string {
+	n.plugins.lock.Lock()
+	defer n.plugins.lock.Unlock()
+	names := make([]string, 0, len(n.plugins.plugins))
+	for name := range n.plugins.plugins {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+//run calls the handler of an enabled plugin for cmd, panics only cost the message
+func (e *pluginEntry) run(cmd, listener string, h PluginHandler, ch chan *IrcMessage, exch chan bool) {
+	defer e.running.Done()
+	defer e.c.Net.Listen.DelListener(cmd, listener)
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case <-exch:
+			return
+		}
+		e.protect("Handler for "+cmd, func() os.Error {
+			h(msg)
+			return nil
+		})
+	}
+}
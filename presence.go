@@ -0,0 +1,275 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//a watched nick came online or went offline
+type PresenceEvent struct {
+	Nick   string
+	Online bool
+	User   string //empty when the server doesn't tell (ISON, MONITOR offline)
+	Host   string
+}
+
+//Watcher reports when watched nicks come online or go offline. It uses MONITOR when the server
+//supports it, WATCH otherwise, and falls back to polling with ISON.
+type Watcher struct {
+	Events   chan *PresenceEvent
+	n        *Network
+	lock     *sync.Mutex
+	nicks    map[string]string //lower case -> as given
+	online   map[string]bool   //lower case
+	method   string
+	interval int64
+	poll     chan bool
+	exch     chan bool //closed by Stop
+	stop     *sync.Once
+}
+
+//NewWatcher starts a presence watcher; interval is the ISON polling interval in nanoseconds.
+//The watcher survives reconnections and sends its list again to the new server.
+func (n *Network) NewWatcher(interval int64) *Watcher {
+	if interval <= 0 {
+		interval = minute
+	}
+	w := &Watcher{make(chan *PresenceEvent, 100), n, new(sync.Mutex), make(map[string]string), make(map[string]bool),
+		"", interval, make(chan bool, 1), make(chan bool), new(sync.Once)}
+	w.method = w.pickMethod()
+	go w.run()
+	return w
+}
+
+func (w *Watcher) pickMethod() string {
+	if _, ok := w.n.ISupport("MONITOR"); ok {
+		return "MONITOR"
+	} else if _, ok := w.n.ISupport("WATCH"); ok {
+		return "WATCH"
+	}
+	return "ISON"
+}
+
+//Method returns the mechanism in use: MONITOR, WATCH or ISON
+func (w *Watcher) Method() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.method
+}
+
+//send the list changes to the server, prefix is + or -
+func (w *Watcher) sendList(prefix string, nicks []string) {
+	switch w.method {
+	case "MONITOR":
+		for _, batch := range batches(nicks, len("MONITOR + :"), 1) {
+			w.n.queueOut <- &IrcMessage{"", "MONITOR", []string{prefix, strings.Join(batch, ",")}, nil}
+		}
+	case "WATCH":
+		for i, nick := range nicks {
+			nicks[i] = prefix + nick
+		}
+		for _, batch := range batches(nicks, len("WATCH :"), 1) {
+			w.n.queueOut <- &IrcMessage{"", "WATCH", []string{strings.Join(batch, " ")}, nil}
+		}
+	case "ISON":
+		select {
+		case w.poll <- true:
+		default:
+		}
+	}
+}
+
+//Add starts watching nicks
+func (w *Watcher) Add(nicks ...string) os.Error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if max, _ := strconv.Atoi(w.monitorLimit()); max > 0 && len(w.nicks)+len(nicks) > max {
+		return os.NewError(fmt.Sprintf("Can't watch more than %d nicks", max))
+	}
+	added := make([]string, 0)
+	for _, nick := range nicks {
+		if _, ok := w.nicks[strings.ToLower(nick)]; !ok {
+			w.nicks[strings.ToLower(nick)] = nick
+			added = append(added, nick)
+		}
+	}
+	if len(added) > 0 {
+		w.sendList("+", added)
+	}
+	return nil
+}
+
+func (w *Watcher) monitorLimit() string {
+	var limit string
+	switch w.method {
+	case "MONITOR":
+		limit, _ = w.n.ISupport("MONITOR")
+	case "WATCH":
+		limit, _ = w.n.ISupport("WATCH")
+	}
+	return limit
+}
+
+//Remove stops watching nicks
+func (w *Watcher) Remove(nicks ...string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	removed := make([]string, 0)
+	for _, nick := range nicks {
+		if _, ok := w.nicks[strings.ToLower(nick)]; ok {
+			w.nicks[strings.ToLower(nick)] = "", false
+			w.online[strings.ToLower(nick)] = false, false
+			removed = append(removed, nick)
+		}
+	}
+	if len(removed) > 0 && w.method != "ISON" {
+		w.sendList("-", removed)
+	}
+	return
+}
+
+//Online returns the watched nicks that are currently online
+func (w *Watcher) Online() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ret := make([]string, 0)
+	for nick, _ := range w.online {
+		ret = append(ret, w.nicks[nick])
+	}
+	return ret
+}
+
+//Stop stops the watcher and clears the server side list. Calls after the first do nothing.
+func (w *Watcher) Stop() {
+	w.stop.Do(func() {
+		close(w.exch)
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		switch w.method {
+		case "MONITOR":
+			w.n.queueOut <- &IrcMessage{"", "MONITOR", []string{"C"}, nil}
+		case "WATCH":
+			w.n.queueOut <- &IrcMessage{"", "WATCH", []string{"C"}, nil}
+		}
+	})
+	return
+}
+
+//status records a presence change and sends an event if it is news
+func (w *Watcher) status(nick string, online bool, user, host string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	key := strings.ToLower(nick)
+	if _, ok := w.nicks[key]; !ok || w.online[key] == online {
+		return
+	}
+	if online {
+		w.online[key] = true
+	} else {
+		w.online[key] = false, false
+	}
+	select {
+	case w.Events <- &PresenceEvent{nick, online, user, host}:
+	default:
+	}
+}
+
+func (w *Watcher) ison() {
+	w.lock.Lock()
+	nicks := make([]string, 0, len(w.nicks))
+	for _, nick := range w.nicks {
+		nicks = append(nicks, nick)
+	}
+	w.lock.Unlock()
+	if len(nicks) == 0 {
+		return
+	}
+	online, err := w.n.Ison(nicks)
+	if err != nil {
+		return
+	}
+	on := make(map[string]bool)
+	for _, nick := range online {
+		on[strings.ToLower(nick)] = true
+		w.status(nick, true, "", "")
+	}
+	for _, nick := range nicks {
+		if !on[strings.ToLower(nick)] {
+			w.status(nick, false, "", "")
+		}
+	}
+}
+
+//resend the whole list after a reconnection, the server may not even support the same method
+func (w *Watcher) resync() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.method = w.pickMethod()
+	w.online = make(map[string]bool)
+	nicks := make([]string, 0, len(w.nicks))
+	for _, nick := range w.nicks {
+		nicks = append(nicks, nick)
+	}
+	if len(nicks) > 0 {
+		w.sendList("+", nicks)
+	}
+}
+
+func (w *Watcher) run() {
+	myreplies := []string{"RPL_MONONLINE", "RPL_MONOFFLINE",
+		"ERR_MONLISTFULL", "RPL_LOGON",
+		"RPL_LOGOFF", "RPL_NOWON",
+		"RPL_NOWOFF", "ERR_TOOMANYWATCH",
+		"RPL_ENDOFMOTD", "ERR_NOMOTD"}
+	t := "watcher" + strconv.Itoa64(time.Nanoseconds())
+	ch := make(chan *IrcMessage, 100)
+	if err := w.n.listen(myreplies, t, ch); err != nil {
+		w.n.l.Printf("Presence watcher not started: %s", err.String())
+		return
+	}
+	defer w.n.unlisten(myreplies, t)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exch:
+			return
+		case <-ticker.C:
+			if w.Method() == "ISON" {
+				w.ison()
+			}
+		case <-w.poll:
+			w.ison()
+		case msg := <-ch:
+			if len(msg.Params) < 2 {
+				continue
+			}
+			switch msg.Cmd {
+			case replies["RPL_ENDOFMOTD"], replies["ERR_NOMOTD"]: //registered, ISUPPORT is known
+				w.resync()
+			case replies["RPL_MONONLINE"]: //me :nick!user@host,...
+				for _, target := range strings.Split(msg.Params[1], ",", -1) {
+					h := ParseHostmask(target)
+					w.status(h.Nick, true, h.User, h.Host)
+				}
+			case replies["RPL_MONOFFLINE"]: //me :nick,...
+				for _, nick := range strings.Split(msg.Params[1], ",", -1) {
+					w.status(nick, false, "", "")
+				}
+			case replies["RPL_LOGON"], replies["RPL_NOWON"]: //me nick user host time :logged online
+				if len(msg.Params) > 3 {
+					w.status(msg.Params[1], true, msg.Params[2], msg.Params[3])
+				}
+			case replies["RPL_LOGOFF"], replies["RPL_NOWOFF"]:
+				w.status(msg.Params[1], false, "", "")
+			case replies["ERR_MONLISTFULL"], replies["ERR_TOOMANYWATCH"]:
+				w.n.l.Printf("Presence watch list full: %s", msg.String())
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,411 @@
+package ircchans
+
+import (
+	"strings"
+	"sync"
+)
+
+//what we know about other users on the network
+type User struct {
+	Nick    string
+	User    string
+	Host    string
+	Away    bool
+	AwayMsg string
+	Account string //services account, empty if not logged in or unknown
+}
+
+type userMap struct {
+	lock  *sync.RWMutex
+	users map[string]*User //keyed by folded nick
+	fold  func(string) string
+}
+
+func newUserMap(fold func(string) string) userMap {
+	return userMap{new(sync.RWMutex), make(map[string]*User), fold}
+}
+
+func (u *userMap) reset() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.users = make(map[string]*User)
+}
+
+func (u *userMap) get(nick string) (User, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	if usr, ok := u.users[u.fold(nick)]; ok {
+		return *usr, true
+	}
+	return User{}, false
+}
+
+func (u *userMap) seen(nick, user, host string) {
+	if nick == "" || user == "" || host == "" {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	usr, ok := u.users[u.fold(nick)]
+	if !ok {
+		usr = new(User)
+		u.users[u.fold(nick)] = usr
+	}
+	usr.Nick, usr.User, usr.Host = nick, user, host
+}
+
+func (u *userMap) setAway(nick string, away bool, msg string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if usr, ok := u.users[u.fold(nick)]; ok {
+		if away && msg == "" && usr.Away { //still away, keep the message we know
+			return
+		}
+		usr.Away, usr.AwayMsg = away, msg
+	}
+}
+
+func (u *userMap) setAccount(nick, account string) {
+	if account == "*" { //logged out
+		account = ""
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if usr, ok := u.users[u.fold(nick)]; ok {
+		usr.Account = account
+	}
+}
+
+func (u *userMap) rename(oldnick, newnick string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	usr, ok := u.users[u.fold(oldnick)]
+	if !ok {
+		return
+	}
+	u.users[u.fold(oldnick)] = nil, false
+	usr.Nick = newnick
+	u.users[u.fold(newnick)] = usr
+}
+
+func (u *userMap) forget(nick string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.users[u.fold(nick)] = nil, false
+}
+
+//prune forgets the users for whom keep returns false
+func (u *userMap) prune(keep func(string) bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for key, usr := range u.users {
+		if !keep(usr.Nick) {
+			u.users[key] = nil, false
+		}
+	}
+}
+
+//a channel member and its membership prefixes (e.g. "@+" for an op with voice)
+type Member struct {
+	Nick     string
+	Prefixes string
+}
+
+type chanMap struct {
+	lock  *sync.RWMutex
+	chans map[string]map[string]*Member //folded channel -> folded nick
+	fold  func(string) string
+}
+
+func newChanMap(fold func(string) string) chanMap {
+	return chanMap{new(sync.RWMutex), make(map[string]map[string]*Member), fold}
+}
+
+func (c *chanMap) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.chans = make(map[string]map[string]*Member)
+}
+
+//member returns the member entry of nick on ch, creating it, with the lock held
+func (c *chanMap) member(ch, nick string) *Member {
+	members, ok := c.chans[c.fold(ch)]
+	if !ok {
+		members = make(map[string]*Member)
+		c.chans[c.fold(ch)] = members
+	}
+	m, ok := members[c.fold(nick)]
+	if !ok {
+		m = &Member{nick, ""}
+		members[c.fold(nick)] = m
+	}
+	return m
+}
+
+func (c *chanMap) join(ch, nick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.member(ch, nick)
+}
+
+func (c *chanMap) part(ch, nick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if members, ok := c.chans[c.fold(ch)]; ok {
+		members[c.fold(nick)] = nil, false
+	}
+}
+
+//forget drops a channel we left
+func (c *chanMap) forget(ch string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.chans[c.fold(ch)] = nil, false
+}
+
+func (c *chanMap) quit(nick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, members := range c.chans {
+		members[c.fold(nick)] = nil, false
+	}
+}
+
+func (c *chanMap) rename(oldnick, newnick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, members := range c.chans {
+		if m, ok := members[c.fold(oldnick)]; ok {
+			members[c.fold(oldnick)] = nil, false
+			m.Nick = newnick
+			members[c.fold(newnick)] = m
+		}
+	}
+}
+
+//setPrefix adds or removes a membership prefix, keeping them in the server's order (syms)
+func (c *chanMap) setPrefix(ch, nick string, sym byte, add bool, syms string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := c.member(ch, nick)
+	prefixes := ""
+	for i := 0; i < len(syms); i++ {
+		has := strings.IndexRune(m.Prefixes, int(syms[i])) > -1
+		if syms[i] == sym {
+			has = add
+		}
+		if has {
+			prefixes += syms[i : i+1]
+		}
+	}
+	m.Prefixes = prefixes
+}
+
+func (c *chanMap) get(ch, nick string) (Member, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if m, ok := c.chans[c.fold(ch)][c.fold(nick)]; ok {
+		return *m, true
+	}
+	return Member{}, false
+}
+
+//shares tells whether nick is on one of our channels
+func (c *chanMap) shares(nick string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, members := range c.chans {
+		if _, ok := members[c.fold(nick)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *chanMap) members(ch string) []Member {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := make([]Member, 0, len(c.chans[c.fold(ch)]))
+	for _, m := range c.chans[c.fold(ch)] {
+		ret = append(ret, *m)
+	}
+	return ret
+}
+
+//names records a RPL_NAMREPLY entry like @+nick or, with userhost-in-names, @nick!user@host
+func (n *Network) names(ch, entry string) {
+	syms := n.ModeSpec(ch).PrefixSyms
+	i := 0
+	for i < len(entry) && strings.IndexRune(syms, int(entry[i])) > -1 {
+		i++
+	}
+	h := ParseHostmask(entry[i:])
+	n.channels.lock.Lock()
+	n.channels.member(ch, h.Nick).Prefixes = entry[:i]
+	n.channels.lock.Unlock()
+	n.seen(h.Nick, h.User, h.Host)
+}
+
+//seen records the user and host of nick if nick shares a channel with us: nothing would
+//forget the others, as we don't hear of them leaving
+func (n *Network) seen(nick, user, host string) {
+	if n.channels.shares(nick) {
+		n.users.seen(nick, user, host)
+	}
+}
+
+//left forgets nick if it shares no channel with us anymore, everybody who doesn't if nick is us
+func (n *Network) left(nick string) {
+	if n.EqualFold(nick, n.GetNick()) {
+		n.users.prune(n.channels.shares)
+	} else if !n.channels.shares(nick) {
+		n.users.forget(nick)
+	}
+}
+
+//modes records membership mode changes (+o, +v...)
+func (n *Network) modes(msg *IrcMessage) {
+	target, changes, err := n.ParseModeMsg(msg)
+	if err != nil || !n.IsChannel(target) {
+		return
+	}
+	spec := n.ModeSpec(target)
+	for _, c := range changes {
+		if i := strings.IndexRune(spec.Prefix, int(c.Mode)); i > -1 && i < len(spec.PrefixSyms) {
+			n.channels.setPrefix(target, c.Arg, spec.PrefixSyms[i], c.Add, spec.PrefixSyms)
+		}
+	}
+}
+
+//tracker keeps the user and channel maps current from message prefixes, WHOIS/WHO/NAMES
+//replies, JOIN/PART/KICK/MODE, away notifications (away-notify) and account information
+//(account-tag, extended-join, account-notify), and follows our own away state
+func (n *Network) tracker() {
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("tracker", exch)
+	if err != nil {
+		return
+	}
+	defer close(done)
+	ch := make(chan *IrcMessage, 100)
+	n.Listen.regInternal("*", "tracker", ch)
+	defer n.Listen.DelListener("*", "tracker")
+	for {
+		var msg *IrcMessage
+		select {
+		case msg = <-ch:
+		case exit := <-exch:
+			if exit {
+				return
+			}
+			continue
+		}
+		h := msg.Hostmask()
+		nick := h.Nick
+		switch msg.Cmd {
+		case "NICK":
+			if len(msg.Params) > 0 {
+				n.users.rename(nick, msg.Params[0])
+				n.channels.rename(nick, msg.Params[0])
+			}
+			continue
+		case "QUIT":
+			n.users.forget(nick)
+			n.channels.quit(nick)
+			continue
+		}
+		if msg.Cmd == "JOIN" && len(msg.Params) > 0 {
+			n.channels.join(msg.Params[0], nick) //first, seen only keeps users on our channels
+		}
+		n.seen(nick, h.User, h.Host)
+		if h.User != "" && n.HasCap("account-tag") {
+			n.users.setAccount(nick, msg.Tags["account"])
+		}
+		switch msg.Cmd {
+		case "JOIN":
+			if len(msg.Params) > 1 { //extended-join: #chan account :realname
+				n.users.setAccount(nick, msg.Params[1])
+			}
+		case "PART":
+			if len(msg.Params) > 0 {
+				if n.EqualFold(nick, n.GetNick()) {
+					n.channels.forget(msg.Params[0])
+				} else {
+					n.channels.part(msg.Params[0], nick)
+				}
+				n.left(nick)
+			}
+		case "KICK":
+			if len(msg.Params) > 1 {
+				if n.EqualFold(msg.Params[1], n.GetNick()) {
+					n.channels.forget(msg.Params[0])
+				} else {
+					n.channels.part(msg.Params[0], msg.Params[1])
+				}
+				n.left(msg.Params[1])
+			}
+		case "MODE":
+			n.modes(msg)
+		case "ACCOUNT": //account-notify
+			if len(msg.Params) > 0 {
+				n.users.setAccount(nick, msg.Params[0])
+			}
+		case "AWAY": //away-notify
+			if len(msg.Params) > 0 && msg.Params[0] != "" {
+				n.users.setAway(nick, true, msg.Params[0])
+			} else {
+				n.users.setAway(nick, false, "")
+			}
+		case replies["RPL_NAMREPLY"]: //me = #chan :@nick +nick nick
+			if len(msg.Params) > 3 {
+				for _, entry := range strings.Fields(msg.Params[3]) {
+					n.names(msg.Params[2], entry)
+				}
+			}
+		case replies["RPL_WHOISUSER"]: //me nick user host * :realname
+			if len(msg.Params) > 3 {
+				n.seen(msg.Params[1], msg.Params[2], msg.Params[3])
+			}
+		case replies["RPL_WHOISACCOUNT"]: //me nick account :is logged in as
+			if len(msg.Params) > 2 {
+				n.users.setAccount(msg.Params[1], msg.Params[2])
+			}
+		case replies["RPL_WHOREPLY"]: //me chan user host server nick flags :hops realname
+			if len(msg.Params) > 6 {
+				n.seen(msg.Params[5], msg.Params[2], msg.Params[3])
+				if f := msg.Params[6]; strings.HasPrefix(f, "G") || strings.HasPrefix(f, "H") { //gone or here
+					n.users.setAway(msg.Params[5], f[0] == 'G', "")
+				}
+			}
+		case replies["RPL_AWAY"]: //me nick :message
+			if len(msg.Params) > 2 {
+				n.users.setAway(msg.Params[1], true, msg.Params[2])
+			}
+		case replies["RPL_NOWAWAY"]:
+			n.lock.Lock()
+			n.away = true
+			n.lock.Unlock()
+		case replies["RPL_UNAWAY"]:
+			n.lock.Lock()
+			n.away, n.awayReason = false, ""
+			n.lock.Unlock()
+		}
+	}
+	return
+}
+
+//LookupUser returns what we know about nick. Only users sharing a channel with us are tracked.
+func (n *Network) LookupUser(nick string) (User, bool) {
+	return n.users.get(nick)
+}
+
+//ChannelMember returns the membership of nick on channel, ok is false if nick isn't known
+//to be there. Only channels we are on are tracked.
+func (n *Network) ChannelMember(channel, nick string) (Member, bool) {
+	return n.channels.get(channel, nick)
+}
+
+//ChannelMembers returns the known members of channel
+func (n *Network) ChannelMembers(channel string) []Member {
+	return n.channels.members(channel)
+}
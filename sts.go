@@ -0,0 +1,134 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//StsPolicy is an IRCv3 Strict Transport Security policy: until it expires, its host is only
+//connected to with TLS, on Port
+type StsPolicy struct {
+	Port     int
+	Duration int64 //seconds, restarted at each disconnection
+	Expires  int64 //in seconds since the epoch
+}
+
+//stsUpgrade is returned by Register when a plain text server asks us to come back over TLS
+type stsUpgrade struct {
+	port string
+}
+
+func (e *stsUpgrade) String() string {
+	return fmt.Sprintf("Server has an STS policy, reconnecting with TLS on port %s", e.port)
+}
+
+var stsLock = new(sync.Mutex) //guards the policy files
+
+//parseSts splits the value of the sts capability, e.g. port=6697,duration=300
+func parseSts(value string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(value, ",", -1) {
+		if i := strings.Index(kv, "="); i > -1 {
+			params[kv[:i]] = kv[i+1:]
+		} else {
+			params[kv] = ""
+		}
+	}
+	return params
+}
+
+//stsApplies tells whether policies concern the connections of the network: not when TLS is
+//off, nor over WebSocket, a Unix socket or a handed out connection
+func (n *Network) stsApplies() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.tlsMode != TlsOff && !plainDialer(n.dialer) && !isWsURL(n.network)
+}
+
+//stsFile keeps the policies of the network, by host
+func (n *Network) stsFile() string {
+	return n.getStr(&n.confdir) + "/sts.json"
+}
+
+func readStsPolicies(file string) (map[string]StsPolicy, os.Error) {
+	policies := make(map[string]StsPolicy)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+			return policies, nil
+		}
+		return nil, err
+	}
+	return policies, json.Unmarshal(data, &policies)
+}
+
+func writeStsPolicies(file string, policies map[string]StsPolicy) os.Error {
+	data, err := json.Marshal(policies)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+//StsPolicy returns the policy of the network host, if there is one that hasn't expired
+func (n *Network) StsPolicy() (StsPolicy, bool) {
+	return n.stsPolicy(n.GetNetName())
+}
+
+func (n *Network) stsPolicy(host string) (StsPolicy, bool) {
+	stsLock.Lock()
+	defer stsLock.Unlock()
+	policies, err := readStsPolicies(n.stsFile())
+	if err != nil {
+		n.l.Printf("Can't read STS policies: %s", err.String())
+		return StsPolicy{}, false
+	}
+	p, ok := policies[strings.ToLower(host)]
+	return p, ok && p.Expires > time.Seconds()
+}
+
+//updateSts records the sts value advertised on a secure connection to host:port. A duration
+//of 0 removes the policy.
+func (n *Network) updateSts(host string, port int, value string) os.Error {
+	duration, err := strconv.Atoi64(parseSts(value)["duration"])
+	if err != nil || duration < 0 {
+		return os.NewError(fmt.Sprintf("Bad STS policy: %s", value))
+	}
+	stsLock.Lock()
+	defer stsLock.Unlock()
+	policies, err := readStsPolicies(n.stsFile())
+	if err != nil {
+		return err
+	}
+	host = strings.ToLower(host)
+	if duration == 0 {
+		policies[host] = StsPolicy{}, false
+	} else {
+		policies[host] = StsPolicy{port, duration, time.Seconds() + duration}
+	}
+	return writeStsPolicies(n.stsFile(), policies)
+}
+
+//refreshSts restarts the policy of host, as clients are to do when they disconnect
+func (n *Network) refreshSts(host string) {
+	stsLock.Lock()
+	defer stsLock.Unlock()
+	policies, err := readStsPolicies(n.stsFile())
+	if err != nil {
+		return
+	}
+	host = strings.ToLower(host)
+	if p, ok := policies[host]; ok && p.Expires > time.Seconds() {
+		p.Expires = time.Seconds() + p.Duration
+		policies[host] = p
+		if err := writeStsPolicies(n.stsFile(), policies); err != nil {
+			n.l.Printf("Can't write STS policies: %s", err.String())
+		}
+	}
+}
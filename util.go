@@ -4,33 +4,25 @@ import (
 	"time"
 )
 
-func (n *Network) pinger() {
+func (n *Network) ponger() {
 	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
+	done, err := n.Shutdown.regName("ponger", exch)
 	if err != nil {
 		return
 	}
-	ticker1 := time.NewTicker(minute)
-	defer ticker1.Stop()
-	ticker15 := time.NewTicker(minute * 15)
-	defer ticker15.Stop()
-	tick := make(chan *IrcMessage)
-	var lastMessage int64
-	n.Listen.RegListener("*", "ticker", tick)
-	defer n.Listen.DelListener("*", "ticker") //close channel and delete listener
-	for {
+	defer close(done)
+	pingch := make(chan *IrcMessage)
+	n.Listen.RegListener("PING", "ponger", pingch)
+	defer n.Listen.DelListener("PING", "ponger")
+	for !closed(pingch) {
 		select {
-		case <-ticker1.C:
-			if time.Seconds()-lastMessage >= 60*4 { //ping about every five minutes if there is no activity at all
-				n.Ping()
-				n.l.Printf("Network lag is: %d nanoseconds", n.lag)
+		case p := <-pingch:
+			if p == nil {
+				n.l.Println("Something bad happened, ponger returning")
+				n.connError("Software error")
+				return
 			}
-		case <-ticker15.C:
-			//Ping every 15 minutes.
-			n.Ping()
-			n.l.Printf("Network lag is: %d nanoseconds", n.lag)
-		case <-tick:
-			lastMessage = time.Seconds()
+			n.Pong(p.Params[0])
 		case exit := <-exch:
 			if exit {
 				return
@@ -41,24 +33,66 @@ func (n *Network) pinger() {
 	return
 }
 
-func (n *Network) ponger() {
+var autoAwayCheck int64 = minute / 4 //how often autoAway checks the idle time
+
+const defAutoAwayReason = "Idle"
+
+//SetAutoAway marks us away with reason after idle nanoseconds without sending any PRIVMSG,
+//and back as soon as we send one again. An idle time of 0 disables auto-away, an empty reason
+//is defAutoAwayReason (an empty AWAY would mean back).
+func (n *Network) SetAutoAway(idle int64, reason string) {
+	if reason == "" {
+		reason = defAutoAwayReason
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.autoAwayIdle, n.autoAwayReason = idle, reason
+}
+
+func (n *Network) autoAway() {
 	exch := make(chan bool, 0)
-	err := n.Shutdown.Reg(exch)
+	done, err := n.Shutdown.regName("autoAway", exch)
 	if err != nil {
 		return
 	}
-	pingch := make(chan *IrcMessage)
-	n.Listen.RegListener("PING", "ponger", pingch)
-	defer n.Listen.DelListener("PING", "ponger")
-	for !closed(pingch) {
+	defer close(done)
+	ticker := time.NewTicker(autoAwayCheck)
+	defer ticker.Stop()
+	sent := make(chan *IrcMessage, 10)
+	n.OutListen.RegListener("PRIVMSG", "autoaway", sent)
+	defer n.OutListen.DelListener("PRIVMSG", "autoaway")
+	lastMessage, awaySent := time.Nanoseconds(), int64(0)
+	autoAway, pending := false, false //did we set the away state ourselves, is an AWAY waiting for its reply?
+	result := make(chan bool, 1)      //autoAway once the AWAY is answered, Away runs apart so as not to hold up Close
+	away := func(reason string) {
+		pending = true
+		go func() {
+			err := n.Away(reason)
+			result <- (reason != "") == (err == nil)
+		}()
+	}
+	for {
 		select {
-		case p := <-pingch:
-			if p == nil {
-				n.l.Println("Something bad happened, ponger returning")
-				n.Disconnect("Software error")
-				return
+		case <-ticker.C:
+			n.lock.RLock()
+			idle, reason := n.autoAwayIdle, n.autoAwayReason
+			n.lock.RUnlock()
+			if idle > 0 && !autoAway && !pending && time.Nanoseconds()-lastMessage >= idle {
+				if isAway, _ := n.IsAway(); !isAway {
+					awaySent = time.Nanoseconds()
+					away(reason)
+				}
+			}
+		case <-sent:
+			lastMessage = time.Nanoseconds()
+			if autoAway && !pending {
+				away("")
+			}
+		case autoAway = <-result:
+			pending = false
+			if autoAway && lastMessage > awaySent { //we talked while going away
+				away("")
 			}
-			n.Pong(p.Params[0])
 		case exit := <-exch:
 			if exit {
 				return
@@ -70,19 +104,29 @@ func (n *Network) ponger() {
 }
 
 func (n *Network) logger() {
+	exch := make(chan bool, 0)
+	done, err := n.Shutdown.regName("logger", exch)
+	if err != nil {
+		return
+	}
+	defer close(done)
 	inch := make(chan *IrcMessage, 10)
 	outch := make(chan *IrcMessage, 10)
 	n.Listen.RegListener("*", "logger", inch)
+	defer n.Listen.DelListener("*", "logger")
 	n.OutListen.RegListener("*", "logger", outch)
+	defer n.OutListen.DelListener("*", "logger")
 	for {
 		select {
 		case m := <-inch:
 			n.l.Printf("<<< %#v", m)
 		case m := <-outch:
 			n.l.Printf(">>> %#v", m)
+		case exit := <-exch:
+			if exit {
+				return
+			}
 		}
 	}
-	n.Listen.DelListener("*", "logger")
-	n.OutListen.DelListener("*", "logger")
 	return
 }
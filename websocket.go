@@ -0,0 +1,323 @@
+package ircchans
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"net"
+	"bufio"
+	"strings"
+	"sync"
+	"time"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+)
+
+//the IRCv3 WebSocket subprotocols: binary frames can carry any encoding, text ones only UTF-8
+const (
+	wsBinary = "binary.ircv3.net"
+	wsText   = "text.ircv3.net"
+	wsGuid   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" //RFC 6455
+	wsMaxMsg = 1 << 16                                //way more than any IRC line
+)
+
+//WebSocketDialer connects to an IRC over WebSocket gateway. Each IRC line is sent in its own
+//frame, so the rest of Network sees the usual CRLF separated lines. Connect uses it when the
+//network is a ws:// or wss:// URL.
+type WebSocketDialer struct {
+	URL       string //ws://host[:port][/path] or wss://...
+	Origin    string //sent if not empty, some gateways check it
+	TlsConfig *tls.Config
+	Forward   Dialer //reaches the gateway, directly if nil
+}
+
+//parseWsURL returns whether url is wss://, the host, host:port and the path of url
+func parseWsURL(url string) (bool, string, string, string, os.Error) {
+	secure, port := false, "80"
+	switch {
+	case strings.HasPrefix(url, "ws://"):
+		url = url[len("ws://"):]
+	case strings.HasPrefix(url, "wss://"):
+		url, secure, port = url[len("wss://"):], true, "443"
+	default:
+		return false, "", "", "", os.NewError(fmt.Sprintf("Not a WebSocket URL: %s", url))
+	}
+	hostport, path := url, "/"
+	if i := strings.Index(url, "/"); i > -1 {
+		hostport, path = url[:i], url[i:]
+	}
+	if i := strings.LastIndex(hostport, ":"); i == -1 || i < strings.LastIndex(hostport, "]") {
+		hostport += ":" + port
+	}
+	host, _, err := splitAddr(hostport)
+	return secure, host, hostport, path, err
+}
+
+func isWsURL(url string) bool {
+	return strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")
+}
+
+//wsAccept returns the Sec-WebSocket-Accept answer to key
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGuid))
+	sum := h.Sum()
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(enc, sum)
+	return string(enc)
+}
+
+func (d WebSocketDialer) Dial(addr string) (net.Conn, os.Error) {
+	secure, host, hostport, path, err := parseWsURL(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	forward := d.Forward
+	if forward == nil {
+		forward = DirectDialer{}
+	}
+	conn, err := forward.Dial(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		config := d.TlsConfig
+		if config == nil {
+			config = &tls.Config{Rand: rand.Reader}
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		tconn := tls.Client(conn, config)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	ws, err := d.handshake(conn, hostport, path)
+	if err != nil {
+		conn.Close()
+		return nil, os.NewError(fmt.Sprintf("WebSocket %s: %s", d.URL, err.String()))
+	}
+	return ws, nil
+}
+
+func (d WebSocketDialer) handshake(conn net.Conn, hostport, path string) (net.Conn, os.Error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := make([]byte, base64.StdEncoding.EncodedLen(len(nonce)))
+	base64.StdEncoding.Encode(key, nonce)
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: %s, %s\r\n",
+		path, hostport, key, wsBinary, wsText)
+	if d.Origin != "" {
+		req += fmt.Sprintf("Origin: %s\r\n", d.Origin)
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(status); len(fields) < 2 || fields[1] != "101" {
+		return nil, os.NewError(strings.TrimSpace(status))
+	}
+	headers := make(map[string]string)
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if l = strings.TrimSpace(l); l == "" {
+			break
+		}
+		if i := strings.Index(l, ":"); i > -1 {
+			headers[strings.ToLower(l[:i])] = strings.TrimSpace(l[i+1:])
+		}
+	}
+	if headers["sec-websocket-accept"] != wsAccept(string(key)) {
+		return nil, os.NewError("Bad Sec-WebSocket-Accept")
+	}
+	proto := headers["sec-websocket-protocol"]
+	if proto != "" && proto != wsBinary && proto != wsText {
+		return nil, os.NewError(fmt.Sprintf("Unknown subprotocol %s", proto))
+	}
+	return newWsConn(conn, r, proto == wsBinary, true), nil
+}
+
+//wsConn turns lines written into frames, and frames read into lines
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	binary bool
+	client bool //clients mask their frames, servers don't
+	wlock  *sync.Mutex
+	wbuf   []byte //written after the last line end
+	rbuf   []byte //the rest of the last message read
+	msg    []byte //a fragmented message being read
+}
+
+func newWsConn(conn net.Conn, r *bufio.Reader, binary, client bool) *wsConn {
+	return &wsConn{conn, r, binary, client, new(sync.Mutex), nil, nil, nil}
+}
+
+//writeFrame sends a whole frame, with wlock held
+func (c *wsConn) writeFrame(op byte, payload []byte) os.Error {
+	hdr := []byte{0x80 | op, 0}
+	l := len(payload)
+	switch {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l < 1<<16:
+		hdr[1] = 126
+		hdr = append(hdr, byte(l>>8), byte(l))
+	default:
+		hdr[1] = 127
+		for i := 7; i >= 0; i-- {
+			hdr = append(hdr, byte(uint64(l)>>(8*uint(i))))
+		}
+	}
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask...)
+		masked := make([]byte, l)
+		for i, b := range payload {
+			masked[i] = b ^ mask[i%4]
+		}
+		payload = masked
+	}
+	_, err := c.Conn.Write(append(hdr, payload...))
+	return err
+}
+
+//Write sends every complete line in its own frame, without the line end
+func (c *wsConn) Write(b []byte) (int, os.Error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+	op := byte(1)
+	if c.binary {
+		op = 2
+	}
+	for i := 0; i < len(c.wbuf); i++ {
+		if c.wbuf[i] != '\n' {
+			continue
+		}
+		end := i
+		if end > 0 && c.wbuf[end-1] == '\r' {
+			end--
+		}
+		if err := c.writeFrame(op, c.wbuf[:end]); err != nil {
+			return 0, err
+		}
+		c.wbuf, i = c.wbuf[i+1:], -1
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err os.Error) {
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(c.r, hdr); err != nil {
+		return
+	}
+	fin, op = hdr[0]&0x80 != 0, hdr[0]&0x0f
+	l := uint64(hdr[1] & 0x7f)
+	if l >= 126 {
+		ext := make([]byte, 2)
+		if l == 127 {
+			ext = make([]byte, 8)
+		}
+		if _, err = io.ReadFull(c.r, ext); err != nil {
+			return
+		}
+		l = 0
+		for _, b := range ext {
+			l = l<<8 | uint64(b)
+		}
+	}
+	if l > wsMaxMsg {
+		err = os.NewError(fmt.Sprintf("WebSocket frame too big: %d bytes", l))
+		return
+	}
+	var mask []byte
+	if hdr[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(c.r, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, l)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+	return
+}
+
+//Read returns the messages received as CRLF terminated lines, answering pings and closes
+func (c *wsConn) Read(b []byte) (int, os.Error) {
+	for len(c.rbuf) == 0 {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case 0, 1, 2: //continuation, text, binary
+			if len(c.msg)+len(payload) > wsMaxMsg {
+				return 0, os.NewError("WebSocket message too big")
+			}
+			c.msg = append(c.msg, payload...)
+			if fin {
+				c.rbuf = append(c.msg, '\r', '\n')
+				c.msg = nil
+			}
+		case 8: //close
+			c.wlock.Lock()
+			c.writeFrame(8, payload)
+			c.wlock.Unlock()
+			return 0, os.EOF
+		case 9: //ping
+			c.wlock.Lock()
+			err = c.writeFrame(10, payload)
+			c.wlock.Unlock()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+//Close sends a close frame if it can within a second, a write blocked on a dead peer holding
+//the lock otherwise, then closes the connection, which ends such writes
+func (c *wsConn) Close() os.Error {
+	sent := make(chan bool, 1)
+	go func() {
+		c.wlock.Lock()
+		c.writeFrame(8, []byte{0x03, 0xe8})
+		c.wlock.Unlock()
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(second):
+	}
+	return c.Conn.Close()
+}